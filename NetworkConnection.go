@@ -16,50 +16,242 @@
 package sansnetwork
 
 import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/chain"
+	"github.com/sanscentral/sansnetwork/inventory"
+	"github.com/sanscentral/sansnetwork/message"
 	"github.com/sanscentral/sansnetwork/node"
 )
 
+const (
+	// Delay between attempts to top-up the connection pool
+	seedRetryDelaySec = 5
+
+	// Number of recently seen inventory hashes remembered for deduplication
+	seenInventorySize = 50000
+)
+
 // NetworkConnection is a self-managing connection to the bitcoin network
 type NetworkConnection struct {
-	nodes              []node.Connection
-	die                bool
+	mu                 sync.Mutex
+	nodes              []*node.Connection
 	testnet            bool
+	params             *chain.Params // Network rules announced headers are checked against
 	requestedNodeCount int
+	broadcastPeers     int
+	feeFilter          int64
+	requiredServices   node.ServiceFlag
+	v2Transport        bool
+	compactBlocks      bool
+	ctx                context.Context
+	cancel             context.CancelFunc
+	wg                 sync.WaitGroup
+	events             *node.Bus
+	newInventory       *node.Bus
+	seen               *inventory.SeenCache
+	announced          *inventory.SeenCache
+	headerRequests     map[[32]byte]time.Time
+	blockRequests      map[*node.Connection]int            // Outstanding getblocks by node
+	blockReplies       map[[32]byte]time.Time              // Block hashes received in reply to getblocks
+	headerSyncs        map[*node.Connection][]*chain.Chain // Chains with getheaders outstanding by node
+	adjustedTime       *chain.MedianTime
 }
 
-// NewNetworkConnection starts a new connection to the bitcoin network
-func NewNetworkConnection(nodeCount int, testnet bool) (NetworkConnection, error) {
-	newc := NetworkConnection{
+// NewNetworkConnection starts a new connection to the bitcoin network.
+// The connection is kept alive until ctx is cancelled or Close is called
+func NewNetworkConnection(ctx context.Context, nodeCount int, testnet bool) (*NetworkConnection, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	params := &chain.MainNetParams
+	if testnet {
+		params = &chain.TestNet3Params
+	}
+	newc := &NetworkConnection{
 		testnet:            testnet,
+		params:             params,
 		requestedNodeCount: nodeCount,
+		requiredServices:   node.DefaultRequiredServices,
+		ctx:                ctx,
+		cancel:             cancel,
+		events:             node.NewBus(),
+		newInventory:       node.NewBus(),
+		seen:               inventory.NewSeenCache(seenInventorySize),
+		announced:          inventory.NewSeenCache(announcedBlocksSize),
+		headerRequests:     map[[32]byte]time.Time{},
+		blockRequests:      map[*node.Connection]int{},
+		blockReplies:       map[[32]byte]time.Time{},
+		headerSyncs:        map[*node.Connection][]*chain.Chain{},
+		adjustedTime:       chain.NewMedianTime(),
 	}
-	go newc.seedConnectionPool()
+	newc.Subscribe(node.ByCommand(message.CommandInventory), newc.recordInventory)
+	newc.Subscribe(node.ByCommand(message.CommandTx), newc.linkTxIDs)
+	newc.Subscribe(node.ByType(node.EventPeerConnected), newc.sendFeeFilter)
+	newc.Subscribe(node.ByType(node.EventPeerConnected), newc.recordTimeOffset)
+	newc.Subscribe(node.ByCommand(message.CommandHeaders), newc.handleHeaders)
+	newc.Subscribe(node.ByCommand(message.CommandCmpctBlock), newc.handleCmpctBlock)
+	newc.SubscribeInventory(newc.handleBlockInventory, inventory.TypeBlock)
+	newc.wg.Add(1)
+	go newc.seedConnectionPool(ctx)
 	return newc, nil
 }
 
-// Close connection to the bitcoin network
-func (c *NetworkConnection) Close() {
-	for _, n := range c.nodes {
-		n.Close()
+// Close connection to the bitcoin network, waiting for
+// all node connections to shut down
+func (c *NetworkConnection) Close() error {
+	c.cancel()
+
+	c.mu.Lock()
+	nodes := append([]*node.Connection{}, c.nodes...)
+	c.mu.Unlock()
+
+	var err error
+	for _, n := range nodes {
+		if cerr := n.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
 	}
+	c.wg.Wait()
+	return err
 }
 
 // NodeCount returns the number of active nodes
 // this Network Connection is connected to
 func (c *NetworkConnection) NodeCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return len(c.nodes)
 }
 
-// TODO: Periodically check if connections are alive and top-up as needed 'node.connected will be false for dead connections'
-func (c *NetworkConnection) seedConnectionPool() {
-	for len(c.nodes) < c.requestedNodeCount {
-		if c.die {
-			break
+// SetRequiredServices sets the services nodes must offer to join the pool,
+// in addition to being full witness nodes. It applies to nodes connected later
+func (c *NetworkConnection) SetRequiredServices(services node.ServiceFlag) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requiredServices = services
+}
+
+// SetV2Transport enables the BIP0324 encrypted transport for nodes connected
+// later. Nodes not supporting it are connected to with the v1 transport
+func (c *NetworkConnection) SetV2Transport(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.v2Transport = enabled
+}
+
+// Nodes returns the nodes currently in the pool
+func (c *NetworkConnection) Nodes() []*node.Connection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*node.Connection{}, c.nodes...)
+}
+
+// SetFeeFilter asks every node in the pool, including nodes connected later, not
+// to announce transactions paying less than feeRate satoshis per kilobyte.
+// A feeRate of 0 removes the filter
+func (c *NetworkConnection) SetFeeFilter(feeRate int64) {
+	c.mu.Lock()
+	c.feeFilter = feeRate
+	c.mu.Unlock()
+	for _, n := range c.Nodes() {
+		n.SendFeeFilter(feeRate)
+	}
+}
+
+// sendFeeFilter sends the configured fee filter to newly connected nodes
+func (c *NetworkConnection) sendFeeFilter(e node.Event) {
+	c.mu.Lock()
+	feeRate := c.feeFilter
+	c.mu.Unlock()
+	if feeRate > 0 {
+		e.Peer.SendFeeFilter(feeRate)
+	}
+}
+
+// AdjustedTime returns the network adjusted time, the system clock adjusted by
+// the median clock offset of nodes connected to, for use with Chain.SetTimeSource
+func (c *NetworkConnection) AdjustedTime() *chain.MedianTime {
+	return c.adjustedTime
+}
+
+// recordTimeOffset samples the clock offset of newly connected nodes, once per address
+func (c *NetworkConnection) recordTimeOffset(e node.Event) {
+	host, _, err := net.SplitHostPort(e.Peer.Host())
+	if err != nil {
+		host = e.Peer.Host()
+	}
+	c.adjustedTime.AddSample(host, e.Peer.TimeOffset())
+}
+
+// Subscribe calls h for every event from any node in the pool matching f,
+// handlers may be called concurrently from different nodes
+func (c *NetworkConnection) Subscribe(f node.EventFilter, h node.EventHandler) *node.Subscription {
+	return c.events.Subscribe(f, h)
+}
+
+// SubscribeChan sends every event from any node in the pool matching f to ch
+// without blocking the nodes' readers, see node.Bus.SubscribeChan
+func (c *NetworkConnection) SubscribeChan(f node.EventFilter, ch chan<- node.Event) *node.Subscription {
+	return c.events.SubscribeChan(f, ch)
+}
+
+// seedConnectionPool keeps the pool topped up to the requested node count until ctx is done
+func (c *NetworkConnection) seedConnectionPool(ctx context.Context) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(seedRetryDelaySec * time.Second)
+	defer ticker.Stop()
+
+	for {
+		for c.NodeCount() < c.requestedNodeCount {
+			c.mu.Lock()
+			opts := node.Options{RequiredServices: c.requiredServices, V2Transport: c.v2Transport}
+			c.mu.Unlock()
+			n, err := node.NewConnectionWithOptions(ctx, c.testnet, opts)
+			if err != nil {
+				break
+			}
+			c.addNode(ctx, n)
 		}
-		node, err := node.NewConnection(c.testnet)
-		if err != nil {
-			continue
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// addNode adds n to the pool and runs it until it is closed or goes away
+func (c *NetworkConnection) addNode(ctx context.Context, n *node.Connection) {
+	c.mu.Lock()
+	c.nodes = append(c.nodes, n)
+	c.mu.Unlock()
+
+	// Forward node events to pool subscribers. This runs on the node's reader,
+	// handlers from Subscribe are called inline and channel subscribers are
+	// fed through their own buffer so only slow handlers can stall the node
+	sub := n.Subscribe(nil, c.events.Publish)
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		n.Run(ctx)
+		n.Close()
+		c.removeNode(n)
+		sub.Unsubscribe()
+	}()
+}
+
+// removeNode drops n from the pool
+func (c *NetworkConnection) removeNode(n *node.Connection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, e := range c.nodes {
+		if e == n {
+			c.nodes = append(c.nodes[:i], c.nodes[i+1:]...)
+			return
 		}
-		c.nodes = append(c.nodes, node)
 	}
 }
@@ -0,0 +1,122 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package address
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+const (
+	mainnetPubKeyHash = 0x00
+	mainnetScriptHash = 0x05
+	testnetPubKeyHash = 0x6f
+	testnetScriptHash = 0xc4
+	mainnetHRP        = "bc"
+	testnetHRP        = "tb"
+
+	opDup         = 0x76
+	opHash160     = 0xa9
+	opEqual       = 0x87
+	opEqualVerify = 0x88
+	opCheckSig    = 0xac
+	op0           = 0x00
+	op1           = 0x51
+)
+
+// ErrInvalidAddress is returned for addresses which cannot be decoded for the network
+var ErrInvalidAddress = errors.New("invalid address")
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// ToScript returns the output script paying to a P2PKH, P2SH or segwit address
+func ToScript(addr string, testnet bool) ([]byte, error) {
+	hrp := mainnetHRP
+	if testnet {
+		hrp = testnetHRP
+	}
+	if strings.HasPrefix(strings.ToLower(addr), hrp+"1") {
+		version, program, err := decodeSegwit(hrp, addr)
+		if err != nil {
+			return nil, err
+		}
+		op := byte(op0)
+		if version > 0 {
+			op = op1 + version - 1
+		}
+		return append([]byte{op, byte(len(program))}, program...), nil
+	}
+
+	version, hash, err := decodeBase58Check(addr)
+	if err != nil || len(hash) != 20 {
+		return nil, ErrInvalidAddress
+	}
+	pkh, sh := byte(mainnetPubKeyHash), byte(mainnetScriptHash)
+	if testnet {
+		pkh, sh = testnetPubKeyHash, testnetScriptHash
+	}
+	switch version {
+	case pkh:
+		s := []byte{opDup, opHash160, 20}
+		s = append(s, hash...)
+		return append(s, opEqualVerify, opCheckSig), nil
+	case sh:
+		s := []byte{opHash160, 20}
+		s = append(s, hash...)
+		return append(s, opEqual), nil
+	}
+	return nil, ErrInvalidAddress
+}
+
+// decodeBase58 returns the bytes encoded by a base58 string
+func decodeBase58(s string) ([]byte, error) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	for _, c := range []byte(s) {
+		i := strings.IndexByte(base58Alphabet, c)
+		if i < 0 {
+			return nil, ErrInvalidAddress
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(i)))
+	}
+	b := n.Bytes()
+	for _, c := range []byte(s) {
+		if c != base58Alphabet[0] {
+			break
+		}
+		b = append([]byte{0}, b...)
+	}
+	return b, nil
+}
+
+// decodeBase58Check returns the version byte and payload of a base58check string
+func decodeBase58Check(s string) (byte, []byte, error) {
+	b, err := decodeBase58(s)
+	if err != nil || len(b) < 5 {
+		return 0, nil, ErrInvalidAddress
+	}
+	payload, chk := b[:len(b)-4], b[len(b)-4:]
+	h := sha256.Sum256(payload)
+	h = sha256.Sum256(h[:])
+	if !bytes.Equal(h[:4], chk) {
+		return 0, nil, ErrInvalidAddress
+	}
+	return payload[0], payload[1:], nil
+}
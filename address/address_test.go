@@ -0,0 +1,138 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package address
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestSegwitAddresses(t *testing.T) {
+	tests := []struct {
+		addr    string
+		testnet bool
+		script  string
+	}{
+		{"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4", false, "0014751e76e8199196d454941c45d1b3a323f1433bd6"},
+		{"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7", true, "00201863143c14c5166804bd19203356da136c985678cd4d27a1b8c6329604903262"},
+		{"bc1pw508d6qejxtdg4y5r3zarvary0c5xw7kw508d6qejxtdg4y5r3zarvary0c5xw7kt5nd6y", false, "5128751e76e8199196d454941c45d1b3a323f1433bd6751e76e8199196d454941c45d1b3a323f1433bd6"},
+		{"BC1SW50QGDZ25J", false, "6002751e"},
+		{"bc1zw508d6qejxtdg4y5r3zarvaryvaxxpcs", false, "5210751e76e8199196d454941c45d1b3a323"},
+		{"tb1qqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesrxh6hy", true, "0020000000c4a5cad46221b2a187905e5266362b99d5e91c6ce24d165dab93e86433"},
+		{"tb1pqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesf3hn0c", true, "5120000000c4a5cad46221b2a187905e5266362b99d5e91c6ce24d165dab93e86433"},
+		{"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0", false, "512079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"},
+	}
+	for _, test := range tests {
+		script, err := ToScript(test.addr, test.testnet)
+		if err != nil {
+			t.Errorf("%s: %v", test.addr, err)
+			continue
+		}
+		if got := hex.EncodeToString(script); got != test.script {
+			t.Errorf("%s: script %s, want %s", test.addr, got, test.script)
+		}
+	}
+}
+
+func TestInvalidSegwitAddresses(t *testing.T) {
+	tests := []struct {
+		addr    string
+		testnet bool
+	}{
+		{"tc1qw508d6qejxtdg4y5r3zarvary0c5xw7kg3g4ty", false},                                   // Invalid human readable part
+		{"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t5", false},                                   // Invalid checksum
+		{"BC13W508D6QEJXTDG4Y5R3ZARVARY0C5XW7KN40WF2", false},                                   // Invalid witness version
+		{"bc1rw5uspcuh", false},                                                                 // Invalid program length
+		{"bc10w508d6qejxtdg4y5r3zarvary0c5xw7kw508d6qejxtdg4y5r3zarvary0c5xw7kw5rljs90", false}, // Invalid program length
+		{"BC1QR508D6QEJXTDG4Y5R3ZARVARYV98GJ9P", false},                                         // Invalid program length for version 0
+		{"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sL5k7", true},                // Mixed case
+		{"bc1zw508d6qejxtdg4y5r3zarvaryvqyzf3du", false},                                        // Zero padding of more than 4 bits
+		{"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3pjxtptv", true},                // Non-zero padding
+		{"bc1gmk9yu", false}, // Empty data section
+		{"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqh2y7hd", false}, // Version 1 with a bech32 checksum
+		{"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kemeawh", false},                     // Version 0 with a bech32m checksum
+		{"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7", false}, // Testnet address on mainnet
+	}
+	for _, test := range tests {
+		if _, err := ToScript(test.addr, test.testnet); err != ErrInvalidAddress {
+			t.Errorf("%s: got %v, want ErrInvalidAddress", test.addr, err)
+		}
+	}
+}
+
+func TestBase58(t *testing.T) {
+	tests := []struct {
+		data    string
+		encoded string
+	}{
+		{"", ""},
+		{"61", "2g"},
+		{"626262", "a3gV"},
+		{"636363", "aPEr"},
+		{"73696d706c792061206c6f6e6720737472696e67", "2cFupjhnEsSn59qHXstmK2ffpLv2"},
+		{"00eb15231dfceb60925886b67d065299925915aeb172c06647", "1NS17iag9jJgTHD1VXjvLCEnZuQ3rJDE9L"},
+		{"516b6fcd0f", "ABnLTmg"},
+		{"bf4f89001e670274dd", "3SEo3LWLoPntC"},
+		{"572e4794", "3EFU7m"},
+		{"ecac89cad93923c02321", "EJDM8drfXA6uyA"},
+		{"10c8511e", "Rt5zm"},
+		{"00000000000000000000", "1111111111"},
+	}
+	for _, test := range tests {
+		b, err := decodeBase58(test.encoded)
+		if err != nil {
+			t.Errorf("%s: %v", test.encoded, err)
+			continue
+		}
+		if got := hex.EncodeToString(b); got != test.data {
+			t.Errorf("%s: decoded %s, want %s", test.encoded, got, test.data)
+		}
+	}
+	if _, err := decodeBase58("3SEo3LWLoPnt0"); err != ErrInvalidAddress {
+		t.Errorf("invalid character: got %v, want ErrInvalidAddress", err)
+	}
+}
+
+func TestBase58Addresses(t *testing.T) {
+	tests := []struct {
+		addr    string
+		testnet bool
+		script  string
+	}{
+		{"1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa", false, "76a91462e907b15cbf27d5425399ebf6f0fb50ebb88f1888ac"},
+		{"1AGNa15ZQXAZUgFiqJ2i7Z2DPU2J6hW62i", false, "76a91465a16059864a2fdbc7c99a4723a8395bc6f188eb88ac"},
+		{"3CMNFxN1oHBc4R1EpboAL5yzHGgE611Xou", false, "a91474f209f6ea907e2ea48f74fae05782ae8a66525787"},
+		{"mo9ncXisMeAoXwqcV5EWuyncbmCcQN4rVs", true, "76a91453c0307d6851aa0ce7825ba883c6bd9ad242b48688ac"},
+		{"2N2JD6wb56AfK4tfmM6PwdVmoYk2dCKf4Br", true, "a9146349a418fc4578d10a372b54b45c280cc8c4382f87"},
+	}
+	for _, test := range tests {
+		script, err := ToScript(test.addr, test.testnet)
+		if err != nil {
+			t.Errorf("%s: %v", test.addr, err)
+			continue
+		}
+		if got := hex.EncodeToString(script); got != test.script {
+			t.Errorf("%s: script %s, want %s", test.addr, got, test.script)
+		}
+		if _, err := ToScript(test.addr, !test.testnet); err != ErrInvalidAddress {
+			t.Errorf("%s on the other network: got %v, want ErrInvalidAddress", test.addr, err)
+		}
+	}
+
+	if _, err := ToScript("1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNb", false); err != ErrInvalidAddress {
+		t.Errorf("bad checksum: got %v, want ErrInvalidAddress", err)
+	}
+}
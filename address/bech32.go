@@ -0,0 +1,118 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package address
+
+import "strings"
+
+const (
+	bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+	// Checksum constants for witness version 0 (BIP0173) and later versions (BIP0350)
+	bech32Const  = 1
+	bech32mConst = 0x2bc830a3
+)
+
+func bech32Polymod(values []byte) uint32 {
+	gen := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := uint(0); i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func hrpExpand(hrp string) []byte {
+	res := make([]byte, 0, len(hrp)*2+1)
+	for _, c := range []byte(hrp) {
+		res = append(res, c>>5)
+	}
+	res = append(res, 0)
+	for _, c := range []byte(hrp) {
+		res = append(res, c&31)
+	}
+	return res
+}
+
+// convertBits regroups data from fromBits to toBits per byte
+func convertBits(data []byte, fromBits, toBits uint, pad bool) ([]byte, bool) {
+	acc, bits := uint32(0), uint(0)
+	maxv := uint32(1)<<toBits - 1
+	res := []byte{}
+	for _, v := range data {
+		if uint32(v)>>fromBits != 0 {
+			return nil, false
+		}
+		acc = acc<<fromBits | uint32(v)
+		bits += fromBits
+		for bits >= toBits {
+			bits -= toBits
+			res = append(res, byte(acc>>bits&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			res = append(res, byte(acc<<(toBits-bits)&maxv))
+		}
+	} else if bits >= fromBits || (acc<<(toBits-bits))&maxv != 0 {
+		return nil, false
+	}
+	return res, true
+}
+
+// decodeSegwit returns the witness version and program of a bech32 or bech32m address
+func decodeSegwit(hrp, addr string) (byte, []byte, error) {
+	if len(addr) > 90 || (strings.ToLower(addr) != addr && strings.ToUpper(addr) != addr) {
+		return 0, nil, ErrInvalidAddress
+	}
+	addr = strings.ToLower(addr)
+	sep := strings.LastIndexByte(addr, '1')
+	if sep < 1 || sep+7 > len(addr) || addr[:sep] != hrp {
+		return 0, nil, ErrInvalidAddress
+	}
+
+	data := make([]byte, 0, len(addr)-sep-1)
+	for _, c := range []byte(addr[sep+1:]) {
+		i := strings.IndexByte(bech32Charset, c)
+		if i < 0 {
+			return 0, nil, ErrInvalidAddress
+		}
+		data = append(data, byte(i))
+	}
+	chk := bech32Polymod(append(hrpExpand(hrp), data...))
+	data = data[:len(data)-6]
+	if len(data) < 1 {
+		return 0, nil, ErrInvalidAddress
+	}
+
+	version := data[0]
+	if (version == 0 && chk != bech32Const) || (version > 0 && chk != bech32mConst) || version > 16 {
+		return 0, nil, ErrInvalidAddress
+	}
+	program, ok := convertBits(data[1:], 5, 8, false)
+	if !ok || len(program) < 2 || len(program) > 40 {
+		return 0, nil, ErrInvalidAddress
+	}
+	if version == 0 && len(program) != 20 && len(program) != 32 {
+		return 0, nil, ErrInvalidAddress
+	}
+	return version, program, nil
+}
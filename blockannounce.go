@@ -0,0 +1,138 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sansnetwork
+
+import (
+	"time"
+
+	"github.com/sanscentral/sansnetwork/inventory"
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/node"
+)
+
+const (
+	// Number of recently announced block hashes remembered for deduplication
+	announcedBlocksSize = 1000
+
+	// Time after which a header requested for an inv announcement is given up on
+	headerRequestTimeoutSec = 30
+)
+
+// NewBlockHandler is type for new block callbacks, peer is
+// the node which first announced the block
+type NewBlockHandler func(peer *node.Connection, header message.BlockHeader)
+
+// SubscribeNewBlocks calls h with the header of every new block the first
+// time it is announced by any node in the pool. Blocks announced with inv
+// rather than headers are delivered once their header has been fetched.
+// Headers without valid proof of work are not delivered. Handlers may be
+// called concurrently from different nodes
+func (c *NetworkConnection) SubscribeNewBlocks(h NewBlockHandler) *node.Subscription {
+	return c.Subscribe(node.ByType(node.EventNewBlock), func(e node.Event) {
+		if header, ok := e.Message.(message.BlockHeader); ok {
+			h(e.Peer, header)
+		}
+	})
+}
+
+// handleHeaders treats unsolicited headers messages as new block announcements
+// (BIP0130). Replies to header sync announce nothing, nor do messages longer
+// than a node would announce. Replies to the getheaders sent for blocks
+// announced with inv are the announcement of those blocks
+func (c *NetworkConnection) handleHeaders(e node.Event) {
+	headers, ok := e.Message.([]message.BlockHeader)
+	if !ok || len(headers) > message.MaxBlocksToAnnounce || c.isHeaderSyncReply(e.Peer, headers) {
+		return
+	}
+	for _, h := range headers {
+		c.announceBlock(e.Peer, h, message.CommandHeaders)
+	}
+}
+
+// handleCmpctBlock treats compact blocks as new block announcements (BIP0152)
+func (c *NetworkConnection) handleCmpctBlock(e node.Event) {
+	if cb, ok := e.Message.(message.CmpctBlock); ok {
+		c.announceBlock(e.Peer, cb.Header, message.CommandCmpctBlock)
+	}
+}
+
+// handleBlockInventory fetches the headers of blocks announced with inv by
+// nodes not using headers announcements, or announcing a long run of blocks.
+// Longer inv messages and inv sent in reply to GetBlocks announce nothing
+func (c *NetworkConnection) handleBlockInventory(peer *node.Connection, entries []inventory.Entry) {
+	if len(entries) > message.MaxBlocksToAnnounce {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	for hash, t := range c.headerRequests {
+		if now.Sub(t) > headerRequestTimeoutSec*time.Second {
+			delete(c.headerRequests, hash)
+		}
+	}
+	for hash, t := range c.blockReplies {
+		if now.Sub(t) > headerRequestTimeoutSec*time.Second {
+			delete(c.blockReplies, hash)
+		}
+	}
+	awaitingReply := c.blockRequests[peer] > 0
+	c.mu.Unlock()
+	if awaitingReply {
+		return
+	}
+
+	for _, entry := range entries {
+		if _, ok := c.announced.Lookup(entry.Hash); ok {
+			continue
+		}
+		c.mu.Lock()
+		_, requested := c.headerRequests[entry.Hash]
+		_, reply := c.blockReplies[entry.Hash]
+		requested = requested || reply
+		if !requested {
+			c.headerRequests[entry.Hash] = now
+		}
+		c.mu.Unlock()
+		if !requested {
+			// With an empty locator only the header of the stop hash is returned
+			err := peer.QueueMessage(message.NewGetHeadersMessage(nil, entry.Hash, c.testnet), nil)
+			if err != nil {
+				c.mu.Lock()
+				delete(c.headerRequests, entry.Hash)
+				c.mu.Unlock()
+			}
+		}
+	}
+}
+
+// announceBlock publishes header as a node.EventNewBlock unless already
+// announced, cmd is the command of the message announcing it. Headers
+// without valid proof of work are reported and otherwise ignored
+func (c *NetworkConnection) announceBlock(peer *node.Connection, header message.BlockHeader, cmd string) {
+	hash := header.BlockHash()
+	if err := c.params.CheckProofOfWork(hash, header.Bits); err != nil {
+		peer.ReportMisbehaviour(err)
+		return
+	}
+	c.mu.Lock()
+	delete(c.headerRequests, hash)
+	c.mu.Unlock()
+
+	entry := inventory.Entry{Type: inventory.TypeBlock, Hash: hash}
+	if c.announced.Record(entry, peer.Host(), time.Now()) {
+		c.events.Publish(node.Event{Type: node.EventNewBlock, Peer: peer, Command: cmd, Message: header})
+	}
+}
@@ -0,0 +1,168 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sansnetwork
+
+import (
+	"context"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/chain"
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/node"
+)
+
+// testParams are mainnet rules with a proof of work limit low enough to mine headers in tests
+var testParams = func() chain.Params {
+	p := chain.MainNetParams
+	p.PowLimit = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(1))
+	return p
+}()
+
+// easyBits is the target of headers mined by mine, within testParams.PowLimit
+const easyBits = 0x207fffff
+
+// mine sets the nonce of h so it meets easyBits
+func mine(h *message.BlockHeader) {
+	h.Bits = easyBits
+	for testParams.CheckProofOfWork(h.BlockHash(), h.Bits) != nil {
+		h.Nonce++
+	}
+}
+
+// pipeNode adds a node connected over an in-memory pipe to c and returns
+// the running connection at the other end
+func pipeNode(t *testing.T, c *NetworkConnection) (*node.Connection, *node.Connection) {
+	a, b := net.Pipe()
+	var peer *node.Connection
+	var peerErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		peer, peerErr = node.NewConnectionFromConn(context.Background(), b, false)
+	}()
+	n, err := node.NewConnectionFromConn(context.Background(), a, false)
+	wg.Wait()
+	if err != nil || peerErr != nil {
+		t.Fatalf("handshake failed: %v, %v", err, peerErr)
+	}
+	go peer.Run(context.Background())
+	c.addNode(c.ctx, n)
+	return n, peer
+}
+
+func TestHeadersAnnouncements(t *testing.T) {
+	c, err := NewNetworkConnection(context.Background(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.params = &testParams
+	n, peer := pipeNode(t, c)
+	defer peer.Close()
+
+	announced := make(chan message.BlockHeader, 4)
+	c.SubscribeNewBlocks(func(_ *node.Connection, h message.BlockHeader) {
+		announced <- h
+	})
+	expect := func(h message.BlockHeader, want bool) {
+		t.Helper()
+		if err := peer.QueueMessage(message.NewHeadersMessage([]message.BlockHeader{h}, false), nil); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-announced:
+			if !want || got != h {
+				t.Fatalf("unexpected announcement of %x", got.BlockHash())
+			}
+		case <-time.After(time.Second):
+			if want {
+				t.Fatal("header not announced")
+			}
+		}
+	}
+
+	ch := chain.New(&testParams)
+	reply := message.BlockHeader{Version: 1, PrevBlock: chain.MainNetParams.GenesisHash(), Timestamp: 1}
+	unrelated := message.BlockHeader{Version: 1, PrevBlock: [32]byte{1}, Timestamp: 2}
+	mine(&reply)
+	mine(&unrelated)
+
+	// While a getheaders is outstanding its reply is not an announcement
+	c.startHeaderSync(n, ch)
+	expect(reply, false)
+	expect(unrelated, true)
+	c.endHeaderSync(n, ch)
+
+	expect(reply, true)
+	expect(unrelated, false) // Already announced
+}
+
+func TestAnnouncementProofOfWork(t *testing.T) {
+	c, err := NewNetworkConnection(context.Background(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.params = &testParams
+	n, peer := pipeNode(t, c)
+	defer peer.Close()
+
+	announced := make(chan message.BlockHeader, 4)
+	c.SubscribeNewBlocks(func(_ *node.Connection, h message.BlockHeader) {
+		announced <- h
+	})
+	misbehaviour := make(chan node.Event, 4)
+	n.SubscribeChan(node.ByType(node.EventMisbehaviour), misbehaviour)
+
+	unmined := message.BlockHeader{Version: 1, PrevBlock: [32]byte{1}, Timestamp: 1, Bits: easyBits}
+	for testParams.CheckProofOfWork(unmined.BlockHash(), unmined.Bits) == nil {
+		unmined.Nonce++
+	}
+	aboveLimit := message.BlockHeader{Version: 1, PrevBlock: [32]byte{1}, Timestamp: 2}
+	aboveLimit.Bits = 0x2100ffff
+	for chain.HashToBig(aboveLimit.BlockHash()).Cmp(chain.CompactToBig(aboveLimit.Bits)) > 0 {
+		aboveLimit.Nonce++
+	}
+	for _, h := range []message.BlockHeader{unmined, aboveLimit} {
+		peer.QueueMessage(message.NewHeadersMessage([]message.BlockHeader{h}, false), nil)
+		select {
+		case <-misbehaviour:
+		case <-time.After(5 * time.Second):
+			t.Fatal("invalid proof of work not reported")
+		}
+	}
+
+	// Invalid headers are not remembered as announced
+	if _, ok := c.announced.Lookup(unmined.BlockHash()); ok {
+		t.Fatal("header without proof of work recorded as announced")
+	}
+	valid := unmined
+	mine(&valid)
+	peer.QueueMessage(message.NewHeadersMessage([]message.BlockHeader{valid}, false), nil)
+	select {
+	case got := <-announced:
+		if got != valid {
+			t.Fatalf("unexpected announcement of %x", got.BlockHash())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("valid header not announced")
+	}
+}
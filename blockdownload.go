@@ -0,0 +1,415 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sansnetwork
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/inventory"
+	"github.com/sanscentral/sansnetwork/merkle"
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/node"
+)
+
+const (
+	// Most blocks requested or waiting for delivery ahead of the next block to deliver
+	blockDownloadWindow = 128
+
+	// Most blocks requested from a single node at once
+	maxBlocksInFlightPerPeer = 16
+
+	// Time without receiving a requested block after which a node's requests are reassigned
+	blockStallTimeoutSec = 30
+)
+
+var (
+	// ErrUnconnectedHeaders is returned when headers do not form a chain
+	ErrUnconnectedHeaders = errors.New("headers do not connect")
+
+	errBadMerkleRoot         = errors.New("block does not match merkle root")
+	errBadWitnessCommitment  = errors.New("block does not match witness commitment")
+	errUnexpectedWitnessData = errors.New("block has witness data but no witness commitment")
+)
+
+// Prefix of the coinbase output committing to the block's witness data (BIP0141)
+var witnessCommitmentPrefix = []byte{0x6a, 0x24, 0xaa, 0x21, 0xa9, 0xed}
+
+// DownloadedBlock is a block delivered by a block download
+type DownloadedBlock struct {
+	Height int32
+	Block  message.Block
+}
+
+// FullBlockNodes returns the connected nodes which serve the whole block chain
+// including witness data
+func (c *NetworkConnection) FullBlockNodes() []*node.Connection {
+	res := []*node.Connection{}
+	for _, n := range c.Nodes() {
+		if n.Services()&(node.ServiceFullNode|node.ServiceWitness) == node.ServiceFullNode|node.ServiceWitness {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+// DownloadBlocks fetches the blocks of headers, a chain of headers starting at
+// startHeight, with witness data. Blocks are requested from every full block
+// node in the pool in parallel, requests a node stalls on are reassigned to
+// other nodes, and each block is checked against its header's merkle root and
+// its witness commitment. Blocks are passed to h in height order from a separate
+// goroutine, so downloading continues while h runs, with up to blockDownloadWindow
+// blocks waiting for it. It returns once every block has been delivered,
+// h returns an error or ctx is done, and h is not called after it returns
+func (c *NetworkConnection) DownloadBlocks(ctx context.Context, headers []message.BlockHeader, startHeight int32, h func(DownloadedBlock) error) error {
+	d := &blockDownload{
+		c:           c,
+		headers:     headers,
+		startHeight: startHeight,
+		index:       make(map[[32]byte]int, len(headers)),
+		received:    map[int]message.Block{},
+		inFlight:    map[int]*node.Connection{},
+		peers:       map[*node.Connection]*downloadPeer{},
+		failed:      map[int]map[*node.Connection]bool{},
+	}
+	for i := range headers {
+		if i > 0 && headers[i].PrevBlock != headers[i-1].BlockHash() {
+			return ErrUnconnectedHeaders
+		}
+		d.index[headers[i].BlockHash()] = i
+	}
+	return d.run(ctx, h)
+}
+
+// DownloadBlocksChan is like DownloadBlocks but sends each block to ch
+func (c *NetworkConnection) DownloadBlocksChan(ctx context.Context, headers []message.BlockHeader, startHeight int32, ch chan<- DownloadedBlock) error {
+	return c.DownloadBlocks(ctx, headers, startHeight, func(b DownloadedBlock) error {
+		select {
+		case ch <- b:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// blockDownload tracks the blocks of a DownloadBlocks call by position in headers
+type blockDownload struct {
+	c           *NetworkConnection
+	headers     []message.BlockHeader
+	startHeight int32
+	index       map[[32]byte]int
+	next        int                                // Next block to deliver
+	received    map[int]message.Block              // Blocks waiting for delivery
+	inFlight    map[int]*node.Connection           // Requested blocks by node asked
+	peers       map[*node.Connection]*downloadPeer // Nodes with blocks in flight
+	failed      map[int]map[*node.Connection]bool  // Nodes which did not deliver a block
+}
+
+// downloadPeer is the state of a node blocks are requested from
+type downloadPeer struct {
+	inFlight int
+	progress time.Time // When a requested block was last received
+	stalled  bool      // Whether the node stalled since it last delivered a block
+}
+
+func (d *blockDownload) run(ctx context.Context, h func(DownloadedBlock) error) error {
+	events := make(chan node.Event, maxBlocksInFlightPerPeer)
+	sub := d.c.SubscribeChan(func(e node.Event) bool {
+		return e.Type == node.EventPeerDisconnected ||
+			e.Type == node.EventMessage && (e.Command == message.CommandBlock || e.Command == message.CommandNotFound)
+	}, events)
+	defer sub.Unsubscribe()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	deliver := make(chan DownloadedBlock, blockDownloadWindow)
+	errc := make(chan error, 1)
+	go func() {
+		for b := range deliver {
+			if ctx.Err() != nil {
+				break
+			}
+			if err := h(b); err != nil {
+				errc <- err
+				cancel()
+				return
+			}
+		}
+		errc <- nil
+	}()
+
+	for d.next < len(d.headers) {
+		d.request()
+
+		// Only offer the next block to the consumer once it has arrived
+		var out chan<- DownloadedBlock
+		var next DownloadedBlock
+		if blk, ok := d.received[d.next]; ok {
+			out = deliver
+			next = DownloadedBlock{Height: d.startHeight + int32(d.next), Block: blk}
+		}
+
+		select {
+		case <-ctx.Done():
+			close(deliver)
+			if err := <-errc; err != nil {
+				return err
+			}
+			return ctx.Err()
+		case out <- next:
+			delete(d.received, d.next)
+			d.next++
+		case e := <-events:
+			d.handle(e)
+		case now := <-ticker.C:
+			d.checkStalls(now)
+		}
+	}
+	close(deliver)
+	if err := <-errc; err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// request assigns blocks in the window which are neither received nor in
+// flight to the least busy nodes which have not failed to deliver them
+func (d *blockDownload) request() {
+	nodes := d.c.FullBlockNodes()
+	if len(nodes) == 0 {
+		return
+	}
+	batches := map[*node.Connection][]inventory.Entry{}
+	end := d.next + blockDownloadWindow
+	if end > len(d.headers) {
+		end = len(d.headers)
+	}
+	for i := d.next; i < end; i++ {
+		if _, ok := d.received[i]; ok {
+			continue
+		}
+		if _, ok := d.inFlight[i]; ok {
+			continue
+		}
+		n := d.pickPeer(nodes, i)
+		if n == nil && d.allFailed(nodes, i) {
+			// Every node failed this block once, give them all another go
+			delete(d.failed, i)
+			n = d.pickPeer(nodes, i)
+		}
+		if n == nil {
+			break
+		}
+		d.assign(i, n)
+		batches[n] = append(batches[n], inventory.Entry{Type: inventory.TypeWitnessBlock, Hash: d.headers[i].BlockHash()})
+	}
+	for n, inv := range batches {
+		if err := n.QueueMessage(message.NewGetDataMessage(inv, d.c.testnet), nil); err != nil {
+			for _, entry := range inv {
+				d.unassign(d.index[entry.Hash])
+			}
+		}
+	}
+}
+
+// pickPeer returns the node with fewest blocks in flight that can take block i,
+// if any. Nodes which stalled are only used when every other node failed it
+func (d *blockDownload) pickPeer(nodes []*node.Connection, i int) *node.Connection {
+	var best *node.Connection
+	bestCount := maxBlocksInFlightPerPeer
+	available := false
+	for _, n := range nodes {
+		if d.failed[i][n] {
+			continue
+		}
+		if p, ok := d.peers[n]; !ok || !p.stalled {
+			available = true
+		}
+	}
+	for _, n := range nodes {
+		if d.failed[i][n] {
+			continue
+		}
+		count := 0
+		if p, ok := d.peers[n]; ok {
+			if p.stalled && available {
+				continue
+			}
+			count = p.inFlight
+		}
+		if count < bestCount {
+			best = n
+			bestCount = count
+		}
+	}
+	return best
+}
+
+// allFailed reports whether every one of nodes failed to deliver block i
+func (d *blockDownload) allFailed(nodes []*node.Connection, i int) bool {
+	for _, n := range nodes {
+		if !d.failed[i][n] {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *blockDownload) assign(i int, n *node.Connection) {
+	p, ok := d.peers[n]
+	if !ok {
+		p = &downloadPeer{}
+		d.peers[n] = p
+	}
+	if p.inFlight == 0 {
+		p.progress = time.Now()
+	}
+	p.inFlight++
+	d.inFlight[i] = n
+}
+
+func (d *blockDownload) unassign(i int) {
+	n, ok := d.inFlight[i]
+	if !ok {
+		return
+	}
+	delete(d.inFlight, i)
+	if p, ok := d.peers[n]; ok {
+		p.inFlight--
+	}
+}
+
+// fail reassigns block i if it is in flight from n, not asking n for it again
+func (d *blockDownload) fail(i int, n *node.Connection) {
+	if d.inFlight[i] != n {
+		return
+	}
+	d.unassign(i)
+	if d.failed[i] == nil {
+		d.failed[i] = map[*node.Connection]bool{}
+	}
+	d.failed[i][n] = true
+}
+
+func (d *blockDownload) handle(e node.Event) {
+	switch {
+	case e.Type == node.EventPeerDisconnected:
+		for i, n := range d.inFlight {
+			if n == e.Peer {
+				d.unassign(i)
+			}
+		}
+		delete(d.peers, e.Peer)
+	case e.Command == message.CommandNotFound:
+		inv, err := message.ParseInventoryPayload(e.Payload)
+		if err != nil {
+			return
+		}
+		for _, entry := range inv.Entry {
+			if i, ok := d.index[entry.Hash]; ok {
+				d.fail(i, e.Peer)
+			}
+		}
+	case e.Command == message.CommandBlock:
+		blk, err := message.ParseBlockPayload(e.Payload)
+		if err != nil {
+			return
+		}
+		i, ok := d.index[blk.Header.BlockHash()]
+		if !ok || i < d.next || i >= d.next+blockDownloadWindow {
+			return
+		}
+		if _, ok := d.received[i]; ok {
+			return
+		}
+		if err := checkBlock(&blk); err != nil {
+			e.Peer.ReportMisbehaviour(err)
+			d.fail(i, e.Peer)
+			return
+		}
+		if p, ok := d.peers[e.Peer]; ok {
+			p.progress = time.Now()
+			p.stalled = false
+		}
+		d.unassign(i)
+		d.received[i] = blk
+	}
+}
+
+// checkStalls reassigns the requests of nodes which have not delivered a block in time
+func (d *blockDownload) checkStalls(now time.Time) {
+	for n, p := range d.peers {
+		if p.inFlight == 0 || now.Sub(p.progress) < blockStallTimeoutSec*time.Second {
+			continue
+		}
+		p.stalled = true
+		for i, m := range d.inFlight {
+			if m == n {
+				d.fail(i, n)
+			}
+		}
+	}
+}
+
+// checkBlock verifies the transactions of blk against its header's merkle
+// root and its coinbase's witness commitment
+func checkBlock(blk *message.Block) error {
+	if root, mutated := merkle.Root(blk.TxIDs()); mutated || root != blk.Header.MerkleRoot {
+		return errBadMerkleRoot
+	}
+	return checkWitnessCommitment(blk)
+}
+
+// checkWitnessCommitment verifies the witness data of blk against the last
+// witness commitment output of its coinbase. Blocks without a commitment
+// must not carry witness data (BIP0141)
+func checkWitnessCommitment(blk *message.Block) error {
+	if len(blk.Tx) == 0 {
+		return errBadMerkleRoot
+	}
+	coinbase := &blk.Tx[0]
+	var commitment []byte
+	for _, out := range coinbase.TxOut {
+		if len(out.PkScript) >= 38 && bytes.HasPrefix(out.PkScript, witnessCommitmentPrefix) {
+			commitment = out.PkScript[6:38]
+		}
+	}
+
+	if commitment == nil {
+		for i := range blk.Tx {
+			if blk.Tx[i].HasWitness() {
+				return errUnexpectedWitnessData
+			}
+		}
+		return nil
+	}
+
+	// The coinbase witness is the single 32 byte witness reserved value
+	if len(coinbase.TxIn) != 1 || len(coinbase.TxIn[0].Witness) != 1 || len(coinbase.TxIn[0].Witness[0]) != 32 {
+		return errBadWitnessCommitment
+	}
+	want := merkle.WitnessCommitment(blk.WTxIDs(), coinbase.TxIn[0].Witness[0])
+	if !bytes.Equal(commitment, want[:]) {
+		return errBadWitnessCommitment
+	}
+	return nil
+}
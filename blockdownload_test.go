@@ -0,0 +1,241 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sansnetwork
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/merkle"
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/node"
+	"github.com/sanscentral/sansnetwork/typeconv"
+)
+
+func readMessage(c net.Conn) (string, []byte, error) {
+	h, err := message.ReadHeader(c)
+	if err != nil {
+		return "", nil, err
+	}
+	p := make([]byte, typeconv.Uint32FromBytes(h.PayloadLen[:]))
+	if _, err := io.ReadFull(c, p); err != nil {
+		return "", nil, err
+	}
+	return typeconv.CleanStringFromBytes(h.Command[:]), p, nil
+}
+
+// segwitBlock returns a block after prev with a witness transaction committed to by its coinbase
+func segwitBlock(prev [32]byte, i int) message.Block {
+	reserved := make([]byte, 32)
+	coinbase := message.Tx{
+		Version: 1,
+		TxIn:    []message.TxIn{{SignatureScript: []byte{byte(i), byte(i >> 8)}, Witness: [][]byte{reserved}}},
+		TxOut:   []message.TxOut{{Value: 50}},
+	}
+	spend := message.Tx{
+		Version: 2,
+		TxIn:    []message.TxIn{{PreviousOutPoint: message.OutPoint{Hash: [32]byte{byte(i)}}, Witness: [][]byte{{1, 2, 3}}}},
+		TxOut:   []message.TxOut{{Value: int64(i)}},
+	}
+	blk := message.Block{Tx: []message.Tx{coinbase, spend}}
+	commitment := merkle.WitnessCommitment(blk.WTxIDs(), reserved)
+	script := append(append([]byte{}, witnessCommitmentPrefix...), commitment[:]...)
+	blk.Tx[0].TxOut = append(blk.Tx[0].TxOut, message.TxOut{PkScript: script})
+
+	root, _ := merkle.Root(blk.TxIDs())
+	blk.Header = message.BlockHeader{Version: 1, PrevBlock: prev, MerkleRoot: root, Timestamp: uint32(i)}
+	return blk
+}
+
+func blockMessage(blk message.Block) []byte {
+	p := blk.Header.Serialize()
+	p = append(p, typeconv.BytesFromVarInt(uint64(len(blk.Tx)))...)
+	for i := range blk.Tx {
+		p = append(p, blk.Tx[i].Serialize(true)...)
+	}
+	return message.NewMessage(message.CommandBlock, p, false)
+}
+
+func TestCheckWitnessCommitment(t *testing.T) {
+	blk := segwitBlock([32]byte{}, 1)
+	if err := checkBlock(&blk); err != nil {
+		t.Fatal(err)
+	}
+
+	// Witness data is not covered by the merkle root
+	tampered := segwitBlock([32]byte{}, 1)
+	tampered.Tx[1].TxIn[0].Witness = [][]byte{{4, 5, 6}}
+	if err := checkBlock(&tampered); err != errBadWitnessCommitment {
+		t.Fatalf("tampered witness: got %v", err)
+	}
+
+	uncommitted := segwitBlock([32]byte{}, 1)
+	uncommitted.Tx[0].TxOut = uncommitted.Tx[0].TxOut[:1]
+	root, _ := merkle.Root(uncommitted.TxIDs())
+	uncommitted.Header.MerkleRoot = root
+	if err := checkBlock(&uncommitted); err != errUnexpectedWitnessData {
+		t.Fatalf("missing commitment: got %v", err)
+	}
+}
+
+// serverHandshake answers the handshake of a node over c, advertising services
+func serverHandshake(c net.Conn, services node.ServiceFlag) error {
+	if _, _, err := readMessage(c); err != nil {
+		return err
+	}
+	version := message.NewVersionMessage(false)
+	payload := append([]byte{}, version[message.HeaderLength():]...)
+	svc := typeconv.BytesFromUint64(uint64(services))
+	copy(payload[4:12], svc[:])
+	c.Write(message.NewMessage(message.CommandVersion, payload, false))
+	for {
+		cmd, _, err := readMessage(c)
+		if err != nil {
+			return err
+		}
+		if cmd == message.CommandVersionAcknowledge {
+			break
+		}
+	}
+	_, err := c.Write(message.NewVerackMessage(false))
+	return err
+}
+
+// blockServer handshakes as a full witness node over c and serves getdata
+// requests from blocks, corrupting witness data if bad is set. Requested
+// block hashes are sent to requests if it is not nil
+func blockServer(c net.Conn, blocks map[[32]byte]message.Block, bad bool, requests chan<- [32]byte) {
+	if serverHandshake(c, node.ServiceFullNode|node.ServiceWitness) != nil {
+		return
+	}
+
+	var wmu sync.Mutex
+	for {
+		cmd, p, err := readMessage(c)
+		if err != nil {
+			return
+		}
+		if cmd != message.CommandGetData {
+			continue
+		}
+		inv, err := message.ParseInventoryPayload(p)
+		if err != nil {
+			return
+		}
+		go func() {
+			for _, e := range inv.Entry {
+				if requests != nil {
+					requests <- e.Hash
+				}
+				blk := blocks[e.Hash]
+				if bad {
+					blk = segwitBlock(blk.Header.PrevBlock, int(blk.Header.Timestamp))
+					blk.Tx[1].TxIn[0].Witness = [][]byte{{9}}
+				}
+				wmu.Lock()
+				c.Write(blockMessage(blk))
+				wmu.Unlock()
+			}
+		}()
+	}
+}
+
+func downloadTestPool(t *testing.T, count int, bad []bool, requests chan<- [32]byte) (*NetworkConnection, []message.BlockHeader) {
+	c, err := NewNetworkConnection(context.Background(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := []message.BlockHeader{}
+	blocks := map[[32]byte]message.Block{}
+	prev := [32]byte{1}
+	for i := 0; i < count; i++ {
+		blk := segwitBlock(prev, i)
+		prev = blk.Header.BlockHash()
+		headers = append(headers, blk.Header)
+		blocks[prev] = blk
+	}
+	for _, b := range bad {
+		a, s := net.Pipe()
+		go blockServer(s, blocks, b, requests)
+		n, err := node.NewConnectionFromConn(context.Background(), a, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.addNode(c.ctx, n)
+	}
+	return c, headers
+}
+
+func TestDownloadBlocks(t *testing.T) {
+	c, headers := downloadTestPool(t, 300, []bool{false, true}, nil)
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	height := int32(100)
+	err := c.DownloadBlocks(ctx, headers, height, func(b DownloadedBlock) error {
+		// h runs on the downloader's goroutine, so errors end the download instead of t.Fatal
+		if b.Height != height || b.Block.Header != headers[height-100] {
+			return fmt.Errorf("got block at height %d, want %d", b.Height, height)
+		}
+		if err := checkBlock(&b.Block); err != nil {
+			return fmt.Errorf("delivered invalid block: %v", err)
+		}
+		height++
+		return nil
+	})
+	if err != nil || height != 400 {
+		t.Fatalf("download stopped at height %d: %v", height, err)
+	}
+}
+
+// Blocks keep downloading while the consumer is busy
+func TestDownloadBlocksSlowConsumer(t *testing.T) {
+	requests := make(chan [32]byte, 1000)
+	c, headers := downloadTestPool(t, 200, []bool{false}, requests)
+	defer c.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	release := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.DownloadBlocks(ctx, headers, 0, func(b DownloadedBlock) error {
+			<-release
+			return nil
+		})
+	}()
+
+	// A single node has at most maxBlocksInFlightPerPeer blocks requested at
+	// once, so more requests mean blocks were taken in while h was blocked
+	timeout := time.After(10 * time.Second)
+	for i := 0; i < 4*maxBlocksInFlightPerPeer; i++ {
+		select {
+		case <-requests:
+		case <-timeout:
+			t.Fatalf("only %d blocks requested while the consumer was blocked", i)
+		}
+	}
+	close(release)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,239 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bloom
+
+import (
+	"errors"
+	"math"
+	"sync"
+
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/typeconv"
+)
+
+const (
+	// MaxFilterSize is the largest filter in bytes a node will accept
+	MaxFilterSize = 36000
+
+	// MaxHashFuncs is the most hash functions a node will accept
+	MaxHashFuncs = 50
+
+	// MaxFilterAddSize is the largest element accepted by filteradd
+	MaxFilterAddSize = 520
+
+	// Multiplier used to derive the seed of each hash function
+	hashSeedMultiplier = 0xfba4c795
+
+	ln2Squared = math.Ln2 * math.Ln2
+)
+
+var (
+	// ErrFilterSize is returned when loading an empty filter or one larger than MaxFilterSize
+	ErrFilterSize = errors.New("bloom filter size out of range")
+
+	// ErrHashFuncs is returned when loading a filter using more than MaxHashFuncs hash functions
+	ErrHashFuncs = errors.New("too many bloom filter hash functions")
+)
+
+// UpdateFlag controls how a node adds matched outputs to the filter
+type UpdateFlag uint8
+
+const (
+	// UpdateNone never adds outpoints to the filter
+	UpdateNone UpdateFlag = iota
+
+	// UpdateAll adds the outpoint of every output matching the filter
+	UpdateAll
+
+	// UpdateP2PubkeyOnly adds the outpoints of matching pay to pubkey and multisig outputs only
+	UpdateP2PubkeyOnly
+)
+
+// Filter is a BIP0037 bloom filter, safe for concurrent use
+type Filter struct {
+	mu        sync.Mutex
+	data      []byte
+	hashFuncs uint32
+	tweak     uint32
+	flags     UpdateFlag
+}
+
+// NewFilter creates a filter sized to hold elements items with a false positive
+// rate of fpRate, within the limits nodes accept. tweak randomises the hash seeds
+func NewFilter(elements int, fpRate float64, tweak uint32, flags UpdateFlag) *Filter {
+	if elements < 1 {
+		elements = 1
+	}
+	if fpRate <= 0 {
+		fpRate = 1e-9
+	}
+	if fpRate > 1 {
+		fpRate = 1
+	}
+
+	size := int(-1 / ln2Squared * float64(elements) * math.Log(fpRate) / 8)
+	if size < 1 {
+		size = 1
+	}
+	if size > MaxFilterSize {
+		size = MaxFilterSize
+	}
+
+	funcs := uint32(float64(size*8) / float64(elements) * math.Ln2)
+	if funcs < 1 {
+		funcs = 1
+	}
+	if funcs > MaxHashFuncs {
+		funcs = MaxHashFuncs
+	}
+
+	return &Filter{
+		data:      make([]byte, size),
+		hashFuncs: funcs,
+		tweak:     tweak,
+		flags:     flags,
+	}
+}
+
+// LoadFilter creates a filter from its serialised fields, rejecting
+// filters outside the limits nodes accept (BIP0037)
+func LoadFilter(data []byte, hashFuncs uint32, tweak uint32, flags UpdateFlag) (*Filter, error) {
+	if len(data) == 0 || len(data) > MaxFilterSize {
+		return nil, ErrFilterSize
+	}
+	if hashFuncs > MaxHashFuncs {
+		return nil, ErrHashFuncs
+	}
+	return &Filter{
+		data:      append([]byte{}, data...),
+		hashFuncs: hashFuncs,
+		tweak:     tweak,
+		flags:     flags,
+	}, nil
+}
+
+// Bytes returns a copy of the filter bit field
+func (f *Filter) Bytes() []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]byte{}, f.data...)
+}
+
+// HashFuncs returns the number of hash functions
+func (f *Filter) HashFuncs() uint32 {
+	return f.hashFuncs
+}
+
+// Tweak returns the hash seed tweak
+func (f *Filter) Tweak() uint32 {
+	return f.tweak
+}
+
+// Flags returns the update flags
+func (f *Filter) Flags() UpdateFlag {
+	return f.flags
+}
+
+// bit returns the index of the bit set by hash function i for data
+func (f *Filter) bit(i uint32, data []byte) uint32 {
+	return murmur3(i*hashSeedMultiplier+f.tweak, data) % uint32(len(f.data)*8)
+}
+
+func (f *Filter) add(data []byte) {
+	for i := uint32(0); i < f.hashFuncs; i++ {
+		b := f.bit(i, data)
+		f.data[b>>3] |= 1 << (b & 7)
+	}
+}
+
+func (f *Filter) matches(data []byte) bool {
+	for i := uint32(0); i < f.hashFuncs; i++ {
+		b := f.bit(i, data)
+		if f.data[b>>3]&(1<<(b&7)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Add inserts data into the filter
+func (f *Filter) Add(data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.add(data)
+}
+
+// Matches returns true if data may have been added to the filter
+func (f *Filter) Matches(data []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.matches(data)
+}
+
+// AddOutPoint inserts a serialised outpoint into the filter
+func (f *Filter) AddOutPoint(op message.OutPoint) {
+	f.Add(outPointBytes(op))
+}
+
+// MatchesOutPoint returns true if the outpoint may have been added to the filter
+func (f *Filter) MatchesOutPoint(op message.OutPoint) bool {
+	return f.Matches(outPointBytes(op))
+}
+
+func outPointBytes(op message.OutPoint) []byte {
+	idx := typeconv.BytesFromUint32(op.Index)
+	return append(append([]byte{}, op.Hash[:]...), idx[:]...)
+}
+
+// MatchTxAndUpdate applies the BIP0037 matching rules to tx as a node would.
+// A transaction matches if its txid, a data push in an output script, a spent
+// outpoint or a data push in an input script is in the filter. Matching outputs
+// are added to the filter according to the update flags so spends of them match
+func (f *Filter) MatchTxAndUpdate(tx *message.Tx) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	txid := tx.TxID()
+	matched := f.matches(txid[:])
+
+	for i, out := range tx.TxOut {
+		for _, push := range pushedData(out.PkScript) {
+			if !f.matches(push) {
+				continue
+			}
+			matched = true
+			if f.flags == UpdateAll || (f.flags == UpdateP2PubkeyOnly && isPubkeyOrMultisig(out.PkScript)) {
+				f.add(outPointBytes(message.OutPoint{Hash: txid, Index: uint32(i)}))
+			}
+			break
+		}
+	}
+	if matched {
+		return true
+	}
+
+	for _, in := range tx.TxIn {
+		if f.matches(outPointBytes(in.PreviousOutPoint)) {
+			return true
+		}
+		for _, push := range pushedData(in.SignatureScript) {
+			if f.matches(push) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bloom
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/sanscentral/sansnetwork/message"
+)
+
+func TestLoadFilterLimits(t *testing.T) {
+	if _, err := LoadFilter(nil, 1, 0, UpdateNone); err != ErrFilterSize {
+		t.Fatalf("empty filter: got %v, want ErrFilterSize", err)
+	}
+	if _, err := LoadFilter(make([]byte, MaxFilterSize+1), 1, 0, UpdateNone); err != ErrFilterSize {
+		t.Fatalf("oversized filter: got %v, want ErrFilterSize", err)
+	}
+	if _, err := LoadFilter(make([]byte, 1), MaxHashFuncs+1, 0, UpdateNone); err != ErrHashFuncs {
+		t.Fatalf("too many hash functions: got %v, want ErrHashFuncs", err)
+	}
+
+	f := NewFilter(10, 0.0001, 5, UpdateAll)
+	g, err := LoadFilter(f.Bytes(), f.HashFuncs(), f.Tweak(), f.Flags())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Add([]byte("element"))
+	g.Add([]byte("element"))
+	if !g.Matches([]byte("element")) || string(g.Bytes()) != string(f.Bytes()) {
+		t.Fatal("loaded filter does not behave like the original")
+	}
+}
+
+func TestMurmur3(t *testing.T) {
+	tests := []struct {
+		want uint32
+		seed uint32
+		data string
+	}{
+		{0x00000000, 0x00000000, ""},
+		{0x6a396f08, 0xfba4c795, ""},
+		{0x81f16f39, 0xffffffff, ""},
+		{0x514e28b7, 0x00000000, "00"},
+		{0xea3f0b17, 0xfba4c795, "00"},
+		{0xfd6cf10d, 0x00000000, "ff"},
+		{0x16c6b7ab, 0x00000000, "0011"},
+		{0x8eb51c3d, 0x00000000, "001122"},
+		{0xb4471bf8, 0x00000000, "00112233"},
+		{0xe2301fa8, 0x00000000, "0011223344"},
+		{0xfc2e4a15, 0x00000000, "001122334455"},
+		{0xb074502c, 0x00000000, "00112233445566"},
+		{0x8034d2a0, 0x00000000, "0011223344556677"},
+		{0xb4698def, 0x00000000, "001122334455667788"},
+	}
+	for _, test := range tests {
+		if got := murmur3(test.seed, mustHex(t, test.data)); got != test.want {
+			t.Errorf("murmur3(%08x, %s) = %08x, want %08x", test.seed, test.data, got, test.want)
+		}
+	}
+}
+
+func TestFilterSerialize(t *testing.T) {
+	tests := []struct {
+		tweak uint32
+		want  string
+	}{
+		{0, "03614e9b050000000000000001"},
+		{2147483649, "03ce4299050000000100008001"},
+	}
+	for _, test := range tests {
+		f := NewFilter(3, 0.01, test.tweak, UpdateAll)
+		f.Add(mustHex(t, "99108ad8ed9bb6274d3980bab5a85c048f0950c8"))
+		if !f.Matches(mustHex(t, "99108ad8ed9bb6274d3980bab5a85c048f0950c8")) {
+			t.Fatal("added element does not match")
+		}
+		if f.Matches(mustHex(t, "19108ad8ed9bb6274d3980bab5a85c048f0950c8")) {
+			t.Fatal("element differing in one bit matches")
+		}
+		f.Add(mustHex(t, "b5a2c786d9ef4658287ced5914b37a1b4aa32eee"))
+		f.Add(mustHex(t, "b9300670b4c5366e95b2699e8b18bc75e5f729c5"))
+
+		msg := message.NewFilterLoadMessage(f.Bytes(), f.HashFuncs(), f.Tweak(), uint8(f.Flags()), false)
+		if got := hex.EncodeToString(msg[message.HeaderLength():]); got != test.want {
+			t.Errorf("tweak %d: serialised %s, want %s", test.tweak, got, test.want)
+		}
+	}
+}
+
+func TestEmptyPushesNotMatched(t *testing.T) {
+	// OP_PUSHDATA1 of nothing, OP_0 and a 2 byte push
+	script := []byte{0x4c, 0x00, 0x00, 0x02, 0xab, 0xcd}
+	pushes := ScriptElements(script)
+	if len(pushes) != 1 || hex.EncodeToString(pushes[0]) != "abcd" {
+		t.Fatalf("got pushes %x, want only abcd", pushes)
+	}
+
+	// A filter matching the empty element does not match empty pushes
+	f := NewFilter(1, 0.0001, 0, UpdateNone)
+	f.Add(nil)
+	tx := message.Tx{
+		Version: 1,
+		TxIn:    []message.TxIn{{PreviousOutPoint: message.OutPoint{Hash: [32]byte{1}}, SignatureScript: []byte{0x4c, 0x00}}},
+		TxOut:   []message.TxOut{{Value: 1, PkScript: []byte{0x4c, 0x00}}},
+	}
+	if f.MatchTxAndUpdate(&tx) {
+		t.Fatal("transaction matched on an empty push")
+	}
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -0,0 +1,91 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bloom
+
+import "encoding/binary"
+
+const (
+	opPushData1     = 0x4c
+	opPushData2     = 0x4d
+	opPushData4     = 0x4e
+	op1             = 0x51
+	op16            = 0x60
+	opCheckSig      = 0xac
+	opCheckMultiSig = 0xae
+)
+
+// pushedData returns the data pushed by each push operation in script,
+// stopping at the first malformed push. Empty pushes are skipped as nodes
+// never match them against a filter
+func pushedData(script []byte) [][]byte {
+	res := [][]byte{}
+	for i := 0; i < len(script); {
+		op := script[i]
+		i++
+		var n int
+		switch {
+		case op > 0 && op < opPushData1:
+			n = int(op)
+		case op == opPushData1:
+			if i+1 > len(script) {
+				return res
+			}
+			n = int(script[i])
+			i++
+		case op == opPushData2:
+			if i+2 > len(script) {
+				return res
+			}
+			n = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+		case op == opPushData4:
+			if i+4 > len(script) {
+				return res
+			}
+			n = int(binary.LittleEndian.Uint32(script[i:]))
+			i += 4
+		default:
+			continue
+		}
+		if n < 0 || i+n > len(script) {
+			return res
+		}
+		if n > 0 {
+			res = append(res, script[i:i+n])
+		}
+		i += n
+	}
+	return res
+}
+
+// isPubkeyOrMultisig returns true for pay to pubkey and bare multisig output scripts
+func isPubkeyOrMultisig(script []byte) bool {
+	l := len(script)
+	if (l == 35 || l == 67) && int(script[0]) == l-2 && script[l-1] == opCheckSig {
+		return true
+	}
+	if l >= 3 && script[l-1] == opCheckMultiSig && script[0] >= op1 && script[0] <= op16 &&
+		script[l-2] >= op1 && script[l-2] <= op16 {
+		return true
+	}
+	return false
+}
+
+// ScriptElements returns the data pushed by an output script, which are the
+// elements to add to a filter for transactions paying to that script to match
+func ScriptElements(script []byte) [][]byte {
+	return pushedData(script)
+}
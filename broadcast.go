@@ -0,0 +1,264 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sansnetwork
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/inventory"
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/node"
+)
+
+// Default number of nodes a broadcast transaction is announced to
+const defaultBroadcastPeers = 8
+
+var (
+	// ErrInvalidTx is returned when broadcasting bytes which are not a valid transaction
+	ErrInvalidTx = errors.New("invalid transaction serialisation")
+
+	// ErrNoPeers is returned when there are no connected nodes to broadcast to
+	ErrNoPeers = errors.New("no connected nodes")
+
+	// ErrTxRejected is returned when every node a transaction was announced to rejected it
+	ErrTxRejected = errors.New("transaction rejected by all nodes")
+)
+
+// BroadcastResult describes what happened to a broadcast transaction
+type BroadcastResult struct {
+	TxID       [32]byte
+	WTxID      [32]byte
+	Announced  []string         // Nodes the transaction was announced to
+	Requested  []string         // Nodes which fetched the transaction with getdata
+	Rejected   []node.Rejection // Nodes which rejected the transaction
+	Propagated []string         // Other nodes which announced the transaction back to us
+}
+
+// SetBroadcastPeers sets how many nodes BroadcastTx announces transactions to
+func (c *NetworkConnection) SetBroadcastPeers(count int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.broadcastPeers = count
+}
+
+// broadcast tracks a single transaction broadcast
+type broadcast struct {
+	c         *NetworkConnection
+	tx        message.Tx
+	result    BroadcastResult
+	mu        sync.Mutex
+	announced map[*node.Connection]bool
+	rejected  map[*node.Connection]bool
+	done      chan struct{}
+	once      sync.Once
+}
+
+// BroadcastTx announces the serialised transaction rawTx to some of the nodes
+// in the pool and serves it to those which request it. It returns once another
+// node announces the transaction back, confirming it propagated, once every
+// announced node rejected it, or when ctx is done. The result describes
+// progress so far in every case
+func (c *NetworkConnection) BroadcastTx(ctx context.Context, rawTx []byte) (BroadcastResult, error) {
+	return c.BroadcastTxWithFee(ctx, rawTx, -1)
+}
+
+// BroadcastTxWithFee is like BroadcastTx but skips nodes whose feefilter is
+// above the fee rate of the transaction paying fee satoshis. A negative fee
+// means the fee is unknown and no nodes are skipped
+func (c *NetworkConnection) BroadcastTxWithFee(ctx context.Context, rawTx []byte, fee int64) (BroadcastResult, error) {
+	tx, err := message.ParseTxPayload(rawTx)
+	if err != nil || !bytes.Equal(tx.Serialize(true), rawTx) {
+		return BroadcastResult{}, ErrInvalidTx
+	}
+	feeRate := int64(-1)
+	if fee >= 0 {
+		feeRate = fee * 1000 / int64(tx.VSize())
+	}
+
+	b := &broadcast{
+		c:  c,
+		tx: tx,
+		result: BroadcastResult{
+			TxID:  tx.TxID(),
+			WTxID: tx.WTxID(),
+		},
+		announced: map[*node.Connection]bool{},
+		rejected:  map[*node.Connection]bool{},
+		done:      make(chan struct{}),
+	}
+
+	peers := c.broadcastNodes(feeRate)
+	if len(peers) == 0 {
+		return b.result, ErrNoPeers
+	}
+
+	subs := []*node.Subscription{
+		c.Subscribe(node.ByCommand(message.CommandGetData), b.handleGetData),
+		c.Subscribe(node.ByType(node.EventReject), b.handleReject),
+		c.SubscribeInventory(b.handleInventory, inventory.TypeTx, inventory.TypeWTX),
+	}
+	defer func() {
+		for _, s := range subs {
+			s.Unsubscribe()
+		}
+	}()
+
+	for _, n := range peers {
+		// Mark the node first so an immediate reject is counted
+		b.mu.Lock()
+		b.announced[n] = true
+		b.mu.Unlock()
+		inv := []inventory.Entry{n.TxEntry(b.result.TxID, b.result.WTxID)}
+		err := n.QueueMessage(message.NewInventoryMessage(inv, c.testnet), nil)
+		b.mu.Lock()
+		if err != nil {
+			delete(b.announced, n)
+			delete(b.rejected, n)
+		} else {
+			b.result.Announced = append(b.result.Announced, n.Host())
+		}
+		b.mu.Unlock()
+	}
+
+	b.mu.Lock()
+	if len(b.announced) == 0 {
+		b.mu.Unlock()
+		return b.result, ErrNoPeers
+	}
+	if len(b.rejected) == len(b.announced) {
+		b.finish()
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.result.Propagated) == 0 && len(b.rejected) == len(b.announced) {
+		err = ErrTxRejected
+	}
+	return b.result, err
+}
+
+// broadcastNodes returns a random selection of connected nodes to announce
+// a transaction paying feeRate satoshis per kilobyte to, a negative
+// feeRate ignores the nodes' fee filters
+func (c *NetworkConnection) broadcastNodes(feeRate int64) []*node.Connection {
+	c.mu.Lock()
+	count := c.broadcastPeers
+	c.mu.Unlock()
+	if count <= 0 {
+		count = defaultBroadcastPeers
+	}
+
+	nodes := []*node.Connection{}
+	for _, n := range c.Nodes() {
+		if feeRate < 0 || feeRate >= n.FeeFilter() {
+			nodes = append(nodes, n)
+		}
+	}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i := range nodes {
+		j := r.Intn(i + 1)
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	}
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+// finish ends the broadcast
+func (b *broadcast) finish() {
+	b.once.Do(func() { close(b.done) })
+}
+
+// handleGetData serves the transaction to nodes requesting it
+func (b *broadcast) handleGetData(e node.Event) {
+	inv, err := message.ParseInventoryPayload(e.Payload)
+	if err != nil {
+		return
+	}
+	for _, entry := range inv.Entry {
+		var witness bool
+		switch {
+		case entry.Type == inventory.TypeTx && entry.Hash == b.result.TxID:
+			witness = false
+		case entry.Type == inventory.TypeWitnessTx && entry.Hash == b.result.TxID:
+			witness = true
+		case entry.Type == inventory.TypeWTX && entry.Hash == b.result.WTxID:
+			witness = true
+		default:
+			continue
+		}
+		if err := e.Peer.QueueMessage(message.NewTxMessage(b.tx, witness, b.c.testnet), nil); err != nil {
+			// The node asks again after its request times out
+			return
+		}
+		b.mu.Lock()
+		b.result.Requested = append(b.result.Requested, e.Peer.Host())
+		b.mu.Unlock()
+		return
+	}
+}
+
+// handleReject records rejections of the transaction
+func (b *broadcast) handleReject(e node.Event) {
+	rej, ok := e.Message.(node.Rejection)
+	if !ok || rej.Message != message.CommandTx || !rej.HasData {
+		return
+	}
+	if rej.Data != b.result.TxID && rej.Data != b.result.WTxID {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Only nodes the transaction was announced to count towards ErrTxRejected
+	if !b.announced[e.Peer] || b.rejected[e.Peer] {
+		return
+	}
+	b.result.Rejected = append(b.result.Rejected, rej)
+	b.rejected[e.Peer] = true
+	if len(b.rejected) == len(b.announced) {
+		b.finish()
+	}
+}
+
+// handleInventory treats announcements of the transaction by other nodes as propagation
+func (b *broadcast) handleInventory(peer *node.Connection, entries []inventory.Entry) {
+	for _, e := range entries {
+		if e.Hash != b.result.TxID && e.Hash != b.result.WTxID {
+			continue
+		}
+		b.mu.Lock()
+		if !b.announced[peer] {
+			b.result.Propagated = append(b.result.Propagated, peer.Host())
+			b.finish()
+		}
+		b.mu.Unlock()
+		return
+	}
+}
@@ -0,0 +1,174 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sansnetwork
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/inventory"
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/node"
+)
+
+// testTx returns a serialised transaction to broadcast
+func testTx() []byte {
+	tx := message.Tx{
+		Version: 2,
+		TxIn:    []message.TxIn{{PreviousOutPoint: message.OutPoint{Hash: [32]byte{1}}, Sequence: 0xffffffff}},
+		TxOut:   []message.TxOut{{Value: 1000, PkScript: []byte{0x51}}},
+	}
+	return tx.Serialize(true)
+}
+
+// rejectMessage returns a reject message for the transaction with hash
+func rejectMessage(hash [32]byte) []byte {
+	return message.NewRejectMessage(message.Reject{
+		Message: message.CommandTx,
+		Code:    message.RejectInsufficientFee,
+		Reason:  "min relay fee not met",
+		Data:    hash,
+		HasData: true,
+	}, false)
+}
+
+// fetchAnnounced makes peer request announced transactions, sending
+// each transaction it receives to txs
+func fetchAnnounced(peer *node.Connection, txs chan<- message.Tx) {
+	peer.Subscribe(node.ByCommand(message.CommandInventory), func(e node.Event) {
+		inv, ok := e.Message.(inventory.Item)
+		if !ok {
+			return
+		}
+		peer.QueueMessage(message.NewGetDataMessage(inv.Entry, false), nil)
+	})
+	peer.Subscribe(node.ByCommand(message.CommandTx), func(e node.Event) {
+		if tx, ok := e.Message.(message.Tx); ok {
+			txs <- tx
+		}
+	})
+}
+
+func TestBroadcastTxRejected(t *testing.T) {
+	c, err := NewNetworkConnection(context.Background(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	raw := testTx()
+	txs := make(chan message.Tx, 2)
+	for i := 0; i < 2; i++ {
+		_, peer := pipeNode(t, c)
+		defer peer.Close()
+		fetchAnnounced(peer, txs)
+
+		// Reject the transaction once it has been served
+		peer.Subscribe(node.ByCommand(message.CommandTx), func(e node.Event) {
+			tx := e.Message.(message.Tx)
+			peer.QueueMessage(rejectMessage(tx.TxID()), nil)
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := c.BroadcastTx(ctx, raw)
+	if err != ErrTxRejected {
+		t.Fatalf("got %v, want ErrTxRejected", err)
+	}
+	if len(res.Announced) != 2 || len(res.Requested) != 2 || len(res.Rejected) != 2 {
+		t.Fatalf("announced %d, requested %d, rejected %d, want 2 of each",
+			len(res.Announced), len(res.Requested), len(res.Rejected))
+	}
+	for _, r := range res.Rejected {
+		if r.Code != message.RejectInsufficientFee || !r.Matched {
+			t.Fatalf("rejection %v not matched to the served transaction", r)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if tx := <-txs; string(tx.Serialize(true)) != string(raw) {
+			t.Fatal("served transaction differs from the broadcast one")
+		}
+	}
+}
+
+func TestBroadcastTxPropagated(t *testing.T) {
+	c, err := NewNetworkConnection(context.Background(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetBroadcastPeers(1)
+
+	// Whichever node is not announced to announces the transaction back
+	peers := []*node.Connection{}
+	txs := make(chan message.Tx, 2)
+	for i := 0; i < 2; i++ {
+		_, peer := pipeNode(t, c)
+		defer peer.Close()
+		fetchAnnounced(peer, txs)
+		peers = append(peers, peer)
+	}
+	go func() {
+		tx := <-txs
+		for _, p := range peers {
+			p.QueueMessage(message.NewInventoryMessage([]inventory.Entry{p.TxEntry(tx.TxID(), tx.WTxID())}, false), nil)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := c.BroadcastTx(ctx, testTx())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Announced) != 1 || len(res.Requested) != 1 || len(res.Propagated) != 1 {
+		t.Fatalf("announced %d, requested %d, propagated %d, want 1 of each",
+			len(res.Announced), len(res.Requested), len(res.Propagated))
+	}
+}
+
+func TestBroadcastTxDeadline(t *testing.T) {
+	c, err := NewNetworkConnection(context.Background(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.BroadcastTx(context.Background(), testTx()); err != ErrNoPeers {
+		t.Fatalf("empty pool: got %v, want ErrNoPeers", err)
+	}
+	if _, err := c.BroadcastTx(context.Background(), []byte{1, 2, 3}); err != ErrInvalidTx {
+		t.Fatalf("invalid transaction: got %v, want ErrInvalidTx", err)
+	}
+
+	// The node never fetches or rejects the transaction
+	_, peer := pipeNode(t, c)
+	defer peer.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	res, err := c.BroadcastTx(ctx, testTx())
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatal("broadcast did not return at the deadline")
+	}
+	if len(res.Announced) != 1 || len(res.Requested) != 0 {
+		t.Fatalf("announced %d, requested %d, want 1 and 0", len(res.Announced), len(res.Requested))
+	}
+}
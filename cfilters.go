@@ -0,0 +1,331 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sansnetwork
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/sanscentral/sansnetwork/gcs"
+	"github.com/sanscentral/sansnetwork/inventory"
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/node"
+	"github.com/sanscentral/sansnetwork/typeconv"
+)
+
+// Number of nodes whose filter headers are compared against each other
+const filterHeaderPeers = 3
+
+var (
+	// ErrNoFilterPeers is returned when no connected node serves compact filters
+	ErrNoFilterPeers = errors.New("no connected nodes serve compact filters")
+
+	// ErrTooManyFilters is returned when requesting more filters than fit in one request
+	ErrTooManyFilters = errors.New("too many filters requested")
+
+	// ErrFilterRange is returned when block hashes do not match the range of filter headers
+	ErrFilterRange = errors.New("block hashes do not match filter headers")
+
+	// ErrBadBlock is returned when a fetched block does not match its hash,
+	// merkle root or witness commitment
+	ErrBadBlock = errors.New("block does not match requested hash")
+)
+
+// FilterHeaderConflict is returned when nodes disagree on filter headers,
+// Responses holds each node's answer to the getcfheaders request
+type FilterHeaderConflict struct {
+	StartHeight uint32
+	Height      uint32 // First height the nodes disagree on
+	Responses   map[*node.Connection]message.CFHeaders
+}
+
+func (e *FilterHeaderConflict) Error() string {
+	return fmt.Sprintf("%d nodes disagree on filter headers at height %d", len(e.Responses), e.Height)
+}
+
+// CompactFilterNodes returns the connected nodes which serve compact block filters
+func (c *NetworkConnection) CompactFilterNodes() []*node.Connection {
+	res := []*node.Connection{}
+	for _, n := range c.Nodes() {
+		if n.Services()&node.ServiceCompactFilters != 0 {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+// GetCFCheckpt requests basic filter header checkpoints up to stopHash from a compact filter node
+func (c *NetworkConnection) GetCFCheckpt(ctx context.Context, stopHash [32]byte) (message.CFCheckpt, error) {
+	var res message.CFCheckpt
+	err := ErrNoFilterPeers
+	for _, n := range c.CompactFilterNodes() {
+		msg := message.NewGetCFCheckptMessage(message.FilterTypeBasic, stopHash, c.testnet)
+		err = exchange(ctx, n, msg, node.ByCommand(message.CommandCFCheckpt), func(e node.Event) bool {
+			cp := e.Message.(message.CFCheckpt)
+			if cp.FilterType != message.FilterTypeBasic || cp.StopHash != stopHash {
+				return false
+			}
+			res = cp
+			return true
+		})
+		if err == nil {
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return message.CFCheckpt{}, err
+}
+
+// GetCFHeaders requests basic filter headers for the blocks from startHeight
+// to stopHash from several compact filter nodes and checks they agree. A
+// *FilterHeaderConflict is returned when they do not, see ResolveFilterConflict
+func (c *NetworkConnection) GetCFHeaders(ctx context.Context, startHeight uint32, stopHash [32]byte) (message.CFHeaders, error) {
+	peers := c.CompactFilterNodes()
+	if len(peers) == 0 {
+		return message.CFHeaders{}, ErrNoFilterPeers
+	}
+	if len(peers) > filterHeaderPeers {
+		peers = peers[:filterHeaderPeers]
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	responses := map[*node.Connection]message.CFHeaders{}
+	var lastErr error
+	for _, n := range peers {
+		wg.Add(1)
+		go func(n *node.Connection) {
+			defer wg.Done()
+			msg := message.NewGetCFHeadersMessage(message.FilterTypeBasic, startHeight, stopHash, c.testnet)
+			err := exchange(ctx, n, msg, node.ByCommand(message.CommandCFHeaders), func(e node.Event) bool {
+				h := e.Message.(message.CFHeaders)
+				if h.FilterType != message.FilterTypeBasic || h.StopHash != stopHash {
+					return false
+				}
+				mu.Lock()
+				responses[n] = h
+				mu.Unlock()
+				return true
+			})
+			if err != nil {
+				mu.Lock()
+				lastErr = err
+				mu.Unlock()
+			}
+		}(n)
+	}
+	wg.Wait()
+
+	if len(responses) == 0 {
+		return message.CFHeaders{}, lastErr
+	}
+
+	var agreed message.CFHeaders
+	var agreedHeaders [][32]byte
+	conflict := -1
+	for _, h := range responses {
+		headers := h.Headers()
+		if agreedHeaders == nil {
+			agreed, agreedHeaders = h, headers
+			continue
+		}
+		if i := firstDifference(agreedHeaders, headers); i >= 0 && (conflict < 0 || i < conflict) {
+			conflict = i
+		}
+	}
+	if conflict >= 0 {
+		return message.CFHeaders{}, &FilterHeaderConflict{
+			StartHeight: startHeight,
+			Height:      startHeight + uint32(conflict),
+			Responses:   responses,
+		}
+	}
+	return agreed, nil
+}
+
+// firstDifference returns the first index at which a and b differ, or -1 if they are equal
+func firstDifference(a, b [][32]byte) int {
+	for i := range a {
+		if i >= len(b) || a[i] != b[i] {
+			return i
+		}
+	}
+	if len(b) > len(a) {
+		return len(a)
+	}
+	return -1
+}
+
+// GetCFilters requests the basic filters for blockHashes, the hashes of the
+// blocks from startHeight in order, checking each against the verified filter
+// headers from GetCFHeaders for the same range. Nodes serving filters which
+// do not match are reported as misbehaving
+func (c *NetworkConnection) GetCFilters(ctx context.Context, startHeight uint32, blockHashes [][32]byte, headers message.CFHeaders) ([]message.CFilter, error) {
+	if len(blockHashes) > message.MaxCFiltersPerRequest {
+		return nil, ErrTooManyFilters
+	}
+	if len(blockHashes) == 0 || len(blockHashes) != len(headers.FilterHashes) || blockHashes[len(blockHashes)-1] != headers.StopHash {
+		return nil, ErrFilterRange
+	}
+	stopHash := headers.StopHash
+
+	var res []message.CFilter
+	err := ErrNoFilterPeers
+	for _, n := range c.CompactFilterNodes() {
+		res = nil
+		var bad error
+		msg := message.NewGetCFiltersMessage(message.FilterTypeBasic, startHeight, stopHash, c.testnet)
+		err = exchange(ctx, n, msg, node.ByCommand(message.CommandCFilter), func(e node.Event) bool {
+			f, ok := e.Message.(message.CFilter)
+			if !ok || f.FilterType != message.FilterTypeBasic {
+				return false
+			}
+			i := len(res)
+			if f.BlockHash != blockHashes[i] {
+				bad = fmt.Errorf("filter for block %x sent out of order", typeconv.ReverseHash(f.BlockHash))
+				return true
+			}
+			if typeconv.DoubleHashFromBytes(f.Filter) != headers.FilterHashes[i] {
+				bad = fmt.Errorf("filter for block %x does not match filter header", typeconv.ReverseHash(f.BlockHash))
+				return true
+			}
+			res = append(res, f)
+			return len(res) == len(blockHashes)
+		})
+		if err == nil && bad != nil {
+			n.ReportMisbehaviour(bad)
+			err = bad
+			continue
+		}
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ResolveFilterConflict decides which nodes in conflict lied about their
+// filter headers. blockHash is the hash of the block at conflict.Height,
+// which is fetched along with each node's filter for it. A node lies if its
+// filter does not match its own filter header or misses any of the block's
+// outputs. Lying nodes are reported as misbehaving and returned
+func (c *NetworkConnection) ResolveFilterConflict(ctx context.Context, conflict *FilterHeaderConflict, blockHash [32]byte) ([]*node.Connection, error) {
+	blk, err := c.fetchBlock(ctx, conflict, blockHash)
+	if err != nil {
+		return nil, err
+	}
+	scripts := [][]byte{}
+	for _, tx := range blk.Tx {
+		for _, out := range tx.TxOut {
+			if len(out.PkScript) == 0 || out.PkScript[0] == 0x6a {
+				continue
+			}
+			scripts = append(scripts, out.PkScript)
+		}
+	}
+
+	liars := []*node.Connection{}
+	i := int(conflict.Height - conflict.StartHeight)
+	for n, h := range conflict.Responses {
+		headers := h.Headers()
+		if i >= len(headers) {
+			continue
+		}
+		prev := h.PrevFilterHeader
+		if i > 0 {
+			prev = headers[i-1]
+		}
+
+		var filter []byte
+		msg := message.NewGetCFiltersMessage(message.FilterTypeBasic, conflict.Height, blockHash, c.testnet)
+		err := exchange(ctx, n, msg, node.ByCommand(message.CommandCFilter), func(e node.Event) bool {
+			f := e.Message.(message.CFilter)
+			if f.FilterType != message.FilterTypeBasic || f.BlockHash != blockHash {
+				return false
+			}
+			filter = f.Filter
+			return true
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return liars, err
+			}
+			continue
+		}
+
+		if reason := checkFilter(filter, blockHash, scripts, prev, headers[i]); reason != nil {
+			n.ReportMisbehaviour(reason)
+			liars = append(liars, n)
+		}
+	}
+	return liars, nil
+}
+
+// checkFilter returns why filter is not a valid basic filter for a block with
+// the given output scripts and filter header, or nil if it may be valid
+func checkFilter(filter []byte, blockHash [32]byte, scripts [][]byte, prev, header [32]byte) error {
+	if message.FilterHeader(typeconv.DoubleHashFromBytes(filter), prev) != header {
+		return fmt.Errorf("filter for block %x does not match filter header", typeconv.ReverseHash(blockHash))
+	}
+	f, err := gcs.FromBytes(filter, gcs.BasicP, gcs.BasicM, gcs.BasicKey(blockHash))
+	if err != nil {
+		return err
+	}
+	for _, s := range scripts {
+		if !f.Match(s) {
+			return fmt.Errorf("filter for block %x is missing outputs", typeconv.ReverseHash(blockHash))
+		}
+	}
+	return nil
+}
+
+// fetchBlock downloads the block with hash from one of the nodes in conflict,
+// checking its transactions and witness data against its header
+func (c *NetworkConnection) fetchBlock(ctx context.Context, conflict *FilterHeaderConflict, hash [32]byte) (message.Block, error) {
+	var blk message.Block
+	err := ErrNoPeers
+	inv := []inventory.Entry{{Type: inventory.TypeWitnessBlock, Hash: hash}}
+	for n := range conflict.Responses {
+		err = exchange(ctx, n, message.NewGetDataMessage(inv, c.testnet), node.ByCommand(message.CommandBlock), func(e node.Event) bool {
+			b, perr := message.ParseBlockPayload(e.Payload)
+			if perr != nil || b.Header.BlockHash() != hash {
+				return false
+			}
+			blk = b
+			return true
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		if berr := checkBlock(&blk); berr != nil {
+			n.ReportMisbehaviour(berr)
+			err = ErrBadBlock
+			continue
+		}
+		break
+	}
+	return blk, err
+}
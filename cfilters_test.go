@@ -0,0 +1,128 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sansnetwork
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/node"
+	"github.com/sanscentral/sansnetwork/typeconv"
+)
+
+func cfheadersMessage(h message.CFHeaders) []byte {
+	p := []byte{h.FilterType}
+	p = append(p, h.StopHash[:]...)
+	p = append(p, h.PrevFilterHeader[:]...)
+	p = append(p, typeconv.BytesFromVarInt(uint64(len(h.FilterHashes)))...)
+	for _, f := range h.FilterHashes {
+		p = append(p, f[:]...)
+	}
+	return message.NewMessage(message.CommandCFHeaders, p, false)
+}
+
+// filterServer handshakes as a compact filter node over c, answering
+// getcfheaders with headers and getdata with blk
+func filterServer(c net.Conn, headers message.CFHeaders, blk message.Block) {
+	if serverHandshake(c, node.ServiceFullNode|node.ServiceWitness|node.ServiceCompactFilters) != nil {
+		return
+	}
+	for {
+		cmd, _, err := readMessage(c)
+		if err != nil {
+			return
+		}
+		switch cmd {
+		case message.CommandGetCFHeaders:
+			c.Write(cfheadersMessage(headers))
+		case message.CommandGetData:
+			c.Write(blockMessage(blk))
+		}
+	}
+}
+
+// filterTestPool returns a connection to a compact filter node serving
+// each of headers
+func filterTestPool(t *testing.T, blk message.Block, headers ...message.CFHeaders) *NetworkConnection {
+	c, err := NewNetworkConnection(context.Background(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range headers {
+		a, s := net.Pipe()
+		go filterServer(s, h, blk)
+		n, err := node.NewConnectionFromConn(context.Background(), a, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.addNode(c.ctx, n)
+	}
+	return c
+}
+
+func TestGetCFHeadersConflict(t *testing.T) {
+	stop := [32]byte{9}
+	honest := message.CFHeaders{StopHash: stop, FilterHashes: [][32]byte{{1}, {2}, {3}}}
+	lying := message.CFHeaders{StopHash: stop, FilterHashes: [][32]byte{{1}, {4}, {3}}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := filterTestPool(t, message.Block{}, honest, honest)
+	h, err := c.GetCFHeaders(ctx, 100, stop)
+	c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.FilterHashes) != 3 || h.FilterHashes[1] != honest.FilterHashes[1] {
+		t.Fatalf("agreed headers %v", h.FilterHashes)
+	}
+
+	c = filterTestPool(t, message.Block{}, honest, lying)
+	defer c.Close()
+	_, err = c.GetCFHeaders(ctx, 100, stop)
+	conflict, ok := err.(*FilterHeaderConflict)
+	if !ok {
+		t.Fatalf("got %v, want a conflict", err)
+	}
+	if conflict.StartHeight != 100 || conflict.Height != 101 || len(conflict.Responses) != 2 {
+		t.Fatalf("conflict at %d from %d with %d responses, want 101 from 100 with 2",
+			conflict.Height, conflict.StartHeight, len(conflict.Responses))
+	}
+}
+
+func TestResolveFilterConflictForgedWitness(t *testing.T) {
+	blk := segwitBlock([32]byte{1}, 1)
+	blk.Tx[1].TxIn[0].Witness = [][]byte{{9}}
+	hash := blk.Header.BlockHash()
+	c := filterTestPool(t, blk,
+		message.CFHeaders{StopHash: hash, FilterHashes: [][32]byte{{1}}},
+		message.CFHeaders{StopHash: hash, FilterHashes: [][32]byte{{2}}})
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := c.GetCFHeaders(ctx, 1, hash)
+	conflict, ok := err.(*FilterHeaderConflict)
+	if !ok {
+		t.Fatalf("got %v, want a conflict", err)
+	}
+	if _, err := c.ResolveFilterConflict(ctx, conflict, hash); err != ErrBadBlock {
+		t.Fatalf("block with forged witness data: got %v, want ErrBadBlock", err)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package chacha20poly1305 implements the ChaCha20 stream cipher and the
+// ChaCha20-Poly1305 AEAD construction (RFC 8439)
+package chacha20poly1305
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// ErrAuthentication is returned when a ciphertext fails authentication
+var ErrAuthentication = errors.New("chacha20poly1305: message authentication failed")
+
+// Seal encrypts and authenticates plaintext and authenticates aad,
+// returning the ciphertext with the tag appended
+func Seal(key [KeySize]byte, nonce [NonceSize]byte, plaintext, aad []byte) []byte {
+	c, polyKey := setup(key, nonce)
+	out := make([]byte, len(plaintext), len(plaintext)+TagSize)
+	c.XORKeyStream(out, plaintext)
+	tag := poly1305(&polyKey, macData(aad, out))
+	return append(out, tag[:]...)
+}
+
+// Open authenticates and decrypts ciphertext as produced by Seal
+func Open(key [KeySize]byte, nonce [NonceSize]byte, ciphertext, aad []byte) ([]byte, error) {
+	if len(ciphertext) < TagSize {
+		return nil, ErrAuthentication
+	}
+	c, polyKey := setup(key, nonce)
+	ct := ciphertext[:len(ciphertext)-TagSize]
+	tag := poly1305(&polyKey, macData(aad, ct))
+	if subtle.ConstantTimeCompare(tag[:], ciphertext[len(ct):]) != 1 {
+		return nil, ErrAuthentication
+	}
+	out := make([]byte, len(ct))
+	c.XORKeyStream(out, ct)
+	return out, nil
+}
+
+// setup derives the Poly1305 key from block 0 and returns a cipher positioned at block 1
+func setup(key [KeySize]byte, nonce [NonceSize]byte) (*Cipher, [32]byte) {
+	c := NewCipher(key, nonce, 0)
+	var polyKey [32]byte
+	c.Keystream(polyKey[:])
+	c.Seek(nonce, 1)
+	return c, polyKey
+}
+
+// macData returns the authenticated data layout: aad and ciphertext each
+// padded to 16 bytes, followed by their lengths
+func macData(aad, ct []byte) []byte {
+	pad := func(n int) int { return (16 - n%16) % 16 }
+	b := make([]byte, 0, len(aad)+pad(len(aad))+len(ct)+pad(len(ct))+16)
+	b = append(b, aad...)
+	b = append(b, make([]byte, pad(len(aad)))...)
+	b = append(b, ct...)
+	b = append(b, make([]byte, pad(len(ct)))...)
+	var lens [16]byte
+	binary.LittleEndian.PutUint64(lens[0:], uint64(len(aad)))
+	binary.LittleEndian.PutUint64(lens[8:], uint64(len(ct)))
+	return append(b, lens[:]...)
+}
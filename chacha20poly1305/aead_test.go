@@ -0,0 +1,50 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package chacha20poly1305
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// RFC 8439 section 2.8.2
+func TestSealVector(t *testing.T) {
+	var key [KeySize]byte
+	for i := range key {
+		key[i] = byte(0x80 + i)
+	}
+	var nonce [NonceSize]byte
+	n, _ := hex.DecodeString("070000004041424344454647")
+	copy(nonce[:], n)
+	aad, _ := hex.DecodeString("50515253c0c1c2c3c4c5c6c7")
+	plaintext := []byte("Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it.")
+	want, _ := hex.DecodeString("d31a8d34648e60db7b86afbc53ef7ec2a4aded51296e08fea9e2b5a736ee62d63dbea45e8ca9671282fafb69da92728b1a71de0a9e060b2905d6a5b67ecd3b3692ddbd7f2d778b8c9803aee328091b58fab324e4fad675945585808b4831d7bc3ff4def08e4b7a9de576d26586cec64b6116" +
+		"1ae10b594f09e26a7e902ecbd0600691")
+
+	ct := Seal(key, nonce, plaintext, aad)
+	if !bytes.Equal(ct, want) {
+		t.Fatalf("sealed %x", ct)
+	}
+	pt, err := Open(key, nonce, ct, aad)
+	if err != nil || !bytes.Equal(pt, plaintext) {
+		t.Fatalf("open failed: %v", err)
+	}
+	ct[0] ^= 1
+	if _, err := Open(key, nonce, ct, aad); err != ErrAuthentication {
+		t.Fatalf("tampered ciphertext: got %v", err)
+	}
+}
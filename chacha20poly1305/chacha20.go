@@ -0,0 +1,122 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package chacha20poly1305
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	// KeySize is the size in bytes of ChaCha20 keys
+	KeySize = 32
+
+	// NonceSize is the size in bytes of ChaCha20 nonces (RFC 8439)
+	NonceSize = 12
+
+	// BlockSize is the size in bytes of a ChaCha20 keystream block
+	BlockSize = 64
+)
+
+// Cipher is a ChaCha20 stream cipher (RFC 8439). Keystream bytes are
+// consumed continuously across calls, a partially used block is kept for the next call
+type Cipher struct {
+	key     [8]uint32
+	nonce   [3]uint32
+	counter uint32
+	buf     [BlockSize]byte
+	used    int // Bytes of buf already consumed
+}
+
+// NewCipher creates a cipher with the given key and nonce, starting at block counter
+func NewCipher(key [KeySize]byte, nonce [NonceSize]byte, counter uint32) *Cipher {
+	c := &Cipher{}
+	c.SetKey(key)
+	c.Seek(nonce, counter)
+	return c
+}
+
+// SetKey replaces the key, keeping the nonce and position
+func (c *Cipher) SetKey(key [KeySize]byte) {
+	for i := range c.key {
+		c.key[i] = binary.LittleEndian.Uint32(key[i*4:])
+	}
+}
+
+// Seek sets the nonce and block counter, discarding any buffered keystream
+func (c *Cipher) Seek(nonce [NonceSize]byte, counter uint32) {
+	for i := range c.nonce {
+		c.nonce[i] = binary.LittleEndian.Uint32(nonce[i*4:])
+	}
+	c.counter = counter
+	c.used = BlockSize
+}
+
+// Keystream fills b with the next keystream bytes
+func (c *Cipher) Keystream(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	c.XORKeyStream(b, b)
+}
+
+// XORKeyStream xors src with the next keystream bytes into dst, which may alias src
+func (c *Cipher) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if c.used == BlockSize {
+			c.block(&c.buf)
+			c.counter++
+			c.used = 0
+		}
+		dst[i] = src[i] ^ c.buf[c.used]
+		c.used++
+	}
+}
+
+// block computes the keystream block at the current counter
+func (c *Cipher) block(out *[BlockSize]byte) {
+	var s, x [16]uint32
+	s[0], s[1], s[2], s[3] = 0x61707865, 0x3320646e, 0x79622d32, 0x6b206574
+	copy(s[4:12], c.key[:])
+	s[12] = c.counter
+	copy(s[13:], c.nonce[:])
+	x = s
+
+	for i := 0; i < 10; i++ {
+		quarterRound(&x, 0, 4, 8, 12)
+		quarterRound(&x, 1, 5, 9, 13)
+		quarterRound(&x, 2, 6, 10, 14)
+		quarterRound(&x, 3, 7, 11, 15)
+		quarterRound(&x, 0, 5, 10, 15)
+		quarterRound(&x, 1, 6, 11, 12)
+		quarterRound(&x, 2, 7, 8, 13)
+		quarterRound(&x, 3, 4, 9, 14)
+	}
+	for i := range x {
+		binary.LittleEndian.PutUint32(out[i*4:], x[i]+s[i])
+	}
+}
+
+func quarterRound(x *[16]uint32, a, b, c, d int) {
+	x[a] += x[b]
+	x[d] = bits.RotateLeft32(x[d]^x[a], 16)
+	x[c] += x[d]
+	x[b] = bits.RotateLeft32(x[b]^x[c], 12)
+	x[a] += x[b]
+	x[d] = bits.RotateLeft32(x[d]^x[a], 8)
+	x[c] += x[d]
+	x[b] = bits.RotateLeft32(x[b]^x[c], 7)
+}
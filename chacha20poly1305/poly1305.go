@@ -0,0 +1,148 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package chacha20poly1305
+
+import "encoding/binary"
+
+// TagSize is the size in bytes of Poly1305 authentication tags
+const TagSize = 16
+
+// poly1305 computes the Poly1305 one-time authenticator of msg (RFC 8439)
+// using 26 bit limbs
+func poly1305(key *[32]byte, msg []byte) [TagSize]byte {
+	const mask = 0x3ffffff
+	r0 := binary.LittleEndian.Uint32(key[0:]) & 0x3ffffff
+	r1 := (binary.LittleEndian.Uint32(key[3:]) >> 2) & 0x3ffff03
+	r2 := (binary.LittleEndian.Uint32(key[6:]) >> 4) & 0x3ffc0ff
+	r3 := (binary.LittleEndian.Uint32(key[9:]) >> 6) & 0x3f03fff
+	r4 := (binary.LittleEndian.Uint32(key[12:]) >> 8) & 0x00fffff
+	s1, s2, s3, s4 := r1*5, r2*5, r3*5, r4*5
+
+	var h0, h1, h2, h3, h4 uint32
+	var block [16]byte
+	for len(msg) > 0 {
+		hibit := uint32(1 << 24)
+		m := msg
+		if len(msg) >= 16 {
+			msg = msg[16:]
+		} else {
+			// Final partial block is padded with a one byte then zeros
+			block = [16]byte{}
+			copy(block[:], msg)
+			block[len(msg)] = 1
+			m = block[:]
+			msg = nil
+			hibit = 0
+		}
+
+		h0 += binary.LittleEndian.Uint32(m[0:]) & mask
+		h1 += (binary.LittleEndian.Uint32(m[3:]) >> 2) & mask
+		h2 += (binary.LittleEndian.Uint32(m[6:]) >> 4) & mask
+		h3 += (binary.LittleEndian.Uint32(m[9:]) >> 6) & mask
+		h4 += (binary.LittleEndian.Uint32(m[12:]) >> 8) | hibit
+
+		d0 := uint64(h0)*uint64(r0) + uint64(h1)*uint64(s4) + uint64(h2)*uint64(s3) + uint64(h3)*uint64(s2) + uint64(h4)*uint64(s1)
+		d1 := uint64(h0)*uint64(r1) + uint64(h1)*uint64(r0) + uint64(h2)*uint64(s4) + uint64(h3)*uint64(s3) + uint64(h4)*uint64(s2)
+		d2 := uint64(h0)*uint64(r2) + uint64(h1)*uint64(r1) + uint64(h2)*uint64(r0) + uint64(h3)*uint64(s4) + uint64(h4)*uint64(s3)
+		d3 := uint64(h0)*uint64(r3) + uint64(h1)*uint64(r2) + uint64(h2)*uint64(r1) + uint64(h3)*uint64(r0) + uint64(h4)*uint64(s4)
+		d4 := uint64(h0)*uint64(r4) + uint64(h1)*uint64(r3) + uint64(h2)*uint64(r2) + uint64(h3)*uint64(r1) + uint64(h4)*uint64(r0)
+
+		c := d0 >> 26
+		h0 = uint32(d0) & mask
+		d1 += c
+		c = d1 >> 26
+		h1 = uint32(d1) & mask
+		d2 += c
+		c = d2 >> 26
+		h2 = uint32(d2) & mask
+		d3 += c
+		c = d3 >> 26
+		h3 = uint32(d3) & mask
+		d4 += c
+		c = d4 >> 26
+		h4 = uint32(d4) & mask
+		h0 += uint32(c) * 5
+		h1 += h0 >> 26
+		h0 &= mask
+	}
+
+	// Fully carry h
+	c := h1 >> 26
+	h1 &= mask
+	h2 += c
+	c = h2 >> 26
+	h2 &= mask
+	h3 += c
+	c = h3 >> 26
+	h3 &= mask
+	h4 += c
+	c = h4 >> 26
+	h4 &= mask
+	h0 += c * 5
+	c = h0 >> 26
+	h0 &= mask
+	h1 += c
+
+	// Compute h - p and select it if h >= p
+	g0 := h0 + 5
+	c = g0 >> 26
+	g0 &= mask
+	g1 := h1 + c
+	c = g1 >> 26
+	g1 &= mask
+	g2 := h2 + c
+	c = g2 >> 26
+	g2 &= mask
+	g3 := h3 + c
+	c = g3 >> 26
+	g3 &= mask
+	g4 := h4 + c - (1 << 26)
+
+	sel := (g4 >> 31) - 1
+	g0 &= sel
+	g1 &= sel
+	g2 &= sel
+	g3 &= sel
+	g4 &= sel
+	sel = ^sel
+	h0 = (h0 & sel) | g0
+	h1 = (h1 & sel) | g1
+	h2 = (h2 & sel) | g2
+	h3 = (h3 & sel) | g3
+	h4 = (h4 & sel) | g4
+
+	// h = h mod 2^128 + s
+	h0 = h0 | h1<<26
+	h1 = h1>>6 | h2<<20
+	h2 = h2>>12 | h3<<14
+	h3 = h3>>18 | h4<<8
+
+	f := uint64(h0) + uint64(binary.LittleEndian.Uint32(key[16:]))
+	h0 = uint32(f)
+	f = uint64(h1) + uint64(binary.LittleEndian.Uint32(key[20:])) + f>>32
+	h1 = uint32(f)
+	f = uint64(h2) + uint64(binary.LittleEndian.Uint32(key[24:])) + f>>32
+	h2 = uint32(f)
+	f = uint64(h3) + uint64(binary.LittleEndian.Uint32(key[28:])) + f>>32
+	h3 = uint32(f)
+
+	var tag [TagSize]byte
+	binary.LittleEndian.PutUint32(tag[0:], h0)
+	binary.LittleEndian.PutUint32(tag[4:], h1)
+	binary.LittleEndian.PutUint32(tag[8:], h2)
+	binary.LittleEndian.PutUint32(tag[12:], h3)
+	return tag
+}
@@ -0,0 +1,289 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package chain
+
+import (
+	"errors"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/message"
+)
+
+var (
+	// ErrUnknownParent is returned when a header does not connect to a known block
+	ErrUnknownParent = errors.New("header does not connect to a known block")
+
+	// ErrBadProofOfWork is returned when a header hash does not meet its target
+	ErrBadProofOfWork = errors.New("header does not meet its proof of work target")
+
+	// ErrTimeTooOld is returned when a header is not later than the median time past
+	ErrTimeTooOld = errors.New("header time is not after median time past")
+
+	// ErrTimeTooNew is returned when a header is too far ahead of the adjusted time
+	ErrTimeTooNew = errors.New("header time is too far in the future")
+
+	// ErrBadDifficulty is returned when a header's target bits are not those required
+	ErrBadDifficulty = errors.New("header target does not match required difficulty")
+
+	// ErrTimeWarp is returned when a header starting a retarget interval is too
+	// far before its parent (BIP0094)
+	ErrTimeWarp = errors.New("header time is too far before its parent")
+
+	// ErrCheckpointMismatch is returned when a header at a checkpoint height has another hash
+	ErrCheckpointMismatch = errors.New("header conflicts with a checkpoint")
+
+	// ErrForkBeforeCheckpoint is returned when a header forks the chain below the last checkpoint
+	ErrForkBeforeCheckpoint = errors.New("header forks the chain below a checkpoint")
+)
+
+const (
+	// MaxFutureBlockTime is how far ahead of the adjusted time a header may be
+	MaxFutureBlockTime = 2 * time.Hour
+
+	// Number of blocks whose median time a header must be later than
+	medianTimeBlocks = 11
+)
+
+// Block is a header in the chain
+type Block struct {
+	Header message.BlockHeader
+	Hash   [32]byte
+	Height int32
+	Work   *big.Int // Total work of the chain up to and including the block
+	Parent *Block   // Nil for the genesis block
+}
+
+// MedianTimePast returns the median time of the block and up to 10 ancestors
+func (b *Block) MedianTimePast() uint32 {
+	times := make([]uint32, 0, medianTimeBlocks)
+	for n := b; n != nil && len(times) < medianTimeBlocks; n = n.Parent {
+		times = append(times, n.Header.Timestamp)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2]
+}
+
+// Chain is a tree of validated headers starting at the genesis block. The
+// best chain is the branch with the most work, and is a View
+type Chain struct {
+	mu       sync.RWMutex
+	notifyMu sync.Mutex // Held while adding a header and delivering its event
+	params   *Params
+	clock    TimeSource
+	blocks   map[[32]byte]*Block
+	best     []*Block // Best chain by height
+	subs     []*Subscription
+}
+
+// New returns a chain holding only the genesis block of params
+func New(params *Params) *Chain {
+	genesis := &Block{
+		Header: params.Genesis,
+		Hash:   params.GenesisHash(),
+		Work:   CalcWork(params.Genesis.Bits),
+	}
+	return &Chain{
+		params: params,
+		clock:  systemTime{},
+		blocks: map[[32]byte]*Block{genesis.Hash: genesis},
+		best:   []*Block{genesis},
+	}
+}
+
+// Params returns the network parameters headers are validated with
+func (c *Chain) Params() *Params {
+	return c.params
+}
+
+// SetTimeSource sets the clock headers too far in the future are rejected
+// by, such as the network adjusted time. The system clock is used by default
+func (c *Chain) SetTimeSource(ts TimeSource) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock = ts
+}
+
+// Height returns the height of the best chain tip
+func (c *Chain) Height() int32 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return int32(len(c.best)) - 1
+}
+
+// HashAt returns the hash of the best chain block at height
+func (c *Chain) HashAt(height int32) ([32]byte, bool) {
+	if b, ok := c.BlockAt(height); ok {
+		return b.Hash, true
+	}
+	return [32]byte{}, false
+}
+
+// BlockAt returns the best chain block at height
+func (c *Chain) BlockAt(height int32) (*Block, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if height < 0 || int(height) >= len(c.best) {
+		return nil, false
+	}
+	return c.best[height], true
+}
+
+// Tip returns the tip of the best chain
+func (c *Chain) Tip() *Block {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.best[len(c.best)-1]
+}
+
+// Block returns the block with hash, in the best chain or not
+func (c *Chain) Block(hash [32]byte) (*Block, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	b, ok := c.blocks[hash]
+	return b, ok
+}
+
+// AddHeaders adds headers in order, stopping at the first invalid header
+func (c *Chain) AddHeaders(headers []message.BlockHeader) error {
+	for _, h := range headers {
+		if _, err := c.AddHeader(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddHeader validates a header and adds it to the chain, switching the best
+// chain to its branch if that has the most work. Known headers are returned as is
+func (c *Chain) AddHeader(h message.BlockHeader) (*Block, error) {
+	// Adding headers one at a time until their events are delivered keeps
+	// subscribers seeing changes in the order they were made
+	c.notifyMu.Lock()
+	defer c.notifyMu.Unlock()
+	b, e, err := c.addHeader(h)
+	if e != nil {
+		c.notify(*e)
+	}
+	return b, err
+}
+
+// addHeader adds h, returning the event for a change of best chain if any
+func (c *Chain) addHeader(h message.BlockHeader) (*Block, *Event, error) {
+	hash := h.BlockHash()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b, ok := c.blocks[hash]; ok {
+		return b, nil, nil
+	}
+	parent, ok := c.blocks[h.PrevBlock]
+	if !ok {
+		return nil, nil, ErrUnknownParent
+	}
+	b := &Block{Header: h, Hash: hash, Height: parent.Height + 1, Parent: parent}
+	if err := c.checkHeader(b); err != nil {
+		return nil, nil, err
+	}
+	b.Work = new(big.Int).Add(parent.Work, CalcWork(h.Bits))
+	c.blocks[hash] = b
+	if b.Work.Cmp(c.best[len(c.best)-1].Work) <= 0 {
+		return b, nil, nil
+	}
+	e := c.setTip(b)
+	return b, &e, nil
+}
+
+// Confirmations returns the number of best chain blocks from the block with
+// hash to the tip inclusive, 0 if the block is unknown or not in the best chain
+func (c *Chain) Confirmations(hash [32]byte) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	b, ok := c.blocks[hash]
+	if !ok || int(b.Height) >= len(c.best) || c.best[b.Height] != b {
+		return 0
+	}
+	return len(c.best) - int(b.Height)
+}
+
+// InBestChain reports whether the block with hash is in the best chain
+func (c *Chain) InBestChain(hash [32]byte) bool {
+	return c.Confirmations(hash) > 0
+}
+
+// checkHeader validates b against its parent, the chain, the clock, the
+// difficulty rules of the network and checkpoints
+func (c *Chain) checkHeader(b *Block) error {
+	if err := c.params.CheckProofOfWork(b.Hash, b.Header.Bits); err != nil {
+		return err
+	}
+	if b.Header.Bits != c.params.NextBits(b.Parent, b.Header.Timestamp) {
+		return ErrBadDifficulty
+	}
+	if b.Header.Timestamp <= b.Parent.MedianTimePast() {
+		return ErrTimeTooOld
+	}
+	if time.Unix(int64(b.Header.Timestamp), 0).After(c.clock.Now().Add(MaxFutureBlockTime)) {
+		return ErrTimeTooNew
+	}
+	if !c.params.checkTimeWarp(b.Parent, b.Height, b.Header.Timestamp) {
+		return ErrTimeWarp
+	}
+	if cp, ok := c.params.Checkpoint(b.Height); ok && cp.Hash != b.Hash {
+		return ErrCheckpointMismatch
+	}
+	if b.Height < c.lastCheckpointHeight() {
+		return ErrForkBeforeCheckpoint
+	}
+	return nil
+}
+
+// lastCheckpointHeight returns the height of the highest checkpoint reached by the best chain
+func (c *Chain) lastCheckpointHeight() int32 {
+	height := int32(0)
+	for _, cp := range c.params.Checkpoints {
+		if int(cp.Height) < len(c.best) {
+			height = cp.Height
+		}
+	}
+	return height
+}
+
+// setTip makes the branch ending at tip the best chain
+func (c *Chain) setTip(tip *Block) Event {
+	fork := tip
+	for int(fork.Height) >= len(c.best) || c.best[fork.Height] != fork {
+		fork = fork.Parent
+	}
+	e := Event{Type: EventExtended, Fork: fork}
+	for i := len(c.best) - 1; i > int(fork.Height); i-- {
+		e.Disconnected = append(e.Disconnected, c.best[i])
+	}
+	if len(e.Disconnected) > 0 {
+		e.Type = EventReorg
+		e.Depth = len(e.Disconnected)
+	}
+
+	best := append(c.best[:fork.Height+1], make([]*Block, tip.Height-fork.Height)...)
+	for b := tip; b != fork; b = b.Parent {
+		best[b.Height] = b
+	}
+	c.best = best
+	e.Connected = append([]*Block{}, best[fork.Height+1:]...)
+	return e
+}
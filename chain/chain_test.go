@@ -0,0 +1,183 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package chain
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/message"
+)
+
+// Bits of the easiest target allowed by testParams, about one hash in two meets it
+const testBits = 0x207fffff
+
+// testParams returns regtest like params whose headers are mined instantly
+func testParams() *Params {
+	p := &Params{
+		Name:           "test",
+		PowLimit:       CompactToBig(testBits),
+		TargetTimespan: 14 * 24 * time.Hour,
+		TargetSpacing:  10 * time.Minute,
+	}
+	p.Genesis = message.BlockHeader{Version: 1, Timestamp: 1000, Bits: testBits}
+	for HashToBig(p.Genesis.BlockHash()).Cmp(p.PowLimit) > 0 {
+		p.Genesis.Nonce++
+	}
+	return p
+}
+
+// mine returns a valid header following prev, branches are told apart by salt
+func mine(prev message.BlockHeader, salt byte, timestamp uint32) message.BlockHeader {
+	return mineBits(prev, salt, timestamp, testBits)
+}
+
+// mineBits returns a header following prev meeting the target bits
+func mineBits(prev message.BlockHeader, salt byte, timestamp uint32, bits uint32) message.BlockHeader {
+	h := message.BlockHeader{
+		Version:    4,
+		PrevBlock:  prev.BlockHash(),
+		MerkleRoot: [32]byte{salt},
+		Timestamp:  timestamp,
+		Bits:       bits,
+	}
+	for HashToBig(h.BlockHash()).Cmp(CompactToBig(h.Bits)) > 0 {
+		h.Nonce++
+	}
+	return h
+}
+
+// build returns n headers following from, spaced ten minutes apart
+func build(from message.BlockHeader, n int, salt byte) []message.BlockHeader {
+	headers := make([]message.BlockHeader, 0, n)
+	prev := from
+	for i := 0; i < n; i++ {
+		prev = mine(prev, salt, prev.Timestamp+600)
+		headers = append(headers, prev)
+	}
+	return headers
+}
+
+func TestAddHeaders(t *testing.T) {
+	p := testParams()
+	c := New(p)
+	headers := build(p.Genesis, 20, 1)
+	if err := c.AddHeaders(headers); err != nil {
+		t.Fatal(err)
+	}
+	if c.Height() != 20 || c.Tip().Hash != headers[19].BlockHash() {
+		t.Fatalf("tip at height %d, want 20", c.Height())
+	}
+	for i, h := range headers {
+		if hash, ok := c.HashAt(int32(i + 1)); !ok || hash != h.BlockHash() {
+			t.Fatalf("wrong hash at height %d", i+1)
+		}
+	}
+
+	b, err := c.AddHeader(headers[5])
+	if err != nil || b.Height != 6 {
+		t.Fatalf("known header: got %v at %d", err, b.Height)
+	}
+	if _, err := c.AddHeader(mine(message.BlockHeader{Nonce: 1}, 1, 5000)); err != ErrUnknownParent {
+		t.Fatalf("unknown parent: got %v", err)
+	}
+
+	bad := mine(headers[19], 1, headers[19].Timestamp+600)
+	for HashToBig(bad.BlockHash()).Cmp(CompactToBig(bad.Bits)) <= 0 {
+		bad.Nonce++
+	}
+	if _, err := c.AddHeader(bad); err != ErrBadProofOfWork {
+		t.Fatalf("bad proof of work: got %v", err)
+	}
+	easier := mine(headers[19], 1, headers[19].Timestamp+600)
+	easier.Bits = 0x2100ffff
+	if _, err := c.AddHeader(easier); err != ErrBadProofOfWork {
+		t.Fatalf("target above pow limit: got %v", err)
+	}
+	if c.Height() != 20 {
+		t.Fatalf("invalid headers changed the tip to height %d", c.Height())
+	}
+}
+
+func TestMedianTimePast(t *testing.T) {
+	p := testParams()
+	c := New(p)
+	headers := build(p.Genesis, 20, 1)
+	if err := c.AddHeaders(headers); err != nil {
+		t.Fatal(err)
+	}
+
+	// The median of the last 11 timestamps, spaced 600 seconds apart, is the sixth from the tip
+	mtp := headers[19].Timestamp - 5*600
+	if got := c.Tip().MedianTimePast(); got != mtp {
+		t.Fatalf("median time past %d, want %d", got, mtp)
+	}
+	if _, err := c.AddHeader(mine(headers[19], 1, mtp)); err != ErrTimeTooOld {
+		t.Fatalf("header at median time past: got %v, want ErrTimeTooOld", err)
+	}
+	if _, err := c.AddHeader(mine(headers[19], 1, mtp+1)); err != nil {
+		t.Fatalf("header after median time past: %v", err)
+	}
+
+	future := uint32(time.Now().Add(MaxFutureBlockTime + time.Minute).Unix())
+	if _, err := c.AddHeader(mine(c.Tip().Header, 1, future)); err != ErrTimeTooNew {
+		t.Fatalf("header in the future: got %v, want ErrTimeTooNew", err)
+	}
+}
+
+func TestCheckpoints(t *testing.T) {
+	p := testParams()
+	main := build(p.Genesis, 30, 1)
+	p.Checkpoints = []Checkpoint{{20, main[19].BlockHash()}, {500, [32]byte{1}}}
+	c := New(p)
+	if err := c.AddHeaders(main[:19]); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.AddHeader(build(main[18], 1, 2)[0]); err != ErrCheckpointMismatch {
+		t.Fatalf("header at checkpoint height: got %v, want ErrCheckpointMismatch", err)
+	}
+
+	// Forks are allowed until the chain reaches a checkpoint
+	if err := c.AddHeaders(build(main[9], 5, 2)); err != nil {
+		t.Fatalf("fork below an unreached checkpoint: %v", err)
+	}
+	if err := c.AddHeaders(main[19:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddHeaders(build(main[9], 5, 3)); err != ErrForkBeforeCheckpoint {
+		t.Fatalf("fork below a reached checkpoint: got %v, want ErrForkBeforeCheckpoint", err)
+	}
+	if err := c.AddHeaders(build(main[24], 3, 3)); err != nil {
+		t.Fatalf("fork above a reached checkpoint: %v", err)
+	}
+	if c.Tip().Hash != main[29].BlockHash() {
+		t.Fatal("shorter forks changed the tip")
+	}
+}
+
+func TestCalcWork(t *testing.T) {
+	// Difficulty 1 is 2^32 expected hashes, 0x100010001 from rounding
+	if got := CalcWork(0x1d00ffff); got.Cmp(big.NewInt(0x100010001)) != 0 {
+		t.Fatalf("work of difficulty 1: got %v", got)
+	}
+	for _, bits := range []uint32{0x1d00ffff, 0x1b0404cb, testBits, 0x03123456} {
+		if got := BigToCompact(CompactToBig(bits)); got != bits {
+			t.Fatalf("compact %08x round trips to %08x", bits, got)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package chain
+
+import (
+	"math/big"
+	"time"
+)
+
+// Most a block starting a retarget interval may be earlier than its parent (BIP0094)
+const maxTimeWarp = 600
+
+// RetargetInterval returns the number of blocks between difficulty adjustments
+func (p *Params) RetargetInterval() int32 {
+	return int32(p.TargetTimespan / p.TargetSpacing)
+}
+
+// NextBits returns the target bits required of a block with the given
+// timestamp following parent
+func (p *Params) NextBits(parent *Block, timestamp uint32) uint32 {
+	interval := p.RetargetInterval()
+	powLimitBits := BigToCompact(p.PowLimit)
+
+	if (parent.Height+1)%interval != 0 {
+		if !p.ReduceMinDifficulty {
+			return parent.Header.Bits
+		}
+
+		// Blocks long after their parent may have the minimum difficulty
+		if int64(timestamp) > int64(parent.Header.Timestamp)+int64(p.MinDiffReductionTime/time.Second) {
+			return powLimitBits
+		}
+
+		// Otherwise the difficulty is that of the last block not mined at minimum difficulty
+		b := parent
+		for b.Parent != nil && b.Height%interval != 0 && b.Header.Bits == powLimitBits {
+			b = b.Parent
+		}
+		return b.Header.Bits
+	}
+
+	first := parent
+	for i := int32(0); i < interval-1; i++ {
+		first = first.Parent
+	}
+	timespan := int64(parent.Header.Timestamp) - int64(first.Header.Timestamp)
+	target := int64(p.TargetTimespan / time.Second)
+	if timespan < target/4 {
+		timespan = target / 4
+	}
+	if timespan > target*4 {
+		timespan = target * 4
+	}
+
+	// The first block of an interval can not use the minimum difficulty, so
+	// it keeps the real difficulty where the last block may not (BIP0094)
+	bits := parent.Header.Bits
+	if p.EnforceBIP94 {
+		bits = first.Header.Bits
+	}
+	next := CompactToBig(bits)
+	next.Mul(next, big.NewInt(timespan))
+	next.Div(next, big.NewInt(target))
+	if next.Cmp(p.PowLimit) > 0 {
+		next.Set(p.PowLimit)
+	}
+	return BigToCompact(next)
+}
+
+// checkTimeWarp reports whether a block at height with the given timestamp
+// following parent is allowed by the time warp fix, where it applies (BIP0094)
+func (p *Params) checkTimeWarp(parent *Block, height int32, timestamp uint32) bool {
+	if !p.EnforceBIP94 || height%p.RetargetInterval() != 0 {
+		return true
+	}
+	return int64(timestamp) >= int64(parent.Header.Timestamp)-maxTimeWarp
+}
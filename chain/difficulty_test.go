@@ -0,0 +1,189 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package chain
+
+import (
+	"testing"
+
+	"github.com/sanscentral/sansnetwork/message"
+)
+
+// links returns n linked blocks from height start with headers from f
+func links(start int32, n int, f func(i int) message.BlockHeader) []*Block {
+	blocks := make([]*Block, 0, n)
+	var parent *Block
+	for i := 0; i < n; i++ {
+		b := &Block{Header: f(i), Height: start + int32(i), Parent: parent}
+		blocks = append(blocks, b)
+		parent = b
+	}
+	return blocks
+}
+
+// interval returns the blocks of a retarget interval from height start with
+// the given bits, whose first and last blocks have the given timestamps
+func interval(start int32, bits, first, last uint32) []*Block {
+	return links(start, 2016, func(i int) message.BlockHeader {
+		ts := first + uint32(i)
+		if i == 2015 {
+			ts = last
+		}
+		return message.BlockHeader{Bits: bits, Timestamp: ts}
+	})
+}
+
+func TestNextBitsMainNet(t *testing.T) {
+	// Retargets of the main network, the timestamps are those of the first
+	// and last blocks of each interval
+	tests := []struct {
+		name        string
+		start       int32
+		bits        uint32
+		first, last uint32
+		want        uint32
+	}{
+		{"blocks 30240 to 32255", 30240, 0x1d00ffff, 1261130161, 1262152739, 0x1d00d86a},
+		{"at the pow limit, blocks 0 to 2015", 0, 0x1d00ffff, 1231006505, 1233061996, 0x1d00ffff},
+		{"lower limit, blocks 66528 to 68543", 66528, 0x1c05a3f4, 1279008237, 1279297671, 0x1c0168fd},
+		{"upper limit, blocks 46368 to 48383", 46368, 0x1c387f6f, 1263163443, 1269211443, 0x1d00e1fd},
+	}
+	for _, test := range tests {
+		blocks := interval(test.start, test.bits, test.first, test.last)
+		if got := MainNetParams.NextBits(blocks[2015], test.last+600); got != test.want {
+			t.Errorf("%s: got %08x, want %08x", test.name, got, test.want)
+		}
+		if got := MainNetParams.NextBits(blocks[100], test.last+600); got != test.bits {
+			t.Errorf("%s: difficulty changed within the interval to %08x", test.name, got)
+		}
+	}
+}
+
+func TestGenesisHashes(t *testing.T) {
+	tests := []struct {
+		params *Params
+		want   string
+	}{
+		{&MainNetParams, "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f"},
+		{&TestNet3Params, "000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943"},
+		{&TestNet4Params, "00000000da84f2bafbbc53dee25a72ae507ff4914b867c565be350b0da8bf043"},
+	}
+	for _, test := range tests {
+		if test.params.GenesisHash() != mustHash(test.want) {
+			t.Errorf("%s: wrong genesis hash", test.params.Name)
+		}
+	}
+}
+
+func TestTestNet3Headers(t *testing.T) {
+	// Blocks 1 and 2 of the version 3 test network
+	headers := []message.BlockHeader{
+		{
+			Version:    1,
+			PrevBlock:  TestNet3Params.GenesisHash(),
+			MerkleRoot: mustHash("f0315ffc38709d70ad5647e22048358dd3745f3ce3874223c80a7c92fab0c8ba"),
+			Timestamp:  1296688928,
+			Bits:       0x1d00ffff,
+			Nonce:      1924588547,
+		},
+		{
+			Version:    1,
+			PrevBlock:  mustHash("00000000b873e79784647a6c82962c70d228557d24a747ea4d1b8bbe878e1206"),
+			MerkleRoot: mustHash("20222eb90f5895556926c112bb5aa0df4ab5abc3107e21a6950aec3b2e3541e2"),
+			Timestamp:  1296688946,
+			Bits:       0x1d00ffff,
+			Nonce:      875942400,
+		},
+	}
+	c := New(&TestNet3Params)
+	if err := c.AddHeaders(headers); err != nil {
+		t.Fatal(err)
+	}
+	if c.Tip().Hash != mustHash("000000006c02c8ea6e4ff69651f7fcde348fb9d557a06e6957b65552002a7820") {
+		t.Fatal("wrong tip after block 2")
+	}
+}
+
+// TestMinDifficultySynthetic checks the testnet3 minimum difficulty rule on
+// synthetic headers. Real testnet3 headers around a minimum difficulty block
+// are not in the test data yet, only blocks 1 and 2 in TestTestNet3Headers
+func TestMinDifficultySynthetic(t *testing.T) {
+	p := &TestNet3Params
+	powLimitBits := BigToCompact(p.PowLimit)
+
+	// Five blocks at the real difficulty then five at the minimum difficulty
+	blocks := links(4032, 10, func(i int) message.BlockHeader {
+		bits := uint32(0x1c0ffff0)
+		if i >= 5 {
+			bits = powLimitBits
+		}
+		return message.BlockHeader{Bits: bits, Timestamp: uint32(1000 + i*600)}
+	})
+	parent := blocks[9]
+	if got := p.NextBits(parent, parent.Header.Timestamp+1201); got != powLimitBits {
+		t.Fatalf("block more than 20 minutes after its parent: got %08x, want the minimum difficulty", got)
+	}
+	if got := p.NextBits(parent, parent.Header.Timestamp+1200); got != 0x1c0ffff0 {
+		t.Fatalf("block 20 minutes after its parent: got %08x, want the last real difficulty", got)
+	}
+	if got := MainNetParams.NextBits(parent, parent.Header.Timestamp+1201); got != parent.Header.Bits {
+		t.Fatalf("main network allowed the minimum difficulty: got %08x", got)
+	}
+
+	// The search for the last real difficulty stops at the start of the interval
+	blocks = links(4032, 10, func(i int) message.BlockHeader {
+		return message.BlockHeader{Bits: powLimitBits, Timestamp: uint32(1000 + i*600)}
+	})
+	if got := p.NextBits(blocks[9], blocks[9].Header.Timestamp+600); got != powLimitBits {
+		t.Fatalf("search passed the start of the interval: got %08x", got)
+	}
+}
+
+// TestBIP94RetargetSynthetic checks the testnet4 retarget and time warp
+// rules on synthetic headers. Real testnet4 headers at a retarget boundary
+// are not in the test data yet
+func TestBIP94RetargetSynthetic(t *testing.T) {
+	// An interval at the real difficulty whose last block has the minimum difficulty
+	blocks := links(2016, 2016, func(i int) message.BlockHeader {
+		bits := uint32(0x1c0ffff0)
+		if i == 2015 {
+			bits = 0x1d00ffff
+		}
+		return message.BlockHeader{Bits: bits, Timestamp: uint32(1000 + i*600)}
+	})
+	parent := blocks[2015]
+
+	// Testnet3 retargets from the last block, so the difficulty resets to about the minimum
+	if got := TestNet3Params.NextBits(parent, parent.Header.Timestamp+600); got != 0x1d00ffde {
+		t.Fatalf("testnet3 retarget: got %08x, want 1d00ffde", got)
+	}
+
+	// Testnet4 retargets from the first block of the interval
+	if got := TestNet4Params.NextBits(parent, parent.Header.Timestamp+600); got != 0x1c0ffde7 {
+		t.Fatalf("testnet4 retarget: got %08x, want 1c0ffde7", got)
+	}
+
+	// The first block of an interval may be at most 600 seconds before its parent
+	ts := parent.Header.Timestamp
+	if !TestNet4Params.checkTimeWarp(parent, 4032, ts-600) {
+		t.Fatal("testnet4 rejected a block 600 seconds before its parent")
+	}
+	if TestNet4Params.checkTimeWarp(parent, 4032, ts-601) {
+		t.Fatal("testnet4 allowed a block 601 seconds before its parent")
+	}
+	if !TestNet4Params.checkTimeWarp(parent, 4033, 0) || !TestNet3Params.checkTimeWarp(parent, 4032, 0) {
+		t.Fatal("time warp rule applied outside testnet4 retargets")
+	}
+}
@@ -0,0 +1,82 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package chain
+
+// EventType identifies the kind of chain event
+type EventType int
+
+const (
+	// EventExtended is published when blocks are added to the tip of the best chain
+	EventExtended EventType = iota
+
+	// EventReorg is published when the best chain switches to another branch,
+	// disconnecting blocks from the previous best chain
+	EventReorg
+)
+
+// Event is a change of the best chain
+type Event struct {
+	Type         EventType
+	Fork         *Block   // Last block common to the previous and new best chains
+	Disconnected []*Block // Blocks which left the best chain, previous tip first
+	Connected    []*Block // Blocks which joined the best chain, in height order
+	Depth        int      // Number of blocks disconnected
+}
+
+// Handler is type for chain event callbacks
+type Handler func(Event)
+
+// Subscription is a registered chain event handler
+type Subscription struct {
+	c       *Chain
+	handler Handler
+}
+
+// Subscribe calls h for every change of the best chain. Handlers are called
+// after the chain has been updated, from the goroutine adding headers, one
+// event at a time in the order the changes were made. Handlers may read the
+// chain but must not add headers to it
+func (c *Chain) Subscribe(h Handler) *Subscription {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := &Subscription{c: c, handler: h}
+	c.subs = append(c.subs, s)
+	return s
+}
+
+// Unsubscribe stops delivery of further events to this handler
+func (s *Subscription) Unsubscribe() {
+	c := s.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	subs := make([]*Subscription, 0, len(c.subs))
+	for _, e := range c.subs {
+		if e != s {
+			subs = append(subs, e)
+		}
+	}
+	c.subs = subs
+}
+
+// notify delivers e to subscribers, it must be called without holding mu
+func (c *Chain) notify(e Event) {
+	c.mu.RLock()
+	subs := c.subs
+	c.mu.RUnlock()
+	for _, s := range subs {
+		s.handler(e)
+	}
+}
@@ -0,0 +1,184 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package chain
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/message"
+)
+
+func TestReorgEvents(t *testing.T) {
+	p := testParams()
+	c := New(p)
+	var events []Event
+	c.Subscribe(func(e Event) { events = append(events, e) })
+
+	main := build(p.Genesis, 5, 1)
+	if err := c.AddHeaders(main); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 5 {
+		t.Fatalf("got %d events extending the chain, want 5", len(events))
+	}
+	for i, e := range events {
+		if e.Type != EventExtended || len(e.Connected) != 1 || e.Connected[0].Hash != main[i].BlockHash() {
+			t.Fatalf("event %d does not extend the chain by block %d", i, i+1)
+		}
+	}
+
+	// A branch from block 2 overtakes the chain at its fourth block
+	events = nil
+	fork := build(main[1], 4, 2)
+	if err := c.AddHeaders(fork); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("got %d events for the branch, want 1", len(events))
+	}
+	e := events[0]
+	if e.Type != EventReorg || e.Depth != 3 || e.Fork.Hash != main[1].BlockHash() {
+		t.Fatalf("got event type %d depth %d, want a reorg of depth 3 from block 2", e.Type, e.Depth)
+	}
+	for i, b := range e.Disconnected {
+		if b.Hash != main[4-i].BlockHash() {
+			t.Fatalf("disconnected block %d is not block %d", i, 5-i)
+		}
+	}
+	if len(e.Connected) != 4 {
+		t.Fatalf("got %d connected blocks, want 4", len(e.Connected))
+	}
+	for i, b := range e.Connected {
+		if b.Hash != fork[i].BlockHash() {
+			t.Fatalf("connected block %d is not branch block %d", i, i)
+		}
+	}
+
+	if c.InBestChain(main[4].BlockHash()) || c.Confirmations(main[2].BlockHash()) != 0 {
+		t.Fatal("disconnected blocks are still in the best chain")
+	}
+	if got := c.Confirmations(fork[0].BlockHash()); got != 4 {
+		t.Fatalf("first branch block has %d confirmations, want 4", got)
+	}
+	if got := c.Confirmations(main[1].BlockHash()); got != 5 {
+		t.Fatalf("fork block has %d confirmations, want 5", got)
+	}
+	if c.Confirmations([32]byte{1}) != 0 {
+		t.Fatal("unknown block has confirmations")
+	}
+}
+
+func TestConfirmationsAboveTip(t *testing.T) {
+	// Blocks long after their parent have the minimum difficulty, so a short
+	// branch at the real difficulty has more work than a long one at the minimum
+	const hardBits = 0x1f7fffff
+	p := testParams()
+	p.ReduceMinDifficulty = true
+	p.MinDiffReductionTime = 20 * time.Minute
+	p.Genesis = message.BlockHeader{Version: 1, Timestamp: 1000, Bits: hardBits}
+	for HashToBig(p.Genesis.BlockHash()).Cmp(CompactToBig(hardBits)) > 0 {
+		p.Genesis.Nonce++
+	}
+	c := New(p)
+
+	easy := make([]message.BlockHeader, 0, 5)
+	prev := p.Genesis
+	for i := 0; i < 5; i++ {
+		prev = mine(prev, 1, prev.Timestamp+1800)
+		easy = append(easy, prev)
+	}
+	if err := c.AddHeaders(easy); err != nil {
+		t.Fatal(err)
+	}
+	hard := mineBits(p.Genesis, 2, p.Genesis.Timestamp+600, hardBits)
+	if _, err := c.AddHeader(hard); err != nil {
+		t.Fatal(err)
+	}
+	if c.Height() != 1 || c.Tip().Hash != hard.BlockHash() {
+		t.Fatalf("tip at height %d, want the branch with more work", c.Height())
+	}
+
+	// Side branch blocks above the tip are not in the best chain
+	for i, h := range easy {
+		if c.InBestChain(h.BlockHash()) {
+			t.Fatalf("side branch block %d is in the best chain", i+1)
+		}
+	}
+	if c.Confirmations(hard.BlockHash()) != 1 || c.Confirmations(p.GenesisHash()) != 2 {
+		t.Fatal("wrong confirmations in the best chain")
+	}
+}
+
+func TestEventOrder(t *testing.T) {
+	p := testParams()
+	c := New(p)
+	tip := c.Tip()
+	var mu sync.Mutex
+	var bad, overlapped, running int32
+	c.Subscribe(func(e Event) {
+		// Handlers must not run concurrently, give others the chance to
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.AddInt32(&overlapped, 1)
+		}
+		defer atomic.AddInt32(&running, -1)
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		// Every event must start from the tip left by the one before
+		from := e.Fork
+		if e.Type == EventReorg {
+			from = e.Disconnected[0]
+		}
+		if from != tip {
+			bad++
+		}
+		tip = e.Connected[len(e.Connected)-1]
+	})
+
+	// Competing branches added concurrently reorganise the chain back and forth
+	var wg sync.WaitGroup
+	for salt := byte(1); salt <= 4; salt++ {
+		headers := build(p.Genesis, 50, salt)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, h := range headers {
+				if _, err := c.AddHeader(h); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if overlapped > 0 {
+		t.Fatalf("%d events were delivered during another", overlapped)
+	}
+	if bad > 0 {
+		t.Fatalf("%d events did not follow the previous event", bad)
+	}
+	if tip != c.Tip() {
+		t.Fatal("last event does not end at the tip")
+	}
+}
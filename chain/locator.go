@@ -0,0 +1,75 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package chain provides views of the block chain used to
+// synchronise blocks and headers with nodes
+package chain
+
+// View is a chain of blocks from genesis to a tip
+type View interface {
+	// Height returns the height of the tip
+	Height() int32
+
+	// HashAt returns the hash of the block at height, if the chain is that long
+	HashAt(height int32) ([32]byte, bool)
+}
+
+// Number of most recent blocks included in a locator before the gaps grow
+const locatorDenseBlocks = 10
+
+// Hashes is a View of block hashes indexed by height
+type Hashes [][32]byte
+
+// Height returns the height of the last hash
+func (h Hashes) Height() int32 {
+	return int32(len(h)) - 1
+}
+
+// HashAt returns the hash at height
+func (h Hashes) HashAt(height int32) ([32]byte, bool) {
+	if height < 0 || int(height) >= len(h) {
+		return [32]byte{}, false
+	}
+	return h[height], true
+}
+
+// Locator returns a block locator for the tip of v: the hashes of the most
+// recent blocks, then of blocks with doubling gaps back to the genesis block,
+// which is always last. A node replies from the first locator hash it knows
+func Locator(v View) [][32]byte {
+	return LocatorFrom(v, v.Height())
+}
+
+// LocatorFrom returns a block locator for the block at height in v
+func LocatorFrom(v View, height int32) [][32]byte {
+	locator := [][32]byte{}
+	step := int32(1)
+	for height >= 0 {
+		if hash, ok := v.HashAt(height); ok {
+			locator = append(locator, hash)
+		}
+		if height == 0 {
+			break
+		}
+		if len(locator) >= locatorDenseBlocks {
+			step *= 2
+		}
+		height -= step
+		if height < 0 {
+			height = 0
+		}
+	}
+	return locator
+}
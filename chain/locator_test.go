@@ -0,0 +1,91 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package chain
+
+import "testing"
+
+// testHashes returns a View of n distinct hashes
+func testHashes(n int) Hashes {
+	h := make(Hashes, n)
+	for i := range h {
+		h[i] = [32]byte{byte(i), byte(i >> 8), 1}
+	}
+	return h
+}
+
+// heights returns the heights of the hashes in locator
+func heights(v Hashes, locator [][32]byte) []int {
+	index := map[[32]byte]int{}
+	for i, h := range v {
+		index[h] = i
+	}
+	res := make([]int, len(locator))
+	for i, h := range locator {
+		res[i] = index[h]
+	}
+	return res
+}
+
+func TestLocatorSpacing(t *testing.T) {
+	v := testHashes(1000)
+	want := []int{999, 998, 997, 996, 995, 994, 993, 992, 991, 990, 988, 984, 976, 960, 928, 864, 736, 480, 0}
+	got := heights(v, Locator(v))
+	if len(got) != len(want) {
+		t.Fatalf("locator heights %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("locator heights %v, want %v", got, want)
+		}
+	}
+}
+
+func TestLocatorShortChain(t *testing.T) {
+	v := testHashes(6)
+	got := heights(v, Locator(v))
+	for i, height := range got {
+		if height != 5-i {
+			t.Fatalf("locator heights %v, want every block from the tip", got)
+		}
+	}
+	if len(got) != 6 {
+		t.Fatalf("locator has %d hashes, want 6", len(got))
+	}
+
+	genesis := testHashes(1)
+	if loc := Locator(genesis); len(loc) != 1 || loc[0] != genesis[0] {
+		t.Fatal("locator of the genesis block is not the genesis hash")
+	}
+}
+
+func TestLocatorFrom(t *testing.T) {
+	v := testHashes(100)
+	loc := LocatorFrom(v, 50)
+	if loc[0] != v[50] || loc[len(loc)-1] != v[0] {
+		t.Fatal("locator does not run from the requested height to genesis")
+	}
+
+	// Heights beyond the view are skipped rather than included as zero hashes
+	loc = LocatorFrom(v, 105)
+	for _, h := range loc {
+		if h == ([32]byte{}) {
+			t.Fatal("locator includes a missing block")
+		}
+	}
+	if loc[len(loc)-1] != v[0] {
+		t.Fatal("locator does not end at genesis")
+	}
+}
@@ -0,0 +1,142 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package chain
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/typeconv"
+)
+
+// Checkpoint is a block known to be in the best chain
+type Checkpoint struct {
+	Height int32
+	Hash   [32]byte
+}
+
+// Params are the consensus parameters of a network used to validate headers
+type Params struct {
+	Name        string
+	Genesis     message.BlockHeader
+	PowLimit    *big.Int     // Highest allowed target
+	Checkpoints []Checkpoint // In ascending height order
+
+	TargetTimespan       time.Duration // Time each retarget interval should take
+	TargetSpacing        time.Duration // Time each block should take
+	ReduceMinDifficulty  bool          // Blocks may have the minimum difficulty after MinDiffReductionTime
+	MinDiffReductionTime time.Duration // Time after its parent a block may have the minimum difficulty
+	EnforceBIP94         bool          // Retarget from the first block of an interval and prevent time warp (BIP0094)
+}
+
+// GenesisHash returns the hash of the genesis block
+func (p *Params) GenesisHash() [32]byte {
+	return p.Genesis.BlockHash()
+}
+
+// Checkpoint returns the checkpoint at height, if there is one
+func (p *Params) Checkpoint(height int32) (Checkpoint, bool) {
+	for _, cp := range p.Checkpoints {
+		if cp.Height == height {
+			return cp, true
+		}
+	}
+	return Checkpoint{}, false
+}
+
+var (
+	// 2^224 - 1, the target of difficulty 1
+	mainPowLimit = new(big.Int).Sub(new(big.Int).Lsh(bigOne, 224), bigOne)
+
+	genesisMerkleRoot = mustHash("4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b")
+)
+
+// MainNetParams are the parameters of the main bitcoin network
+var MainNetParams = Params{
+	Name: "mainnet",
+	Genesis: message.BlockHeader{
+		Version:    1,
+		MerkleRoot: genesisMerkleRoot,
+		Timestamp:  1231006505,
+		Bits:       0x1d00ffff,
+		Nonce:      2083236893,
+	},
+	PowLimit:       mainPowLimit,
+	TargetTimespan: 14 * 24 * time.Hour,
+	TargetSpacing:  10 * time.Minute,
+	Checkpoints: []Checkpoint{
+		{11111, mustHash("0000000069e244f73d78e8fd29ba2fd2ed618bd6fa2ee92559f542fdb26e7c1d")},
+		{33333, mustHash("000000002dd5588a74784eaa7ab0507a18ad16a236e7b1ce69f00d7ddfb5d0a6")},
+		{74000, mustHash("0000000000573993a3c9e41ce34471c079dcf5f52a0e824a81e7f953b8661a20")},
+		{105000, mustHash("00000000000291ce28027faea320c8d2b054b2e0fe44a773f3eefb151d6bdc97")},
+		{134444, mustHash("00000000000005b12ffd4cd315cd34ffd4a594f430ac814c91184a0d42d2b0fe")},
+		{168000, mustHash("000000000000099e61ea72015e79632f216fe6cb33d7899acb35b75c8303b763")},
+		{193000, mustHash("000000000000059f452a5f7340de6682a977387c17010ff6e6c3bd83ca8b1317")},
+		{210000, mustHash("000000000000048b95347e83192f69cf0366076336c639f9b7228e9ba171342e")},
+		{216116, mustHash("00000000000001b4f4b433e81ee46494af945cf96014816a4e2370f11b23df4e")},
+		{225430, mustHash("00000000000001c108384350f74090433e7fcf79a606b8e797f065b130575932")},
+		{250000, mustHash("000000000000003887df1f29024b06fc2200b55f8af8f35453d7be294df2d214")},
+		{279000, mustHash("0000000000000001ae8c72a0b0c301f67e3afca10e819efa9041e458e9bd7e40")},
+		{295000, mustHash("00000000000000004d9b4ef50f0f9d686fd69db2e03af35a100370c64632a983")},
+	},
+}
+
+// TestNet3Params are the parameters of the version 3 test network
+var TestNet3Params = Params{
+	Name: "testnet3",
+	Genesis: message.BlockHeader{
+		Version:    1,
+		MerkleRoot: genesisMerkleRoot,
+		Timestamp:  1296688602,
+		Bits:       0x1d00ffff,
+		Nonce:      414098458,
+	},
+	PowLimit:             mainPowLimit,
+	TargetTimespan:       14 * 24 * time.Hour,
+	TargetSpacing:        10 * time.Minute,
+	ReduceMinDifficulty:  true,
+	MinDiffReductionTime: 20 * time.Minute,
+	Checkpoints: []Checkpoint{
+		{546, mustHash("000000002a936ca763904c3c35fce2f3556c559c0214345d31b1bcebf76acb70")},
+	},
+}
+
+// TestNet4Params are the parameters of the version 4 test network (BIP0094)
+var TestNet4Params = Params{
+	Name: "testnet4",
+	Genesis: message.BlockHeader{
+		Version:    1,
+		MerkleRoot: mustHash("7aa0a7ae1e223414cb807e40cd57e667b718e42aaf9306db9102fe28912b7b4e"),
+		Timestamp:  1714777860,
+		Bits:       0x1d00ffff,
+		Nonce:      393743547,
+	},
+	PowLimit:             mainPowLimit,
+	TargetTimespan:       14 * 24 * time.Hour,
+	TargetSpacing:        10 * time.Minute,
+	ReduceMinDifficulty:  true,
+	MinDiffReductionTime: 20 * time.Minute,
+	EnforceBIP94:         true,
+}
+
+func mustHash(s string) [32]byte {
+	h, err := typeconv.HashFromString(s)
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
@@ -0,0 +1,101 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package chain
+
+import (
+	"math/big"
+)
+
+var (
+	bigOne = big.NewInt(1)
+
+	// 2^256, work is the number of hashes expected to find a block
+	oneLsh256 = new(big.Int).Lsh(bigOne, 256)
+)
+
+// CompactToBig converts the compact representation of a target
+// used in block headers to a big integer
+func CompactToBig(bits uint32) *big.Int {
+	mantissa := int64(bits & 0x007fffff)
+	exponent := uint(bits >> 24)
+
+	var n *big.Int
+	if exponent <= 3 {
+		n = big.NewInt(mantissa >> (8 * (3 - exponent)))
+	} else {
+		n = big.NewInt(mantissa)
+		n.Lsh(n, 8*(exponent-3))
+	}
+	if bits&0x00800000 != 0 {
+		n.Neg(n)
+	}
+	return n
+}
+
+// BigToCompact converts a target to the compact representation used in block headers
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() == 0 {
+		return 0
+	}
+	abs := new(big.Int).Abs(n)
+	exponent := uint(len(abs.Bytes()))
+	var mantissa uint32
+	if exponent <= 3 {
+		mantissa = uint32(abs.Int64()) << (8 * (3 - exponent))
+	} else {
+		mantissa = uint32(new(big.Int).Rsh(abs, 8*(exponent-3)).Int64())
+	}
+
+	// The sign bit is not part of the mantissa
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+	compact := uint32(exponent<<24) | mantissa
+	if n.Sign() < 0 {
+		compact |= 0x00800000
+	}
+	return compact
+}
+
+// HashToBig converts a block hash in wire byte order to the number
+// compared against the target
+func HashToBig(hash [32]byte) *big.Int {
+	b := make([]byte, len(hash))
+	for i := range hash {
+		b[len(hash)-1-i] = hash[i]
+	}
+	return new(big.Int).SetBytes(b)
+}
+
+// CheckProofOfWork returns ErrBadProofOfWork unless hash meets the target
+// encoded by bits and the target is within the network's proof of work limit
+func (p *Params) CheckProofOfWork(hash [32]byte, bits uint32) error {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 || target.Cmp(p.PowLimit) > 0 || HashToBig(hash).Cmp(target) > 0 {
+		return ErrBadProofOfWork
+	}
+	return nil
+}
+
+// CalcWork returns the work represented by a block with the given target bits
+func CalcWork(bits uint32) *big.Int {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+	return new(big.Int).Div(oneLsh256, target.Add(target, bigOne))
+}
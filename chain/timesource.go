@@ -0,0 +1,94 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package chain
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Most clock samples used, later sources are ignored
+	maxTimeSamples = 200
+
+	// Fewest clock samples before the clock is adjusted
+	minTimeSamples = 5
+
+	// Largest adjustment made to the clock, larger median offsets are ignored
+	maxTimeAdjustment = 70 * time.Minute
+)
+
+// TimeSource provides the current time headers are validated against
+type TimeSource interface {
+	Now() time.Time
+}
+
+// systemTime is the unadjusted system clock
+type systemTime struct{}
+
+func (systemTime) Now() time.Time {
+	return time.Now()
+}
+
+// MedianTime is a TimeSource adjusting the system clock by the median
+// of the clock offsets reported by nodes
+type MedianTime struct {
+	mu      sync.Mutex
+	sources map[string]bool
+	offsets []time.Duration
+	offset  time.Duration
+}
+
+// NewMedianTime returns a MedianTime with no samples, following the system clock
+func NewMedianTime() *MedianTime {
+	return &MedianTime{sources: map[string]bool{}}
+}
+
+// AddSample records the offset of a node's clock from the system clock.
+// Only the first sample from each source, such as a node's IP address, is used
+func (m *MedianTime) AddSample(source string, offset time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sources[source] || len(m.offsets) >= maxTimeSamples {
+		return
+	}
+	m.sources[source] = true
+	m.offsets = append(m.offsets, offset)
+	if len(m.offsets) < minTimeSamples {
+		return
+	}
+
+	sorted := append([]time.Duration{}, m.offsets...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	median := sorted[len(sorted)/2]
+	if median > maxTimeAdjustment || median < -maxTimeAdjustment {
+		median = 0
+	}
+	m.offset = median
+}
+
+// Offset returns the adjustment made to the system clock
+func (m *MedianTime) Offset() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.offset
+}
+
+// Now returns the network adjusted time
+func (m *MedianTime) Now() time.Time {
+	return time.Now().Add(m.Offset())
+}
@@ -16,41 +16,96 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"log"
 	"os"
 	"os/signal"
-	"sync"
+	"path/filepath"
+	"syscall"
 
 	"github.com/sanscentral/sansnetwork"
 	"github.com/sanscentral/sansnetwork/inventory"
+	"github.com/sanscentral/sansnetwork/node"
+	"github.com/sanscentral/sansnetwork/propagation"
+)
+
+const propagationLimit = 100000
+
+var (
+	nodeCount       = flag.Int("nodes", 1, "number of nodes to connect to")
+	isTestnet       = flag.Bool("testnet", false, "connect to testnet instead of mainnet")
+	feeFilter       = flag.Int64("feefilter", 0, "ask nodes not to announce transactions paying less than this many satoshis per kilobyte")
+	propagationFile = flag.String("propagation", "", "record inventory propagation and write it to this file on exit (.csv or .json)")
+	verbose         = flag.Bool("verbose", false, "log connection attempts")
 )
 
 func main() {
+	flag.Parse()
+	if *verbose {
+		node.SetLogger(log.New(os.Stderr, "", log.LstdFlags))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	// Create a new connection to the network
-	isTestnet := false
-	networkconn, err := sansnetwork.NewNetworkConnection(1, isTestnet)
+	networkconn, err := sansnetwork.NewNetworkConnection(ctx, *nodeCount, *isTestnet)
 	if err != nil {
 		panic(err)
 	}
-	defer networkconn.Close()
 
-	// Set callback to handle new inventory entry messages
-	inventory.SetInventoryHandler(invHandler)
+	if *feeFilter > 0 {
+		networkconn.SetFeeFilter(*feeFilter)
+	}
+
+	// Subscribe to new inventory entry messages
+	sub := networkconn.SubscribeInventory(invHandler)
+	defer sub.Unsubscribe()
+
+	var recorder *propagation.Recorder
+	if *propagationFile != "" {
+		recorder = propagation.NewRecorder(propagationLimit)
+		psub := networkconn.RecordPropagation(recorder)
+		defer psub.Unsubscribe()
+	}
 
-	// Leave connection open
+	// Leave connection open until interrupted
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		for range c {
-			fmt.Printf("\nStopping...\n")
-			os.Exit(0)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+	fmt.Printf("\nStopping...\n")
+	if err := networkconn.Close(); err != nil {
+		fmt.Printf("Error closing connection: %s\n", err.Error())
+	}
+
+	if recorder != nil {
+		if err := writePropagation(recorder, *propagationFile); err != nil {
+			fmt.Printf("Error writing propagation: %s\n", err.Error())
+			os.Exit(1)
 		}
-	}()
-	wg.Wait()
+		fmt.Printf("Wrote propagation of %d entries to %s\n", recorder.Len(), *propagationFile)
+	}
+}
+
+func invHandler(peer *node.Connection, i []inventory.Entry) {
+	fmt.Printf("Recieved %d inventory from %s - First is: %s %s \n", len(i), peer.UserAgent(), i[0].Type, i[0].HexString())
 }
 
-func invHandler(i []inventory.Entry) {
-	fmt.Printf("Recieved %d inventory - First is: %s \n", len(i), i[0].HexString())
+// writePropagation exports recorded propagation as JSON or CSV based on the file extension
+func writePropagation(r *propagation.Recorder, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if filepath.Ext(path) == ".json" {
+		err = r.WriteJSON(f)
+	} else {
+		err = r.WriteCSV(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
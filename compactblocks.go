@@ -0,0 +1,470 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sansnetwork
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/inventory"
+	"github.com/sanscentral/sansnetwork/mempool"
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/node"
+)
+
+const (
+	// Most nodes asked to announce new blocks in high bandwidth mode (BIP0152)
+	maxHighBandwidthPeers = 3
+
+	// Time after which an incomplete compact block is abandoned
+	compactBlockTimeoutSec = 60
+
+	// Time for which handled block hashes are remembered
+	blockMemorySec = 3600
+)
+
+// CompactBlockRelay receives new blocks as compact blocks from the pool,
+// reconstructing them from a mempool and publishing each as a node.EventBlock
+type CompactBlockRelay struct {
+	c             *NetworkConnection
+	pool          *mempool.Mempool
+	mu            sync.Mutex
+	highBandwidth []*node.Connection         // Most recent block deliverer first
+	pending       map[[32]byte]*partialBlock // Compact blocks waiting for blocktxn
+	requested     map[[32]byte]time.Time     // Blocks requested in full
+	blocks        map[[32]byte]time.Time     // Blocks seen, by first announcement
+	completed     map[[32]byte]time.Time     // Blocks published
+	subs          []*node.Subscription
+	stop          chan struct{}
+	once          sync.Once
+}
+
+// partialBlock is a requested compact block, tx is nil until it arrives
+type partialBlock struct {
+	peer    *node.Connection
+	header  message.BlockHeader
+	tx      []message.Tx
+	missing []int // Positions of transactions requested with getblocktxn
+	started time.Time
+}
+
+// RelayCompactBlocks negotiates compact block relay with every node in the
+// pool, reconstructing announced blocks from the transactions in m. While
+// relaying, a MempoolMirror no longer fetches full blocks, blocks are removed
+// from m as they are reconstructed. The nodes which most recently delivered
+// a new block first are asked to relay in high bandwidth mode
+func (c *NetworkConnection) RelayCompactBlocks(m *mempool.Mempool) *CompactBlockRelay {
+	r := &CompactBlockRelay{
+		c:         c,
+		pool:      m,
+		pending:   map[[32]byte]*partialBlock{},
+		requested: map[[32]byte]time.Time{},
+		blocks:    map[[32]byte]time.Time{},
+		completed: map[[32]byte]time.Time{},
+		stop:      make(chan struct{}),
+	}
+	c.mu.Lock()
+	c.compactBlocks = true
+	c.mu.Unlock()
+
+	r.subs = []*node.Subscription{
+		c.Subscribe(node.ByType(node.EventPeerConnected), func(e node.Event) {
+			e.Peer.SendCmpct(false)
+		}),
+		c.Subscribe(node.ByType(node.EventPeerDisconnected), func(e node.Event) {
+			r.removePeer(e.Peer)
+		}),
+		c.Subscribe(node.ByType(node.EventNewBlock), r.handleNewBlock),
+		c.Subscribe(node.ByCommand(message.CommandCmpctBlock), r.handleCmpctBlock),
+		c.Subscribe(node.ByCommand(message.CommandBlockTxn), r.handleBlockTxn),
+		c.Subscribe(node.ByCommand(message.CommandBlock), r.handleBlock),
+	}
+	for _, n := range c.Nodes() {
+		n.SendCmpct(false)
+	}
+
+	c.wg.Add(1)
+	go r.expire()
+	return r
+}
+
+// compactBlocksEnabled reports whether a CompactBlockRelay is fetching blocks
+func (c *NetworkConnection) compactBlocksEnabled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.compactBlocks
+}
+
+// Stop stops relaying compact blocks and returns high bandwidth nodes to low bandwidth mode
+func (r *CompactBlockRelay) Stop() {
+	r.once.Do(func() {
+		for _, s := range r.subs {
+			s.Unsubscribe()
+		}
+		close(r.stop)
+		r.c.mu.Lock()
+		r.c.compactBlocks = false
+		r.c.mu.Unlock()
+
+		r.mu.Lock()
+		peers := r.highBandwidth
+		r.highBandwidth = nil
+		r.mu.Unlock()
+		for _, n := range peers {
+			n.SendCmpct(false)
+		}
+	})
+}
+
+// HighBandwidthPeers returns the nodes currently relaying in high bandwidth mode
+func (r *CompactBlockRelay) HighBandwidthPeers() []*node.Connection {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*node.Connection{}, r.highBandwidth...)
+}
+
+// firstSeen records hash as seen, returning false if it already was.
+// The caller must hold r.mu
+func (r *CompactBlockRelay) firstSeen(hash [32]byte) bool {
+	if _, ok := r.blocks[hash]; ok {
+		return false
+	}
+	r.blocks[hash] = time.Now()
+	return true
+}
+
+// promote moves n to the front of the high bandwidth nodes as it was first
+// to deliver a new block, demoting the least recent node when over the limit
+func (r *CompactBlockRelay) promote(n *node.Connection) {
+	if n.CompactBlockVersion() < message.CompactBlockWitnessVersion {
+		return
+	}
+	r.mu.Lock()
+	for i, hb := range r.highBandwidth {
+		if hb == n {
+			copy(r.highBandwidth[1:i+1], r.highBandwidth[:i])
+			r.highBandwidth[0] = n
+			r.mu.Unlock()
+			return
+		}
+	}
+	r.highBandwidth = append([]*node.Connection{n}, r.highBandwidth...)
+	var demoted *node.Connection
+	if len(r.highBandwidth) > maxHighBandwidthPeers {
+		demoted = r.highBandwidth[maxHighBandwidthPeers]
+		r.highBandwidth = r.highBandwidth[:maxHighBandwidthPeers]
+	}
+	r.mu.Unlock()
+
+	n.SendCmpct(true)
+	if demoted != nil {
+		demoted.SendCmpct(false)
+	}
+}
+
+// removePeer forgets a disconnected node and the blocks it was completing
+func (r *CompactBlockRelay) removePeer(n *node.Connection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, hb := range r.highBandwidth {
+		if hb == n {
+			r.highBandwidth = append(r.highBandwidth[:i], r.highBandwidth[i+1:]...)
+			break
+		}
+	}
+	for h, p := range r.pending {
+		if p.peer == n {
+			delete(r.pending, h)
+			delete(r.blocks, h)
+		}
+	}
+}
+
+// handleNewBlock requests blocks announced with inv or headers, blocks
+// announced as compact blocks are reconstructed by handleCmpctBlock
+func (r *CompactBlockRelay) handleNewBlock(e node.Event) {
+	if e.Command == message.CommandCmpctBlock {
+		return
+	}
+	if header, ok := e.Message.(message.BlockHeader); ok {
+		r.requestNewBlocks(e.Peer, []inventory.Entry{{Type: inventory.TypeBlock, Hash: header.BlockHash()}})
+	}
+}
+
+// requestNewBlocks requests new blocks as compact blocks, or in full from
+// nodes without witness compact block support
+func (r *CompactBlockRelay) requestNewBlocks(peer *node.Connection, entries []inventory.Entry) {
+	compact := peer.CompactBlockVersion() >= message.CompactBlockWitnessVersion
+	want := []inventory.Entry{}
+	now := time.Now()
+	r.mu.Lock()
+	for _, e := range entries {
+		if !r.firstSeen(e.Hash) {
+			continue
+		}
+		if compact {
+			e.Type = inventory.TypeCmpctBlock
+			r.pending[e.Hash] = &partialBlock{peer: peer, started: now}
+		} else {
+			e.Type = inventory.TypeWitnessBlock
+			r.requested[e.Hash] = now
+		}
+		want = append(want, e)
+	}
+	r.mu.Unlock()
+
+	if len(want) == 0 {
+		return
+	}
+	r.promote(peer)
+	if err := peer.QueueMessage(message.NewGetDataMessage(want, r.c.testnet), nil); err != nil {
+		r.forget(want)
+	}
+}
+
+// forget drops the bookkeeping of blocks which could not be requested
+// so the next announcement of them is followed up
+func (r *CompactBlockRelay) forget(entries []inventory.Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range entries {
+		delete(r.pending, e.Hash)
+		delete(r.requested, e.Hash)
+		delete(r.blocks, e.Hash)
+	}
+}
+
+// handleCmpctBlock reconstructs a requested or high bandwidth compact block
+// from the mempool, requesting any missing transactions with getblocktxn
+func (r *CompactBlockRelay) handleCmpctBlock(e node.Event) {
+	cb, ok := e.Message.(message.CmpctBlock)
+	if !ok || e.Peer.CompactBlockVersion() < message.CompactBlockWitnessVersion {
+		return
+	}
+	hash := cb.Header.BlockHash()
+	if r.c.params.CheckProofOfWork(hash, cb.Header.Bits) != nil {
+		return
+	}
+
+	r.mu.Lock()
+	_, completed := r.completed[hash]
+	_, requested := r.requested[hash]
+	p, pending := r.pending[hash]
+	if completed || requested || (pending && p.tx != nil) {
+		r.mu.Unlock()
+		return
+	}
+	first := r.firstSeen(hash)
+	p = &partialBlock{peer: e.Peer, header: cb.Header, started: time.Now()}
+	if !r.fill(p, &cb) {
+		delete(r.pending, hash)
+		r.mu.Unlock()
+		r.requestBlock(e.Peer, hash)
+		return
+	}
+	r.pending[hash] = p
+	r.mu.Unlock()
+
+	if first {
+		r.promote(e.Peer)
+	}
+	if len(p.missing) == 0 {
+		r.complete(hash)
+		return
+	}
+	if err := e.Peer.QueueMessage(message.NewGetBlockTxnMessage(hash, p.missing, r.c.testnet), nil); err != nil {
+		r.forget([]inventory.Entry{{Hash: hash}})
+	}
+}
+
+// fill places the prefilled transactions of cb and the mempool transactions
+// matching its short ids into p, recording the positions still missing. It
+// returns false if the short ids are ambiguous and the block must be fetched in full
+func (r *CompactBlockRelay) fill(p *partialBlock, cb *message.CmpctBlock) bool {
+	p.tx = make([]message.Tx, cb.TxCount())
+	have := make([]bool, len(p.tx))
+	for _, pt := range cb.PrefilledTxs {
+		if have[pt.Index] {
+			return false
+		}
+		p.tx[pt.Index] = pt.Tx
+		have[pt.Index] = true
+	}
+
+	// Short ids fill the positions not prefilled in order
+	positions := make(map[uint64]int, len(cb.ShortIDs))
+	pos := 0
+	for _, id := range cb.ShortIDs {
+		for have[pos] {
+			pos++
+		}
+		if _, dup := positions[id]; dup {
+			return false
+		}
+		positions[id] = pos
+		pos++
+	}
+
+	k0, k1 := cb.ShortIDKey()
+	matches := make([]int, len(p.tx))
+	r.pool.MatchShortIDs(k0, k1, positions, func(pos int, tx message.Tx) {
+		matches[pos]++
+		p.tx[pos] = tx
+	})
+
+	for pos := range p.tx {
+		// Positions matching several mempool transactions are requested too
+		if !have[pos] && matches[pos] != 1 {
+			p.missing = append(p.missing, pos)
+		}
+	}
+	return true
+}
+
+// handleBlockTxn completes a compact block with the transactions it was missing
+func (r *CompactBlockRelay) handleBlockTxn(e node.Event) {
+	bt, ok := e.Message.(message.BlockTxn)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	p, ok := r.pending[bt.BlockHash]
+	if !ok || p.peer != e.Peer || p.tx == nil {
+		r.mu.Unlock()
+		return
+	}
+	if len(bt.Tx) != len(p.missing) {
+		delete(r.pending, bt.BlockHash)
+		r.mu.Unlock()
+		e.Peer.ReportMisbehaviour(errors.New("blocktxn does not match getblocktxn"))
+		r.requestBlock(e.Peer, bt.BlockHash)
+		return
+	}
+	for i, pos := range p.missing {
+		p.tx[pos] = bt.Tx[i]
+	}
+	p.missing = nil
+	r.mu.Unlock()
+	r.complete(bt.BlockHash)
+}
+
+// complete checks a fully populated compact block against its merkle root
+// and witness commitment and publishes it, falling back to fetching the
+// full block on mismatch
+func (r *CompactBlockRelay) complete(hash [32]byte) {
+	r.mu.Lock()
+	p, ok := r.pending[hash]
+	if !ok {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.pending, hash)
+	r.mu.Unlock()
+
+	blk := message.Block{Header: p.header, Tx: p.tx}
+	if checkBlock(&blk) != nil {
+		// Short id collisions can reconstruct the wrong transactions
+		r.requestBlock(p.peer, hash)
+		return
+	}
+	r.publish(p.peer, hash, blk)
+}
+
+// requestBlock fetches the block with hash in full from n
+func (r *CompactBlockRelay) requestBlock(n *node.Connection, hash [32]byte) {
+	r.mu.Lock()
+	r.requested[hash] = time.Now()
+	r.mu.Unlock()
+	inv := []inventory.Entry{{Type: inventory.TypeWitnessBlock, Hash: hash}}
+	if err := n.QueueMessage(message.NewGetDataMessage(inv, r.c.testnet), nil); err != nil {
+		r.forget(inv)
+	}
+}
+
+// handleBlock publishes blocks which were requested in full
+func (r *CompactBlockRelay) handleBlock(e node.Event) {
+	blk, err := message.ParseBlockPayload(e.Payload)
+	if err != nil {
+		return
+	}
+	hash := blk.Header.BlockHash()
+	r.mu.Lock()
+	_, ok := r.requested[hash]
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+	if err := checkBlock(&blk); err != nil {
+		e.Peer.ReportMisbehaviour(err)
+		return
+	}
+	r.publish(e.Peer, hash, blk)
+}
+
+// publish removes a completed block's transactions from the mempool and
+// publishes it to the pool's subscribers
+func (r *CompactBlockRelay) publish(peer *node.Connection, hash [32]byte, blk message.Block) {
+	r.mu.Lock()
+	delete(r.requested, hash)
+	r.completed[hash] = time.Now()
+	r.mu.Unlock()
+
+	r.pool.RemoveBlock(blk)
+	r.c.events.Publish(node.Event{Type: node.EventBlock, Peer: peer, Message: blk})
+}
+
+// expire abandons stalled blocks so they can be fetched again when next
+// announced, and forgets old block hashes
+func (r *CompactBlockRelay) expire() {
+	defer r.c.wg.Done()
+	ticker := time.NewTicker(compactBlockTimeoutSec * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.c.ctx.Done():
+			return
+		case <-r.stop:
+			return
+		case now := <-ticker.C:
+			r.mu.Lock()
+			for h, p := range r.pending {
+				if now.Sub(p.started) >= compactBlockTimeoutSec*time.Second {
+					delete(r.pending, h)
+					delete(r.blocks, h)
+				}
+			}
+			for h, t := range r.requested {
+				if now.Sub(t) >= compactBlockTimeoutSec*time.Second {
+					delete(r.requested, h)
+					delete(r.blocks, h)
+				}
+			}
+			for h, t := range r.blocks {
+				if now.Sub(t) >= blockMemorySec*time.Second {
+					delete(r.blocks, h)
+				}
+			}
+			for h, t := range r.completed {
+				if now.Sub(t) >= blockMemorySec*time.Second {
+					delete(r.completed, h)
+				}
+			}
+			r.mu.Unlock()
+		}
+	}
+}
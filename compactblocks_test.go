@@ -0,0 +1,96 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sansnetwork
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/mempool"
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/node"
+	"github.com/sanscentral/sansnetwork/typeconv"
+)
+
+// cmpctBlockMessage returns a compact block with every transaction of blk prefilled
+func cmpctBlockMessage(blk message.Block) []byte {
+	p := blk.Header.Serialize()
+	p = append(p, make([]byte, 8)...)
+	p = append(p, typeconv.BytesFromVarInt(0)...)
+	p = append(p, typeconv.BytesFromVarInt(uint64(len(blk.Tx)))...)
+	for i := range blk.Tx {
+		// Indexes are encoded as the difference from the previous one
+		p = append(p, typeconv.BytesFromVarInt(0)...)
+		p = append(p, blk.Tx[i].Serialize(true)...)
+	}
+	return message.NewMessage(message.CommandCmpctBlock, p, false)
+}
+
+func TestCompactBlockForgedWitness(t *testing.T) {
+	c, err := NewNetworkConnection(context.Background(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.params = &testParams
+	n, peer := pipeNode(t, c)
+	defer peer.Close()
+	r := c.RelayCompactBlocks(mempool.New(0, 0))
+	defer r.Stop()
+
+	blocks := make(chan message.Block, 2)
+	c.Subscribe(node.ByType(node.EventBlock), func(e node.Event) {
+		blocks <- e.Message.(message.Block)
+	})
+
+	blk := segwitBlock([32]byte{1}, 1)
+	mine(&blk.Header)
+	forged := segwitBlock([32]byte{1}, 1)
+	forged.Header = blk.Header
+	forged.Tx[1].TxIn[0].Witness = [][]byte{{9}}
+	requested := make(chan struct{}, 1)
+	peer.Subscribe(node.ByCommand(message.CommandGetData), func(e node.Event) {
+		requested <- struct{}{}
+		peer.QueueMessage(blockMessage(blk), nil)
+	})
+
+	peer.QueueMessage(message.NewSendCmpctMessage(true, message.CompactBlockWitnessVersion, false), nil)
+	for deadline := time.Now().Add(5 * time.Second); n.CompactBlockVersion() != message.CompactBlockWitnessVersion; {
+		if time.Now().After(deadline) {
+			t.Fatal("sendcmpct not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	peer.QueueMessage(cmpctBlockMessage(forged), nil)
+
+	select {
+	case <-requested:
+	case <-blocks:
+		t.Fatal("compact block with forged witness data published")
+	case <-time.After(5 * time.Second):
+		t.Fatal("full block not requested")
+	}
+	select {
+	case got := <-blocks:
+		if !bytes.Equal(got.Tx[1].TxIn[0].Witness[0], blk.Tx[1].TxIn[0].Witness[0]) {
+			t.Fatal("published block has forged witness data")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("full block not published")
+	}
+}
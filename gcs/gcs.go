@@ -0,0 +1,238 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gcs
+
+import (
+	"errors"
+	"math/bits"
+	"sort"
+
+	"github.com/sanscentral/sansnetwork/siphash"
+	"github.com/sanscentral/sansnetwork/typeconv"
+)
+
+const (
+	// BasicP is the Golomb-Rice coding parameter of basic filters (BIP0158)
+	BasicP = 19
+
+	// BasicM is the inverse false positive rate of basic filters (BIP0158)
+	BasicM = 784931
+
+	// KeySize is the length of the SipHash key taken from the block hash
+	KeySize = 16
+)
+
+// ErrInvalidFilter is returned when a filter cannot be decoded
+var ErrInvalidFilter = errors.New("invalid golomb coded set")
+
+// Filter is a Golomb-coded set of items
+type Filter struct {
+	n      uint32
+	p      uint8
+	m      uint64
+	k0, k1 uint64
+	data   []byte // Serialised filter including the element count
+	bits   []byte // Golomb-Rice coded deltas
+}
+
+// BasicKey returns the SipHash key of a block's basic filter
+func BasicKey(blockHash [32]byte) [KeySize]byte {
+	k := [KeySize]byte{}
+	copy(k[:], blockHash[:KeySize])
+	return k
+}
+
+// FromBytes decodes a serialised filter with parameters p and m
+func FromBytes(data []byte, p uint8, m uint64, key [KeySize]byte) (*Filter, error) {
+	n, l, err := typeconv.VarIntFromBytes(data)
+	if err != nil || n > 1<<32-1 {
+		return nil, ErrInvalidFilter
+	}
+	f := &Filter{n: uint32(n), p: p, m: m, data: data, bits: data[l:]}
+	f.k0, f.k1 = siphash.KeyFromBytes(key[:])
+	return f, nil
+}
+
+// Build creates a filter holding items with parameters p and m
+func Build(items [][]byte, p uint8, m uint64, key [KeySize]byte) *Filter {
+	f := &Filter{p: p, m: m}
+	f.k0, f.k1 = siphash.KeyFromBytes(key[:])
+
+	// Duplicate items are only encoded once
+	unique := map[string]bool{}
+	for _, item := range items {
+		unique[string(item)] = true
+	}
+	f.n = uint32(len(unique))
+
+	values := make([]uint64, 0, len(unique))
+	for item := range unique {
+		values = append(values, f.hashToRange([]byte(item)))
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	w := &bitWriter{}
+	last := uint64(0)
+	for _, v := range values {
+		delta := v - last
+		last = v
+		for q := delta >> p; q > 0; q-- {
+			w.writeBit(true)
+		}
+		w.writeBit(false)
+		w.writeBits(delta, uint(p))
+	}
+	f.bits = w.bytes
+	f.data = append(typeconv.BytesFromVarInt(uint64(f.n)), f.bits...)
+	return f
+}
+
+// BuildBasic creates a basic filter for a block from its output scripts and
+// the scripts of the outputs its inputs spend. Empty and OP_RETURN scripts are excluded
+func BuildBasic(blockHash [32]byte, scripts [][]byte) *Filter {
+	items := [][]byte{}
+	for _, s := range scripts {
+		if len(s) == 0 || s[0] == opReturn {
+			continue
+		}
+		items = append(items, s)
+	}
+	return Build(items, BasicP, BasicM, BasicKey(blockHash))
+}
+
+const opReturn = 0x6a
+
+// N returns the number of items in the filter
+func (f *Filter) N() uint32 {
+	return f.n
+}
+
+// Bytes returns the serialised filter
+func (f *Filter) Bytes() []byte {
+	return f.data
+}
+
+// Hash returns the filter hash used in filter headers
+func (f *Filter) Hash() [32]byte {
+	return typeconv.DoubleHashFromBytes(f.data)
+}
+
+// hashToRange maps item uniformly onto [0, N*M)
+func (f *Filter) hashToRange(item []byte) uint64 {
+	h := siphash.Hash(f.k0, f.k1, item)
+	hi, _ := bits.Mul64(h, uint64(f.n)*f.m)
+	return hi
+}
+
+// Match returns true if item may be in the filter
+func (f *Filter) Match(item []byte) bool {
+	return f.MatchAny([][]byte{item})
+}
+
+// MatchAny returns true if any of items may be in the filter
+func (f *Filter) MatchAny(items [][]byte) bool {
+	if f.n == 0 || len(items) == 0 {
+		return false
+	}
+	targets := make([]uint64, 0, len(items))
+	for _, item := range items {
+		targets = append(targets, f.hashToRange(item))
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i] < targets[j] })
+
+	r := &bitReader{b: f.bits}
+	value := uint64(0)
+	t := 0
+	for i := uint32(0); i < f.n; i++ {
+		delta, ok := r.readGolombRice(f.p)
+		if !ok {
+			return false
+		}
+		value += delta
+		for t < len(targets) && targets[t] < value {
+			t++
+		}
+		if t == len(targets) {
+			return false
+		}
+		if targets[t] == value {
+			return true
+		}
+	}
+	return false
+}
+
+// bitWriter writes bits most significant first
+type bitWriter struct {
+	bytes []byte
+	n     uint
+}
+
+func (w *bitWriter) writeBit(b bool) {
+	if w.n%8 == 0 {
+		w.bytes = append(w.bytes, 0)
+	}
+	if b {
+		w.bytes[len(w.bytes)-1] |= 1 << (7 - w.n%8)
+	}
+	w.n++
+}
+
+func (w *bitWriter) writeBits(v uint64, count uint) {
+	for i := count; i > 0; i-- {
+		w.writeBit(v&(1<<(i-1)) != 0)
+	}
+}
+
+// bitReader reads bits most significant first
+type bitReader struct {
+	b []byte
+	n uint
+}
+
+func (r *bitReader) readBit() (bool, bool) {
+	if r.n/8 >= uint(len(r.b)) {
+		return false, false
+	}
+	bit := r.b[r.n/8]&(1<<(7-r.n%8)) != 0
+	r.n++
+	return bit, true
+}
+
+func (r *bitReader) readGolombRice(p uint8) (uint64, bool) {
+	q := uint64(0)
+	for {
+		bit, ok := r.readBit()
+		if !ok {
+			return 0, false
+		}
+		if !bit {
+			break
+		}
+		q++
+	}
+	v := q << p
+	for i := uint(p); i > 0; i-- {
+		bit, ok := r.readBit()
+		if !ok {
+			return 0, false
+		}
+		if bit {
+			v |= 1 << (i - 1)
+		}
+	}
+	return v, true
+}
@@ -0,0 +1,168 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package gcs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/typeconv"
+)
+
+// hash decodes a hash in its displayed byte order
+func hash(t *testing.T, s string) [32]byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 32 {
+		t.Fatalf("bad hash %q", s)
+	}
+	var h [32]byte
+	copy(h[:], b)
+	return typeconv.ReverseHash(h)
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// BIP0158 test vectors for testnet blocks. Output scripts are only listed
+// for the genesis block, whose filter is rebuilt from them
+func TestBasicFilterVectors(t *testing.T) {
+	tests := []struct {
+		height     int
+		blockHash  string
+		scripts    []string
+		filter     string
+		prevHeader string
+		header     string
+	}{
+		{
+			0, "000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943",
+			[]string{"4104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac"},
+			"019dfca8",
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"21584579b7eb08997773e5aeff3a7f932700042d0ed2a6129012b7d7ae81b750",
+		},
+		{
+			2, "", nil,
+			"0174a170",
+			"d7bdac13a59d745b1add0d2ce852f1a0442e8945fc1bf3848d3cbffd88c24fe1",
+			"186afd11ef2b5e7e3504f2e8cbf8df28a1fd251fe53d60dff8b1467d1b386cf0",
+		},
+		{
+			3, "", nil,
+			"016cf7a0",
+			"186afd11ef2b5e7e3504f2e8cbf8df28a1fd251fe53d60dff8b1467d1b386cf0",
+			"8d63aadf5ab7257cb6d2316a57b16f517bff1c6388f124ec4c04af1212729d2a",
+		},
+		{
+			926485, "", nil,
+			"09027acea61b6cc3fb33f5d52f7d088a6b2f75d234e89ca800",
+			"8f13b9a9c85611635b47906c3053ac53cfcec7211455d4cb0d63dc9acc13d472",
+			"546c574a0472144bcaf9b6aeabf26372ad87c7af7d1ee0dbfae5e099abeae49c",
+		},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.height), func(t *testing.T) {
+			data := mustHex(t, test.filter)
+			header := message.FilterHeader(typeconv.DoubleHashFromBytes(data), hash(t, test.prevHeader))
+			if header != hash(t, test.header) {
+				t.Fatalf("filter header %x", typeconv.ReverseHash(header))
+			}
+			f, err := FromBytes(data, BasicP, BasicM, [KeySize]byte{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.N() != uint32(data[0]) {
+				t.Fatalf("N = %d, want %d", f.N(), data[0])
+			}
+			if test.scripts == nil {
+				return
+			}
+
+			scripts := [][]byte{}
+			for _, s := range test.scripts {
+				scripts = append(scripts, mustHex(t, s))
+			}
+			built := BuildBasic(hash(t, test.blockHash), scripts)
+			if !bytes.Equal(built.Bytes(), data) {
+				t.Fatalf("built filter %x, want %s", built.Bytes(), test.filter)
+			}
+			for _, s := range scripts {
+				if !built.Match(s) {
+					t.Fatalf("script %x not matched", s)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildMatch(t *testing.T) {
+	key := [KeySize]byte{1, 2, 3}
+	items := [][]byte{}
+	for i := 0; i < 100; i++ {
+		items = append(items, []byte(fmt.Sprintf("item %d", i)))
+	}
+	f := Build(append(items, items[0]), BasicP, BasicM, key)
+	if f.N() != 100 {
+		t.Fatalf("N = %d, want duplicates encoded once", f.N())
+	}
+
+	decoded, err := FromBytes(f.Bytes(), BasicP, BasicM, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range items {
+		if !f.Match(item) || !decoded.Match(item) {
+			t.Fatalf("%s not matched", item)
+		}
+	}
+
+	// The false positive rate is 1/M
+	positives := 0
+	for i := 0; i < 10000; i++ {
+		if decoded.Match([]byte(fmt.Sprintf("other %d", i))) {
+			positives++
+		}
+	}
+	if positives > 5 {
+		t.Fatalf("%d false positives in 10000", positives)
+	}
+	if decoded.MatchAny([][]byte{[]byte("other"), []byte("other 2")}) || !decoded.MatchAny([][]byte{[]byte("other"), items[50]}) {
+		t.Fatal("MatchAny does not match exactly the filter's items")
+	}
+}
+
+func TestBuildBasicExcludedScripts(t *testing.T) {
+	f := BuildBasic([32]byte{}, [][]byte{{}, {opReturn, 1, 2}})
+	if f.N() != 0 || !bytes.Equal(f.Bytes(), []byte{0}) {
+		t.Fatalf("filter %x, want empty", f.Bytes())
+	}
+	if f.Match([]byte{}) || f.Match([]byte{opReturn, 1, 2}) {
+		t.Fatal("empty filter matches")
+	}
+	if _, err := FromBytes(nil, BasicP, BasicM, [KeySize]byte{}); err != ErrInvalidFilter {
+		t.Fatalf("no element count: got %v, want ErrInvalidFilter", err)
+	}
+}
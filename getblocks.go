@@ -0,0 +1,161 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sansnetwork
+
+import (
+	"context"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/inventory"
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/node"
+)
+
+// Time to wait for the inv answering a getblocks. Nodes with no blocks
+// to announce do not reply at all, so this also ends an iteration
+const getBlocksTimeoutSec = 30
+
+// BlockHashIterator iterates over the block hashes a node announces in
+// reply to getblocks, requesting further batches as each is used up
+type BlockHashIterator struct {
+	ctx     context.Context
+	c       *NetworkConnection
+	n       *node.Connection
+	stop    [32]byte
+	next    [][32]byte // Locator for the next batch
+	batch   [][32]byte
+	hash    [32]byte
+	timeout time.Duration
+	done    bool
+	err     error
+}
+
+// GetBlocks returns an iterator over the hashes of the blocks following the
+// first locator hash known to a full block node from the pool, up to but
+// excluding stopHash, or up to the node's tip if stopHash is zero. A block
+// locator for known blocks can be built with chain.Locator
+func (c *NetworkConnection) GetBlocks(ctx context.Context, locator [][32]byte, stopHash [32]byte) *BlockHashIterator {
+	it := &BlockHashIterator{ctx: ctx, c: c, stop: stopHash, next: locator, timeout: getBlocksTimeoutSec * time.Second}
+	nodes := c.FullBlockNodes()
+	if len(nodes) == 0 {
+		it.err = ErrNoPeers
+	} else {
+		it.n = nodes[0]
+	}
+	return it
+}
+
+// Next advances to the next block hash, returning false at the end of
+// the iteration or on error
+func (it *BlockHashIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	for len(it.batch) == 0 {
+		if it.done {
+			return false
+		}
+		if err := it.fetch(); err != nil {
+			it.err = err
+			return false
+		}
+	}
+	it.hash = it.batch[0]
+	it.batch = it.batch[1:]
+	return true
+}
+
+// Hash returns the current block hash
+func (it *BlockHashIterator) Hash() [32]byte {
+	return it.hash
+}
+
+// Err returns the error which ended the iteration, if any
+func (it *BlockHashIterator) Err() error {
+	return it.err
+}
+
+// fetch requests the next batch of block hashes. Announcements of new blocks
+// by inv can be mistaken for replies, though nodes announce new blocks with
+// headers to the pool instead where they support it
+func (it *BlockHashIterator) fetch() error {
+	ctx, cancel := context.WithTimeout(it.ctx, it.timeout)
+	defer cancel()
+
+	it.c.expectBlockReply(it.n)
+	var replied [][32]byte
+	defer func() { it.c.blockReplyReceived(it.n, replied) }()
+
+	msg := message.NewGetBlocksMessage(it.next, it.stop, it.c.testnet)
+	var hashes [][32]byte
+	err := exchange(ctx, it.n, msg, node.ByCommand(message.CommandInventory), func(e node.Event) bool {
+		inv, ok := e.Message.(inventory.Item)
+		if !ok {
+			return false
+		}
+		for _, entry := range inventory.FilterEntries(inv.Entry, inventory.TypeBlock) {
+			hashes = append(hashes, entry.Hash)
+		}
+		return len(hashes) > 0
+	})
+	if err == context.DeadlineExceeded && it.ctx.Err() == nil {
+		// Nothing more to announce
+		it.done = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	replied = hashes
+
+	for i, h := range hashes {
+		if h == it.stop {
+			hashes = hashes[:i]
+			it.done = true
+			break
+		}
+	}
+	if len(hashes) < message.MaxBlocksResults {
+		it.done = true
+	}
+	if len(hashes) > 0 {
+		it.next = [][32]byte{hashes[len(hashes)-1]}
+	}
+	it.batch = hashes
+	return nil
+}
+
+// expectBlockReply marks a getblocks as outstanding to n, so that the
+// block inventory n sends is not taken for new block announcements
+func (c *NetworkConnection) expectBlockReply(n *node.Connection) {
+	c.mu.Lock()
+	c.blockRequests[n]++
+	c.mu.Unlock()
+}
+
+// blockReplyReceived ends a getblocks to n, recording the hashes of its
+// reply in case their inventory is handled after the request ends
+func (c *NetworkConnection) blockReplyReceived(n *node.Connection, hashes [][32]byte) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, h := range hashes {
+		c.blockReplies[h] = now
+	}
+	if c.blockRequests[n]--; c.blockRequests[n] <= 0 {
+		delete(c.blockRequests, n)
+	}
+}
@@ -0,0 +1,204 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sansnetwork
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/inventory"
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/node"
+)
+
+// invServer handshakes as a full witness node over c, answering each
+// getblocks with the next of batches and nothing once they run out. The
+// first locator hash of every getblocks is sent to locators if it is not
+// nil, and the stop hash of every getheaders to getheaders
+func invServer(c net.Conn, batches [][][32]byte, locators, getheaders chan<- [32]byte) {
+	if serverHandshake(c, node.ServiceFullNode|node.ServiceWitness) != nil {
+		return
+	}
+	for {
+		cmd, p, err := readMessage(c)
+		if err != nil {
+			return
+		}
+		switch {
+		case cmd == message.CommandGetBlocks:
+			var locator [32]byte
+			if len(p) >= 37 && p[4] > 0 {
+				copy(locator[:], p[5:37])
+			}
+			if locators != nil {
+				locators <- locator
+			}
+			if len(batches) > 0 {
+				c.Write(blockInventory(batches[0]))
+				batches = batches[1:]
+			}
+		case cmd == message.CommandGetHeaders && len(p) >= 32:
+			var stop [32]byte
+			copy(stop[:], p[len(p)-32:])
+			getheaders <- stop
+		}
+	}
+}
+
+func blockInventory(hashes [][32]byte) []byte {
+	entries := make([]inventory.Entry, len(hashes))
+	for i, h := range hashes {
+		entries[i] = inventory.Entry{Type: inventory.TypeBlock, Hash: h}
+	}
+	return message.NewInventoryMessage(entries, false)
+}
+
+// getBlocksPool returns a connection to an invServer and the server end of the pipe
+func getBlocksPool(t *testing.T, batches [][][32]byte, locators, getheaders chan<- [32]byte) (*NetworkConnection, net.Conn) {
+	c, err := NewNetworkConnection(context.Background(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, s := net.Pipe()
+	go invServer(s, batches, locators, getheaders)
+	n, err := node.NewConnectionFromConn(context.Background(), a, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.addNode(c.ctx, n)
+	return c, s
+}
+
+// blockHashes returns n distinct block hashes starting from first
+func blockHashes(first, n int) [][32]byte {
+	hashes := make([][32]byte, n)
+	for i := range hashes {
+		hashes[i] = [32]byte{byte(first + i), byte((first + i) >> 8), 0xbb}
+	}
+	return hashes
+}
+
+// collect runs it to completion, returning the hashes it yields
+func collect(it *BlockHashIterator) [][32]byte {
+	hashes := [][32]byte{}
+	for it.Next() {
+		hashes = append(hashes, it.Hash())
+	}
+	return hashes
+}
+
+func TestGetBlocksBatches(t *testing.T) {
+	first := blockHashes(0, message.MaxBlocksResults)
+	second := blockHashes(message.MaxBlocksResults, 3)
+	locators := make(chan [32]byte, 4)
+	c, _ := getBlocksPool(t, [][][32]byte{first, second}, locators, nil)
+	defer c.Close()
+
+	start := [32]byte{0xaa}
+	it := c.GetBlocks(context.Background(), [][32]byte{start}, [32]byte{})
+	hashes := collect(it)
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+	want := append(append([][32]byte{}, first...), second...)
+	if len(hashes) != len(want) {
+		t.Fatalf("%d hashes, want %d", len(hashes), len(want))
+	}
+	for i := range want {
+		if hashes[i] != want[i] {
+			t.Fatalf("hash %d is %x, want %x", i, hashes[i], want[i])
+		}
+	}
+
+	// The second batch follows on from the last hash of the first, a
+	// batch shorter than the maximum ends the iteration
+	if l := <-locators; l != start {
+		t.Fatalf("first locator %x, want %x", l, start)
+	}
+	if l := <-locators; l != first[len(first)-1] {
+		t.Fatalf("second locator %x, want the last hash of the first batch", l)
+	}
+	if len(locators) != 0 {
+		t.Fatal("getblocks sent after a short batch")
+	}
+}
+
+func TestGetBlocksStopHash(t *testing.T) {
+	batch := blockHashes(0, message.MaxBlocksResults)
+	c, _ := getBlocksPool(t, [][][32]byte{batch}, nil, nil)
+	defer c.Close()
+
+	it := c.GetBlocks(context.Background(), nil, batch[10])
+	if hashes := collect(it); it.Err() != nil || len(hashes) != 10 {
+		t.Fatalf("%d hashes up to the stop hash, error %v", len(hashes), it.Err())
+	}
+}
+
+func TestGetBlocksTimeout(t *testing.T) {
+	batch := blockHashes(0, message.MaxBlocksResults)
+	locators := make(chan [32]byte, 4)
+	c, _ := getBlocksPool(t, [][][32]byte{batch}, locators, nil)
+	defer c.Close()
+
+	// A full batch is followed by a request the node does not answer,
+	// having nothing more to announce
+	it := c.GetBlocks(context.Background(), nil, [32]byte{})
+	it.timeout = 200 * time.Millisecond
+	if hashes := collect(it); it.Err() != nil || len(hashes) != len(batch) {
+		t.Fatalf("%d hashes, error %v", len(hashes), it.Err())
+	}
+	if len(locators) != 2 {
+		t.Fatalf("%d getblocks sent, want 2", len(locators))
+	}
+
+	// Cancelling the caller's context is an error
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	it = c.GetBlocks(ctx, nil, [32]byte{})
+	if collect(it); it.Err() != context.DeadlineExceeded {
+		t.Fatalf("got %v, want context.DeadlineExceeded", it.Err())
+	}
+}
+
+func TestGetBlocksReplyNotAnnounced(t *testing.T) {
+	reply := [][32]byte{{1}, {2}, {3}}
+	getheaders := make(chan [32]byte, 8)
+	c, s := getBlocksPool(t, [][][32]byte{reply}, nil, getheaders)
+	defer c.Close()
+
+	it := c.GetBlocks(context.Background(), nil, [32]byte{})
+	count := 0
+	for it.Next() {
+		count++
+	}
+	if it.Err() != nil || count != len(reply) {
+		t.Fatalf("%d hashes, error %v", count, it.Err())
+	}
+
+	// Repeated inventory of the reply is not announced either, a new block is
+	s.Write(blockInventory(reply))
+	s.Write(blockInventory([][32]byte{{4}}))
+	select {
+	case stop := <-getheaders:
+		if stop != [32]byte{4} {
+			t.Fatalf("getheaders sent for getblocks reply %x", stop)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("getheaders not sent for a new block")
+	}
+}
@@ -1,3 +1,5 @@
 module github.com/sanscentral/sansnetwork
 
+go 1.12
+
 // go: no requirements found in Gopkg.lock
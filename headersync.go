@@ -0,0 +1,163 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sansnetwork
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/chain"
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/node"
+)
+
+// Time to wait for the headers answering a getheaders
+const getHeadersTimeoutSec = 30
+
+// SyncHeaders adds the headers following the best chain of ch, as known to a
+// full block node from the pool, until the node has no more to send. Invalid
+// headers are reported as misbehaviour and end the sync with their error
+func (c *NetworkConnection) SyncHeaders(ctx context.Context, ch *chain.Chain) error {
+	nodes := c.FullBlockNodes()
+	if len(nodes) == 0 {
+		return ErrNoPeers
+	}
+	return c.syncHeadersFrom(ctx, nodes[0], ch)
+}
+
+// FollowChain adds the header of every new block announced to the pool to ch,
+// so ch emits chain events as blocks arrive and the best chain reorganises.
+// Announcements which do not connect to ch are caught up with from the
+// announcing node as by SyncHeaders
+func (c *NetworkConnection) FollowChain(ch *chain.Chain) *node.Subscription {
+	var mu sync.Mutex
+	syncing := false
+	return c.SubscribeNewBlocks(func(peer *node.Connection, header message.BlockHeader) {
+		_, err := ch.AddHeader(header)
+		if err == nil {
+			return
+		}
+		if err != chain.ErrUnknownParent {
+			peer.ReportMisbehaviour(err)
+			return
+		}
+
+		// Catch up away from the node's reader, which delivers the replies
+		mu.Lock()
+		defer mu.Unlock()
+		if syncing {
+			return
+		}
+		syncing = true
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.syncHeadersFrom(c.ctx, peer, ch)
+			mu.Lock()
+			syncing = false
+			mu.Unlock()
+		}()
+	})
+}
+
+// syncHeadersFrom adds headers from n to ch until n has no more to send
+func (c *NetworkConnection) syncHeadersFrom(ctx context.Context, n *node.Connection, ch *chain.Chain) error {
+	for {
+		headers, err := c.getHeaders(ctx, n, ch)
+		if err != nil {
+			return err
+		}
+		if err := ch.AddHeaders(headers); err != nil {
+			n.ReportMisbehaviour(err)
+			return err
+		}
+		if len(headers) < message.MaxHeadersResults {
+			return nil
+		}
+	}
+}
+
+// getHeaders requests the headers following the best chain of ch from n.
+// Headers not connecting to ch are announcements rather than the reply
+func (c *NetworkConnection) getHeaders(ctx context.Context, n *node.Connection, ch *chain.Chain) ([]message.BlockHeader, error) {
+	ctx, cancel := context.WithTimeout(ctx, getHeadersTimeoutSec*time.Second)
+	defer cancel()
+
+	c.startHeaderSync(n, ch)
+	defer c.endHeaderSync(n, ch)
+
+	var res []message.BlockHeader
+	msg := message.NewGetHeadersMessage(chain.Locator(ch), [32]byte{}, c.testnet)
+	err := exchange(ctx, n, msg, node.ByCommand(message.CommandHeaders), func(e node.Event) bool {
+		headers, ok := e.Message.([]message.BlockHeader)
+		if !ok || !isHeadersReply(ch, headers) {
+			return false
+		}
+		res = headers
+		return true
+	})
+	return res, err
+}
+
+// isHeadersReply reports whether headers can be the reply to a getheaders
+// for ch, which starts at a block of ch unless it is empty
+func isHeadersReply(ch *chain.Chain, headers []message.BlockHeader) bool {
+	if len(headers) == 0 {
+		return true
+	}
+	_, known := ch.Block(headers[0].PrevBlock)
+	return known
+}
+
+// startHeaderSync records a getheaders for ch outstanding with n so the
+// reply is not taken for a new block announcement
+func (c *NetworkConnection) startHeaderSync(n *node.Connection, ch *chain.Chain) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.headerSyncs[n] = append(c.headerSyncs[n], ch)
+}
+
+// endHeaderSync removes a getheaders recorded by startHeaderSync
+func (c *NetworkConnection) endHeaderSync(n *node.Connection, ch *chain.Chain) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	syncs := c.headerSyncs[n]
+	for i, s := range syncs {
+		if s == ch {
+			syncs = append(syncs[:i], syncs[i+1:]...)
+			break
+		}
+	}
+	if len(syncs) == 0 {
+		delete(c.headerSyncs, n)
+	} else {
+		c.headerSyncs[n] = syncs
+	}
+}
+
+// isHeaderSyncReply reports whether headers from n answer an outstanding getheaders
+func (c *NetworkConnection) isHeaderSyncReply(n *node.Connection, headers []message.BlockHeader) bool {
+	c.mu.Lock()
+	syncs := append([]*chain.Chain{}, c.headerSyncs[n]...)
+	c.mu.Unlock()
+	for _, ch := range syncs {
+		if isHeadersReply(ch, headers) {
+			return true
+		}
+	}
+	return false
+}
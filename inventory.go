@@ -0,0 +1,109 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sansnetwork
+
+import (
+	"time"
+
+	"github.com/sanscentral/sansnetwork/inventory"
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/node"
+	"github.com/sanscentral/sansnetwork/propagation"
+)
+
+// InventoryHandler is type for inventory announcement callbacks,
+// peer is the node which announced the entries
+type InventoryHandler func(peer *node.Connection, entries []inventory.Entry)
+
+// SubscribeInventory calls h with the entries of every inv message received by
+// any node in the pool, limited to the given types if any are given.
+// Handlers may be called concurrently from different nodes
+func (c *NetworkConnection) SubscribeInventory(h InventoryHandler, types ...inventory.Type) *node.Subscription {
+	return subscribeInventory(c.events, h, types)
+}
+
+// SubscribeNewInventory is like SubscribeInventory but each entry is only
+// delivered once, by the first peer to announce it
+func (c *NetworkConnection) SubscribeNewInventory(h InventoryHandler, types ...inventory.Type) *node.Subscription {
+	return subscribeInventory(c.newInventory, h, types)
+}
+
+// InventorySighting returns when hash was first announced and by which
+// peers, if it is among the recently seen inventory
+func (c *NetworkConnection) InventorySighting(hash [32]byte) (inventory.Sighting, bool) {
+	return c.seen.Lookup(hash)
+}
+
+// recordInventory records inv announcements from the pool and
+// republishes entries not seen before to new inventory subscribers
+func (c *NetworkConnection) recordInventory(e node.Event) {
+	inv, ok := e.Message.(inventory.Item)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	fresh := []inventory.Entry{}
+	for _, entry := range inv.Entry {
+		if c.seen.Record(entry, e.Peer.Host(), now) {
+			fresh = append(fresh, entry)
+		}
+	}
+	if len(fresh) > 0 {
+		e.Message = inventory.Item{Count: uint64(len(fresh)), Entry: fresh}
+		c.newInventory.Publish(e)
+	}
+}
+
+// linkTxIDs indexes received transactions by both txid and wtxid so
+// announcements by either map to the same sighting
+func (c *NetworkConnection) linkTxIDs(e node.Event) {
+	tx, ok := e.Message.(message.Tx)
+	if !ok {
+		return
+	}
+	c.seen.Link(tx.TxID(), tx.WTxID())
+}
+
+func subscribeInventory(b *node.Bus, h InventoryHandler, types []inventory.Type) *node.Subscription {
+	return b.Subscribe(node.ByCommand(message.CommandInventory), func(e node.Event) {
+		inv, ok := e.Message.(inventory.Item)
+		if !ok {
+			return
+		}
+		entries := inventory.FilterEntries(inv.Entry, types...)
+		if len(entries) > 0 {
+			h(e.Peer, entries)
+		}
+	})
+}
+
+// RecordPropagation records every inv announcement received by the pool
+// in r until the subscription is cancelled. Received transactions link
+// their txid and wtxid announcements in r
+func (c *NetworkConnection) RecordPropagation(r *propagation.Recorder) *node.Subscription {
+	return c.Subscribe(node.ByCommand(message.CommandInventory, message.CommandTx), func(e node.Event) {
+		switch m := e.Message.(type) {
+		case inventory.Item:
+			now := time.Now()
+			poolSize := c.NodeCount()
+			for _, entry := range m.Entry {
+				r.Record(entry, e.Peer.Host(), now, poolSize)
+			}
+		case message.Tx:
+			r.Link(m.TxID(), m.WTxID())
+		}
+	})
+}
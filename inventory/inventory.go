@@ -15,22 +15,84 @@
 
 package inventory
 
-import "encoding/hex"
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+// Type identifies the kind of object an inventory entry refers to
+type Type uint32
+
+const (
+	// TypeError (ERROR) entries carry no data and can be ignored
+	TypeError Type = 0
+
+	// TypeTx (MSG_TX) is the hash of a transaction
+	TypeTx Type = 1
+
+	// TypeBlock (MSG_BLOCK) is the hash of a block header
+	TypeBlock Type = 2
+
+	// TypeFilteredBlock (MSG_FILTERED_BLOCK) requests a merkleblock in getdata (BIP0037)
+	TypeFilteredBlock Type = 3
+
+	// TypeCmpctBlock (MSG_CMPCT_BLOCK) requests a cmpctblock in getdata (BIP0152)
+	TypeCmpctBlock Type = 4
+
+	// TypeWTX (MSG_WTX) is the witness hash of a transaction (BIP0339)
+	TypeWTX Type = 5
+
+	// witnessFlag is set on types requesting witness serialisation (BIP0144)
+	witnessFlag Type = 1 << 30
+
+	// TypeWitnessTx (MSG_WITNESS_TX) requests a transaction with witness data in getdata
+	TypeWitnessTx = TypeTx | witnessFlag
+
+	// TypeWitnessBlock (MSG_WITNESS_BLOCK) requests a block with witness data in getdata
+	TypeWitnessBlock = TypeBlock | witnessFlag
+
+	// TypeFilteredWitnessBlock (MSG_FILTERED_WITNESS_BLOCK) is reserved (BIP0144)
+	TypeFilteredWitnessBlock = TypeFilteredBlock | witnessFlag
+)
+
+var typeNames = map[Type]string{
+	TypeError:                "ERROR",
+	TypeTx:                   "MSG_TX",
+	TypeBlock:                "MSG_BLOCK",
+	TypeFilteredBlock:        "MSG_FILTERED_BLOCK",
+	TypeCmpctBlock:           "MSG_CMPCT_BLOCK",
+	TypeWTX:                  "MSG_WTX",
+	TypeWitnessTx:            "MSG_WITNESS_TX",
+	TypeWitnessBlock:         "MSG_WITNESS_BLOCK",
+	TypeFilteredWitnessBlock: "MSG_FILTERED_WITNESS_BLOCK",
+}
+
+// String returns the protocol name of the inventory type
+func (t Type) String() string {
+	if n, ok := typeNames[t]; ok {
+		return n
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", uint32(t))
+}
 
 // Handler is type for inventory handler func
 type Handler func([]Entry)
 
-var handlerInstance Handler
+var (
+	handlerMu       sync.RWMutex
+	handlerInstance Handler
+)
 
 // Item is inventory structure of BTC payload
 type Item struct {
-	Count uint8
+	Count uint64
 	Entry []Entry
 }
 
 // Entry is a single inventory entry
 type Entry struct {
-	Type uint32
+	Type Type
 	Hash [32]byte
 }
 
@@ -39,14 +101,39 @@ func (e *Entry) HexString() string {
 	return hex.EncodeToString(e.Hash[:])
 }
 
+// FilterEntries returns the entries matching any of types, all entries if no types are given
+func FilterEntries(entries []Entry, types ...Type) []Entry {
+	if len(types) == 0 {
+		return entries
+	}
+	res := []Entry{}
+	for _, e := range entries {
+		for _, t := range types {
+			if e.Type == t {
+				res = append(res, e)
+				break
+			}
+		}
+	}
+	return res
+}
+
 // CallHandler calls set handler
 func CallHandler(m []Entry) {
-	if handlerInstance != nil {
-		handlerInstance(m)
+	handlerMu.RLock()
+	h := handlerInstance
+	handlerMu.RUnlock()
+	if h != nil {
+		h(m)
 	}
 }
 
-// SetInventoryHandler for inventory entry callbacks
+// SetInventoryHandler for inventory entry callbacks from every connection in the process.
+//
+// Deprecated: use NetworkConnection.SubscribeInventory which supports
+// multiple subscribers, type filtering and reports the announcing peer
 func SetInventoryHandler(i Handler) {
+	handlerMu.Lock()
+	defer handlerMu.Unlock()
 	handlerInstance = i
 }
@@ -0,0 +1,51 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package inventory
+
+import "testing"
+
+func TestFilterEntries(t *testing.T) {
+	entries := []Entry{
+		{Type: TypeTx, Hash: [32]byte{1}},
+		{Type: TypeBlock, Hash: [32]byte{2}},
+		{Type: TypeWTX, Hash: [32]byte{3}},
+		{Type: TypeError},
+		{Type: TypeWitnessTx, Hash: [32]byte{4}},
+	}
+
+	if got := FilterEntries(entries); len(got) != len(entries) {
+		t.Fatalf("no types: got %d entries, want all %d", len(got), len(entries))
+	}
+	got := FilterEntries(entries, TypeTx, TypeWTX)
+	if len(got) != 2 || got[0] != entries[0] || got[1] != entries[2] {
+		t.Fatalf("tx and wtx: got %v", got)
+	}
+	if got := FilterEntries(entries, TypeWitnessTx); len(got) != 1 || got[0] != entries[4] {
+		t.Fatalf("witness flag is part of the type: got %v", got)
+	}
+	if got := FilterEntries(entries, TypeCmpctBlock); len(got) != 0 {
+		t.Fatalf("unmatched type: got %v", got)
+	}
+}
+
+func TestTypeString(t *testing.T) {
+	if s := TypeWitnessBlock.String(); s != "MSG_WITNESS_BLOCK" {
+		t.Fatalf("got %s", s)
+	}
+	if s := Type(99).String(); s != "UNKNOWN(99)" {
+		t.Fatalf("got %s", s)
+	}
+}
@@ -0,0 +1,222 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package inventory
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Announcement is a single peer announcing an inventory entry
+type Announcement struct {
+	Peer string // Address of the announcing peer
+	Time time.Time
+}
+
+// Sighting records when an inventory entry was first seen and which peers announced it
+type Sighting struct {
+	Entry         Entry
+	FirstSeen     time.Time
+	Announcements []Announcement // In order of arrival, one per peer
+}
+
+// Peers returns the addresses of the peers which announced the entry
+func (s *Sighting) Peers() []string {
+	res := make([]string, 0, len(s.Announcements))
+	for _, a := range s.Announcements {
+		res = append(res, a.Peer)
+	}
+	return res
+}
+
+// SeenCache is a bounded least recently used record of inventory sightings
+// keyed by hash. Transactions linked with Link are found by txid or wtxid
+type SeenCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // Front is most recently used
+	items   map[[32]byte]*list.Element
+	aliases map[[32]byte][32]byte // wtxid to txid of linked transactions
+	wtxids  map[[32]byte][32]byte // txid to wtxid of linked transactions
+}
+
+// seenItem is a cached sighting and the hash it is keyed by
+type seenItem struct {
+	key      [32]byte
+	sighting Sighting
+}
+
+// NewSeenCache creates a cache holding at most size sightings
+func NewSeenCache(size int) *SeenCache {
+	if size < 1 {
+		size = 1
+	}
+	return &SeenCache{
+		size:    size,
+		order:   list.New(),
+		items:   map[[32]byte]*list.Element{},
+		aliases: map[[32]byte][32]byte{},
+		wtxids:  map[[32]byte][32]byte{},
+	}
+}
+
+// resolve returns the hash the sighting of hash is keyed by. The caller must hold c.mu
+func (c *SeenCache) resolve(hash [32]byte) [32]byte {
+	if txid, ok := c.aliases[hash]; ok {
+		return txid
+	}
+	return hash
+}
+
+// Record notes that peer announced e at t and returns true if e was not already
+// in the cache. Repeated announcements by the same peer are ignored
+func (c *SeenCache) Record(e Entry, peer string, t time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := c.resolve(e.Hash)
+	if el, ok := c.items[key]; ok {
+		c.order.MoveToFront(el)
+		s := &el.Value.(*seenItem).sighting
+		for _, a := range s.Announcements {
+			if a.Peer == peer {
+				return false
+			}
+		}
+		s.Announcements = append(s.Announcements, Announcement{Peer: peer, Time: t})
+		return false
+	}
+
+	item := &seenItem{
+		key: key,
+		sighting: Sighting{
+			Entry:         e,
+			FirstSeen:     t,
+			Announcements: []Announcement{{Peer: peer, Time: t}},
+		},
+	}
+	c.items[key] = c.order.PushFront(item)
+	for c.order.Len() > c.size {
+		c.evict(c.order.Back())
+	}
+	return true
+}
+
+// evict removes el and any alias of its key. The caller must hold c.mu
+func (c *SeenCache) evict(el *list.Element) {
+	key := el.Value.(*seenItem).key
+	c.order.Remove(el)
+	delete(c.items, key)
+	if wtxid, ok := c.wtxids[key]; ok {
+		delete(c.aliases, wtxid)
+		delete(c.wtxids, key)
+	}
+}
+
+// Link indexes a transaction's sighting under both its txid and wtxid, merging
+// the sightings of peers announcing it by txid and peers announcing it by wtxid
+func (c *SeenCache) Link(txid, wtxid [32]byte) {
+	if txid == wtxid {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.aliases[wtxid]; ok {
+		return
+	}
+
+	wel, wok := c.items[wtxid]
+	tel, tok := c.items[txid]
+	switch {
+	case !wok && !tok:
+		return
+	case wok && tok:
+		merge(&tel.Value.(*seenItem).sighting, &wel.Value.(*seenItem).sighting)
+		c.order.Remove(wel)
+		delete(c.items, wtxid)
+	case wok:
+		delete(c.items, wtxid)
+		wel.Value.(*seenItem).key = txid
+		c.items[txid] = wel
+	}
+	c.aliases[wtxid] = txid
+	c.wtxids[txid] = wtxid
+}
+
+// merge adds the announcements of other to s, keeping the first announcement's entry
+func merge(s *Sighting, other *Sighting) {
+	if other.FirstSeen.Before(s.FirstSeen) {
+		s.Entry = other.Entry
+		s.FirstSeen = other.FirstSeen
+	}
+	peers := map[string]bool{}
+	for _, a := range s.Announcements {
+		peers[a.Peer] = true
+	}
+	for _, a := range other.Announcements {
+		if !peers[a.Peer] {
+			s.Announcements = append(s.Announcements, a)
+		}
+	}
+	sort.SliceStable(s.Announcements, func(i, j int) bool {
+		return s.Announcements[i].Time.Before(s.Announcements[j].Time)
+	})
+}
+
+// Lookup returns a copy of the sighting for hash if it is still cached,
+// linked transactions can be looked up by txid or wtxid
+func (c *SeenCache) Lookup(hash [32]byte) (Sighting, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[c.resolve(hash)]
+	if !ok {
+		return Sighting{}, false
+	}
+	s := el.Value.(*seenItem).sighting
+	s.Announcements = append([]Announcement{}, s.Announcements...)
+	return s, true
+}
+
+// Key returns the hash the sighting of hash is stored under, which is
+// the txid for a linked wtxid and hash itself otherwise
+func (c *SeenCache) Key(hash [32]byte) [32]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resolve(hash)
+}
+
+// Sightings returns a copy of every cached sighting in first seen order
+func (c *SeenCache) Sightings() []Sighting {
+	c.mu.Lock()
+	res := make([]Sighting, 0, c.order.Len())
+	for el := c.order.Front(); el != nil; el = el.Next() {
+		s := el.Value.(*seenItem).sighting
+		s.Announcements = append([]Announcement{}, s.Announcements...)
+		res = append(res, s)
+	}
+	c.mu.Unlock()
+	sort.SliceStable(res, func(i, j int) bool { return res[i].FirstSeen.Before(res[j].FirstSeen) })
+	return res
+}
+
+// Len returns the number of cached sightings
+func (c *SeenCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,134 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package inventory
+
+import (
+	"testing"
+	"time"
+)
+
+func tx(b byte) Entry {
+	return Entry{Type: TypeTx, Hash: [32]byte{b}}
+}
+
+func TestSeenCacheRecord(t *testing.T) {
+	c := NewSeenCache(10)
+	t0 := time.Unix(1000, 0)
+	if !c.Record(tx(1), "a", t0) {
+		t.Fatal("first sighting not reported as new")
+	}
+	if c.Record(tx(1), "b", t0.Add(time.Second)) || c.Record(tx(1), "a", t0.Add(2*time.Second)) {
+		t.Fatal("repeated sighting reported as new")
+	}
+
+	s, ok := c.Lookup(tx(1).Hash)
+	if !ok || !s.FirstSeen.Equal(t0) {
+		t.Fatal("first seen time not kept")
+	}
+	peers := s.Peers()
+	if len(peers) != 2 || peers[0] != "a" || peers[1] != "b" {
+		t.Fatalf("got peers %v, want a then b once each", peers)
+	}
+
+	// Lookup returns a copy
+	s.Announcements[0].Peer = "x"
+	if s, _ := c.Lookup(tx(1).Hash); s.Announcements[0].Peer != "a" {
+		t.Fatal("lookup shares announcements with the cache")
+	}
+}
+
+func TestSeenCacheEviction(t *testing.T) {
+	c := NewSeenCache(3)
+	now := time.Unix(1000, 0)
+	for i := byte(1); i <= 3; i++ {
+		c.Record(tx(i), "a", now)
+	}
+
+	// Seeing 1 again makes 2 the least recently used
+	c.Record(tx(1), "b", now)
+	c.Record(tx(4), "a", now)
+	if c.Len() != 3 {
+		t.Fatalf("cache holds %d sightings, want 3", c.Len())
+	}
+	if _, ok := c.Lookup(tx(2).Hash); ok {
+		t.Fatal("least recently used sighting not evicted")
+	}
+	for _, i := range []byte{1, 3, 4} {
+		if _, ok := c.Lookup(tx(i).Hash); !ok {
+			t.Fatalf("sighting %d evicted", i)
+		}
+	}
+	if !c.Record(tx(2), "a", now) {
+		t.Fatal("evicted sighting not new when seen again")
+	}
+}
+
+func TestSeenCacheLink(t *testing.T) {
+	c := NewSeenCache(10)
+	txid, wtxid := [32]byte{1}, [32]byte{2}
+	t0 := time.Unix(1000, 0)
+	c.Record(Entry{Type: TypeTx, Hash: txid}, "a", t0.Add(time.Second))
+	c.Record(Entry{Type: TypeWTX, Hash: wtxid}, "b", t0)
+	c.Record(Entry{Type: TypeWTX, Hash: wtxid}, "a", t0.Add(2*time.Second))
+	c.Link(txid, wtxid)
+
+	if c.Len() != 1 {
+		t.Fatalf("linked sightings not merged, cache holds %d", c.Len())
+	}
+	for _, h := range [][32]byte{txid, wtxid} {
+		s, ok := c.Lookup(h)
+		if !ok {
+			t.Fatal("linked transaction not found")
+		}
+		if !s.FirstSeen.Equal(t0) || s.Entry.Type != TypeWTX {
+			t.Fatal("merged sighting does not keep the earliest announcement")
+		}
+		peers := s.Peers()
+		if len(peers) != 2 || peers[0] != "b" || peers[1] != "a" {
+			t.Fatalf("got peers %v, want b then a once each", peers)
+		}
+	}
+	if c.Key(wtxid) != txid || c.Key(txid) != txid {
+		t.Fatal("linked sighting not keyed by txid")
+	}
+
+	// Later announcements by wtxid join the same sighting
+	if c.Record(Entry{Type: TypeWTX, Hash: wtxid}, "c", t0.Add(3*time.Second)) {
+		t.Fatal("announcement of a linked wtxid reported as new")
+	}
+	if s, _ := c.Lookup(txid); len(s.Announcements) != 3 {
+		t.Fatalf("got %d announcements, want 3", len(s.Announcements))
+	}
+}
+
+func TestSeenCacheLinkWtxidOnly(t *testing.T) {
+	c := NewSeenCache(1)
+	txid, wtxid := [32]byte{1}, [32]byte{2}
+	c.Record(Entry{Type: TypeWTX, Hash: wtxid}, "a", time.Unix(1000, 0))
+	c.Link(txid, wtxid)
+	if _, ok := c.Lookup(txid); !ok || c.Len() != 1 {
+		t.Fatal("sighting by wtxid not found by txid after linking")
+	}
+
+	// Evicting the sighting drops the link with it
+	c.Record(tx(9), "a", time.Unix(1001, 0))
+	if c.Key(wtxid) != wtxid {
+		t.Fatal("link kept after eviction")
+	}
+	if !c.Record(Entry{Type: TypeWTX, Hash: wtxid}, "a", time.Unix(1002, 0)) {
+		t.Fatal("evicted wtxid not new when seen again")
+	}
+}
@@ -0,0 +1,191 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sansnetwork
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/inventory"
+	"github.com/sanscentral/sansnetwork/mempool"
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/node"
+)
+
+const (
+	// Interval between mempool age expiry checks
+	mempoolExpireDelaySec = 60
+
+	// Time after which an unanswered getdata may be sent again
+	getDataTimeoutSec = 60
+)
+
+// MempoolMirror keeps a mempool in sync with the transactions and blocks relayed by the pool
+type MempoolMirror struct {
+	c         *NetworkConnection
+	pool      *mempool.Mempool
+	mu        sync.Mutex
+	requested map[[32]byte]time.Time
+	subs      []*node.Subscription
+	stop      chan struct{}
+	once      sync.Once
+}
+
+// MirrorMempool requests the mempool of every node in the pool supporting it,
+// fetches announced transactions into m and removes them again as blocks arrive
+func (c *NetworkConnection) MirrorMempool(m *mempool.Mempool) *MempoolMirror {
+	mm := &MempoolMirror{
+		c:         c,
+		pool:      m,
+		requested: map[[32]byte]time.Time{},
+		stop:      make(chan struct{}),
+	}
+	mm.subs = []*node.Subscription{
+		c.Subscribe(node.ByType(node.EventPeerConnected), func(e node.Event) {
+			mm.requestMempool(e.Peer)
+		}),
+		c.SubscribeInventory(mm.handleInventory, inventory.TypeTx, inventory.TypeWTX),
+		c.SubscribeNewBlocks(mm.handleNewBlock),
+		c.Subscribe(node.ByCommand(message.CommandTx), mm.handleTx),
+		c.Subscribe(node.ByCommand(message.CommandBlock), mm.handleBlock),
+	}
+	for _, n := range c.Nodes() {
+		mm.requestMempool(n)
+	}
+
+	c.wg.Add(1)
+	go mm.expire()
+	return mm
+}
+
+// Stop stops mirroring, the mempool keeps its current contents
+func (mm *MempoolMirror) Stop() {
+	mm.once.Do(func() {
+		for _, s := range mm.subs {
+			s.Unsubscribe()
+		}
+		close(mm.stop)
+	})
+}
+
+// requestMempool asks n for its unconfirmed transactions, nodes
+// only serve mempool requests if they offer bloom filtering
+func (mm *MempoolMirror) requestMempool(n *node.Connection) {
+	if n.Services()&node.ServiceBloom != 0 {
+		n.QueueMessage(message.NewMempoolMessage(mm.c.testnet), nil)
+	}
+}
+
+// handleInventory requests announced transactions and blocks not already known
+func (mm *MempoolMirror) handleInventory(peer *node.Connection, entries []inventory.Entry) {
+	want := []inventory.Entry{}
+	now := time.Now()
+	compactBlocks := mm.c.compactBlocksEnabled()
+	mm.mu.Lock()
+	for _, e := range entries {
+		if (e.Type == inventory.TypeTx || e.Type == inventory.TypeWTX) && mm.pool.Has(e.Hash) {
+			continue
+		}
+		// Blocks are fetched as compact blocks instead, see RelayCompactBlocks
+		if e.Type == inventory.TypeBlock && compactBlocks {
+			continue
+		}
+		if t, ok := mm.requested[e.Hash]; ok && now.Sub(t) < getDataTimeoutSec*time.Second {
+			continue
+		}
+		mm.requested[e.Hash] = now
+
+		// Always ask for witness serialisation so wtxids can be computed,
+		// wtxid announcements are requested as they are
+		switch e.Type {
+		case inventory.TypeTx:
+			e.Type = inventory.TypeWitnessTx
+		case inventory.TypeBlock:
+			e.Type = inventory.TypeWitnessBlock
+		}
+		want = append(want, e)
+	}
+	mm.mu.Unlock()
+
+	if len(want) == 0 {
+		return
+	}
+	if err := peer.QueueMessage(message.NewGetDataMessage(want, mm.c.testnet), nil); err != nil {
+		// Forget the requests so the next announcement retries them
+		mm.mu.Lock()
+		for _, e := range want {
+			delete(mm.requested, e.Hash)
+		}
+		mm.mu.Unlock()
+	}
+}
+
+// handleNewBlock requests new blocks so their transactions leave the mempool,
+// whether nodes announce them with inv, headers or compact blocks
+func (mm *MempoolMirror) handleNewBlock(peer *node.Connection, header message.BlockHeader) {
+	mm.handleInventory(peer, []inventory.Entry{{Type: inventory.TypeBlock, Hash: header.BlockHash()}})
+}
+
+// handleTx adds received transactions to the mempool
+func (mm *MempoolMirror) handleTx(e node.Event) {
+	tx, ok := e.Message.(message.Tx)
+	if !ok {
+		return
+	}
+	mm.mu.Lock()
+	delete(mm.requested, tx.TxID())
+	delete(mm.requested, tx.WTxID())
+	mm.mu.Unlock()
+	mm.pool.Add(tx)
+}
+
+// handleBlock removes transactions included in received blocks from the mempool
+func (mm *MempoolMirror) handleBlock(e node.Event) {
+	blk, err := message.ParseBlockPayload(e.Payload)
+	if err != nil {
+		return
+	}
+	hash := blk.Header.BlockHash()
+	mm.mu.Lock()
+	delete(mm.requested, hash)
+	mm.mu.Unlock()
+	mm.pool.RemoveBlock(blk)
+}
+
+// expire periodically removes old mempool entries and forgets unanswered requests
+func (mm *MempoolMirror) expire() {
+	defer mm.c.wg.Done()
+	ticker := time.NewTicker(mempoolExpireDelaySec * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mm.c.ctx.Done():
+			return
+		case <-mm.stop:
+			return
+		case now := <-ticker.C:
+			mm.pool.Expire(now)
+			mm.mu.Lock()
+			for h, t := range mm.requested {
+				if now.Sub(t) >= getDataTimeoutSec*time.Second {
+					delete(mm.requested, h)
+				}
+			}
+			mm.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,375 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mempool
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/message"
+)
+
+// RemovalReason describes why a transaction left the mempool
+type RemovalReason int
+
+const (
+	// RemovalBlock transactions were included in a block
+	RemovalBlock RemovalReason = iota
+
+	// RemovalConflict transactions spent an output also spent by a transaction in a block
+	RemovalConflict
+
+	// RemovalExpired transactions were older than the maximum age
+	RemovalExpired
+
+	// RemovalSize transactions were evicted to keep the mempool within its maximum size
+	RemovalSize
+)
+
+// String returns a readable name for the reason
+func (r RemovalReason) String() string {
+	switch r {
+	case RemovalBlock:
+		return "block"
+	case RemovalConflict:
+		return "conflict"
+	case RemovalExpired:
+		return "expired"
+	case RemovalSize:
+		return "size"
+	}
+	return "unknown"
+}
+
+// Entry is a single transaction held in the mempool
+type Entry struct {
+	Tx       message.Tx
+	TxID     [32]byte
+	WTxID    [32]byte
+	VSize    int
+	Fee      int64 // Satoshis, only valid if FeeKnown
+	FeeKnown bool  // True when the value of every input was known
+	Added    time.Time
+}
+
+// FeeRate returns the fee rate in satoshis per vbyte, or 0 if the fee is unknown
+func (e *Entry) FeeRate() float64 {
+	if !e.FeeKnown || e.VSize == 0 {
+		return 0
+	}
+	return float64(e.Fee) / float64(e.VSize)
+}
+
+// Event is an addition to or removal from the mempool
+type Event struct {
+	Added  bool // True for additions, false for removals
+	Entry  Entry
+	Reason RemovalReason // Only valid for removals
+}
+
+// Handler is type for mempool event callbacks
+type Handler func(Event)
+
+// Subscription is a registered mempool event handler
+type Subscription struct {
+	pool    *Mempool
+	handler Handler
+}
+
+// Mempool mirrors the unconfirmed transactions relayed by the network.
+// Entries are removed when included in a block, when they conflict with a
+// block, when older than maxAge or, oldest first, when over maxVSize
+type Mempool struct {
+	mu       sync.Mutex
+	maxAge   time.Duration
+	maxVSize int
+	vsize    int
+	order    *list.List // Oldest at front
+	byTxID   map[[32]byte]*list.Element
+	byWTxID  map[[32]byte]*list.Element
+	spends   map[message.OutPoint][32]byte // Outpoint to spending txid
+	subs     []*Subscription
+}
+
+// New creates an empty mempool, a zero maxAge or maxVSize disables that limit
+func New(maxAge time.Duration, maxVSize int) *Mempool {
+	return &Mempool{
+		maxAge:   maxAge,
+		maxVSize: maxVSize,
+		order:    list.New(),
+		byTxID:   map[[32]byte]*list.Element{},
+		byWTxID:  map[[32]byte]*list.Element{},
+		spends:   map[message.OutPoint][32]byte{},
+	}
+}
+
+// Subscribe calls h for every addition and removal. Handlers are called
+// after the mempool has been updated, from the goroutine making the change
+func (m *Mempool) Subscribe(h Handler) *Subscription {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &Subscription{pool: m, handler: h}
+	m.subs = append(m.subs, s)
+	return s
+}
+
+// Unsubscribe stops delivery of further events to this handler
+func (s *Subscription) Unsubscribe() {
+	m := s.pool
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	subs := make([]*Subscription, 0, len(m.subs))
+	for _, e := range m.subs {
+		if e != s {
+			subs = append(subs, e)
+		}
+	}
+	m.subs = subs
+}
+
+// notify delivers events to subscribers, it must be called without holding mu
+func (m *Mempool) notify(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	m.mu.Lock()
+	subs := m.subs
+	m.mu.Unlock()
+	for _, e := range events {
+		for _, s := range subs {
+			s.handler(e)
+		}
+	}
+}
+
+// Add adds tx to the mempool and returns true if it was not already present.
+// The fee is computed when every input spends an output of a transaction in the mempool
+func (m *Mempool) Add(tx message.Tx) bool {
+	txid := tx.TxID()
+	m.mu.Lock()
+	if _, ok := m.byTxID[txid]; ok {
+		m.mu.Unlock()
+		return false
+	}
+
+	e := &Entry{
+		Tx:    tx,
+		TxID:  txid,
+		WTxID: tx.WTxID(),
+		VSize: tx.VSize(),
+		Added: time.Now(),
+	}
+	e.Fee, e.FeeKnown = m.fee(tx)
+
+	el := m.order.PushBack(e)
+	m.byTxID[e.TxID] = el
+	m.byWTxID[e.WTxID] = el
+	for _, in := range tx.TxIn {
+		m.spends[in.PreviousOutPoint] = e.TxID
+	}
+	m.vsize += e.VSize
+
+	events := []Event{{Added: true, Entry: *e}}
+	if m.maxVSize > 0 {
+		for m.vsize > m.maxVSize && m.order.Len() > 0 {
+			events = append(events, m.remove(m.order.Front(), RemovalSize))
+		}
+	}
+	m.mu.Unlock()
+
+	m.notify(events)
+	return true
+}
+
+// fee returns the fee paid by tx if the value of every input is known
+func (m *Mempool) fee(tx message.Tx) (int64, bool) {
+	var in, out int64
+	for _, txin := range tx.TxIn {
+		el, ok := m.byTxID[txin.PreviousOutPoint.Hash]
+		if !ok {
+			return 0, false
+		}
+		prev := el.Value.(*Entry).Tx
+		if int(txin.PreviousOutPoint.Index) >= len(prev.TxOut) {
+			return 0, false
+		}
+		in += prev.TxOut[txin.PreviousOutPoint.Index].Value
+	}
+	for _, txout := range tx.TxOut {
+		out += txout.Value
+	}
+	return in - out, true
+}
+
+// remove deletes el from all indices, mu must be held
+func (m *Mempool) remove(el *list.Element, reason RemovalReason) Event {
+	e := el.Value.(*Entry)
+	m.order.Remove(el)
+	delete(m.byTxID, e.TxID)
+	delete(m.byWTxID, e.WTxID)
+	for _, in := range e.Tx.TxIn {
+		if m.spends[in.PreviousOutPoint] == e.TxID {
+			delete(m.spends, in.PreviousOutPoint)
+		}
+	}
+	m.vsize -= e.VSize
+	return Event{Entry: *e, Reason: reason}
+}
+
+// removeWithDescendants removes el and every transaction spending its
+// outputs, directly or through other transactions. mu must be held
+func (m *Mempool) removeWithDescendants(el *list.Element, reason RemovalReason) []Event {
+	events := []Event{}
+	pending := []*list.Element{el}
+	for len(pending) > 0 {
+		el := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		// A transaction spending several outputs of another is found once per output
+		if _, ok := m.byTxID[el.Value.(*Entry).TxID]; !ok {
+			continue
+		}
+		e := m.remove(el, reason)
+		events = append(events, e)
+		for i := range e.Entry.Tx.TxOut {
+			spender, ok := m.spends[message.OutPoint{Hash: e.Entry.TxID, Index: uint32(i)}]
+			if !ok {
+				continue
+			}
+			if child, ok := m.byTxID[spender]; ok {
+				pending = append(pending, child)
+			}
+		}
+	}
+	return events
+}
+
+// RemoveBlock removes the transactions included in blk, and any
+// transactions spending the same outputs as them with their descendants
+func (m *Mempool) RemoveBlock(blk message.Block) {
+	events := []Event{}
+	m.mu.Lock()
+	for i := range blk.Tx {
+		tx := &blk.Tx[i]
+		txid := tx.TxID()
+		if el, ok := m.byTxID[txid]; ok {
+			events = append(events, m.remove(el, RemovalBlock))
+		}
+		if tx.IsCoinBase() {
+			continue
+		}
+		for _, in := range tx.TxIn {
+			spender, ok := m.spends[in.PreviousOutPoint]
+			if !ok || spender == txid {
+				continue
+			}
+			if el, ok := m.byTxID[spender]; ok {
+				events = append(events, m.removeWithDescendants(el, RemovalConflict)...)
+			}
+		}
+	}
+	m.mu.Unlock()
+	m.notify(events)
+}
+
+// Expire removes transactions added before now minus the maximum age
+func (m *Mempool) Expire(now time.Time) {
+	if m.maxAge <= 0 {
+		return
+	}
+	events := []Event{}
+	cutoff := now.Add(-m.maxAge)
+	m.mu.Lock()
+	for m.order.Len() > 0 {
+		el := m.order.Front()
+		if !el.Value.(*Entry).Added.Before(cutoff) {
+			break
+		}
+		events = append(events, m.remove(el, RemovalExpired))
+	}
+	m.mu.Unlock()
+	m.notify(events)
+}
+
+// Get returns the entry for txid
+func (m *Mempool) Get(txid [32]byte) (Entry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.byTxID[txid]; ok {
+		return *el.Value.(*Entry), true
+	}
+	return Entry{}, false
+}
+
+// GetByWTxID returns the entry for wtxid
+func (m *Mempool) GetByWTxID(wtxid [32]byte) (Entry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.byWTxID[wtxid]; ok {
+		return *el.Value.(*Entry), true
+	}
+	return Entry{}, false
+}
+
+// Has returns true if a transaction with the given txid or wtxid is in the mempool
+func (m *Mempool) Has(hash [32]byte) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.byTxID[hash]
+	if !ok {
+		_, ok = m.byWTxID[hash]
+	}
+	return ok
+}
+
+// Entries returns every entry, oldest first
+func (m *Mempool) Entries() []Entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]Entry, 0, m.order.Len())
+	for el := m.order.Front(); el != nil; el = el.Next() {
+		res = append(res, *el.Value.(*Entry))
+	}
+	return res
+}
+
+// MatchShortIDs calls f for every transaction whose BIP0152 short id under the
+// keys k0 and k1 is in ids, with the position ids maps it to. Transactions are
+// hashed in place, f is called with the mempool locked and must not use it
+func (m *Mempool) MatchShortIDs(k0, k1 uint64, ids map[uint64]int, f func(pos int, tx message.Tx)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for wtxid, el := range m.byWTxID {
+		if pos, ok := ids[message.ShortID(k0, k1, wtxid)]; ok {
+			f(pos, el.Value.(*Entry).Tx)
+		}
+	}
+}
+
+// Len returns the number of transactions in the mempool
+func (m *Mempool) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.order.Len()
+}
+
+// VSize returns the total virtual size of the transactions in the mempool
+func (m *Mempool) VSize() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.vsize
+}
@@ -0,0 +1,202 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mempool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/message"
+)
+
+// spend returns a transaction spending the given outpoints with an output per value
+func spend(prev []message.OutPoint, values ...int64) message.Tx {
+	tx := message.Tx{Version: 2}
+	for _, op := range prev {
+		tx.TxIn = append(tx.TxIn, message.TxIn{PreviousOutPoint: op, Sequence: 0xffffffff})
+	}
+	for _, v := range values {
+		tx.TxOut = append(tx.TxOut, message.TxOut{Value: v, PkScript: []byte{0x51}})
+	}
+	return tx
+}
+
+// out returns the outpoint of output i of tx
+func out(tx message.Tx, i uint32) message.OutPoint {
+	return message.OutPoint{Hash: tx.TxID(), Index: i}
+}
+
+// confirmed returns an outpoint of a transaction outside the mempool
+func confirmed(b byte) message.OutPoint {
+	return message.OutPoint{Hash: [32]byte{b}}
+}
+
+// record returns the removal reasons of every transaction removed from m
+func record(m *Mempool) map[[32]byte]RemovalReason {
+	removed := map[[32]byte]RemovalReason{}
+	m.Subscribe(func(e Event) {
+		if !e.Added {
+			removed[e.Entry.TxID] = e.Reason
+		}
+	})
+	return removed
+}
+
+func TestAddFee(t *testing.T) {
+	m := New(0, 0)
+	parent := spend([]message.OutPoint{confirmed(1)}, 1000, 2000)
+	child := spend([]message.OutPoint{out(parent, 0), out(parent, 1)}, 2500)
+
+	if !m.Add(parent) || m.Add(parent) {
+		t.Fatal("Add does not report new transactions only")
+	}
+	if e, _ := m.Get(parent.TxID()); e.FeeKnown || e.FeeRate() != 0 {
+		t.Fatal("fee known for a transaction spending outputs outside the mempool")
+	}
+
+	m.Add(child)
+	e, ok := m.Get(child.TxID())
+	if !ok || !e.FeeKnown || e.Fee != 500 {
+		t.Fatalf("got fee %d known %v, want 500", e.Fee, e.FeeKnown)
+	}
+	if e.FeeRate() != 500/float64(child.VSize()) {
+		t.Fatalf("got fee rate %f", e.FeeRate())
+	}
+
+	bad := spend([]message.OutPoint{out(parent, 5)}, 100)
+	m.Add(bad)
+	if e, _ := m.Get(bad.TxID()); e.FeeKnown {
+		t.Fatal("fee known for a transaction spending a missing output")
+	}
+	if m.Len() != 3 || m.VSize() != parent.VSize()+child.VSize()+bad.VSize() {
+		t.Fatalf("got %d transactions of %d vbytes", m.Len(), m.VSize())
+	}
+}
+
+func TestRemoveBlock(t *testing.T) {
+	m := New(0, 0)
+	removed := record(m)
+
+	// a is confirmed, its child b stays
+	a := spend([]message.OutPoint{confirmed(1)}, 1000)
+	b := spend([]message.OutPoint{out(a, 0)}, 900)
+
+	// c conflicts with the block, d, e and f descend from it and g is unrelated
+	c := spend([]message.OutPoint{confirmed(2)}, 1000, 1000)
+	d := spend([]message.OutPoint{out(c, 0), out(c, 1)}, 1900)
+	e := spend([]message.OutPoint{out(d, 0)}, 1800)
+	f := spend([]message.OutPoint{out(c, 1)}, 900)
+	g := spend([]message.OutPoint{confirmed(3)}, 1000)
+	for _, tx := range []message.Tx{a, b, c, d, e, f, g} {
+		m.Add(tx)
+	}
+
+	coinbase := spend([]message.OutPoint{{Index: 0xffffffff}}, 5000)
+	double := spend([]message.OutPoint{confirmed(2)}, 999)
+	m.RemoveBlock(message.Block{Tx: []message.Tx{coinbase, a, double}})
+
+	if removed[a.TxID()] != RemovalBlock {
+		t.Fatal("confirmed transaction not removed")
+	}
+	for _, tx := range []message.Tx{c, d, e, f} {
+		if reason, ok := removed[tx.TxID()]; !ok || reason != RemovalConflict {
+			t.Fatal("conflicting transaction or descendant not removed as a conflict")
+		}
+	}
+	if len(removed) != 5 || m.Len() != 2 || !m.Has(b.TxID()) || !m.Has(g.TxID()) {
+		t.Fatalf("removed %d transactions, %d left", len(removed), m.Len())
+	}
+	if m.VSize() != b.VSize()+g.VSize() {
+		t.Fatalf("got %d vbytes after removal", m.VSize())
+	}
+}
+
+func TestExpire(t *testing.T) {
+	m := New(time.Hour, 0)
+	removed := record(m)
+	old := spend([]message.OutPoint{confirmed(1)}, 1000)
+	m.Add(old)
+	time.Sleep(10 * time.Millisecond)
+	recent := spend([]message.OutPoint{confirmed(2)}, 1000)
+	m.Add(recent)
+
+	e, _ := m.Get(old.TxID())
+	m.Expire(e.Added.Add(time.Hour))
+	if m.Len() != 2 {
+		t.Fatal("transaction expired at exactly the maximum age")
+	}
+	m.Expire(e.Added.Add(time.Hour + time.Millisecond))
+	if m.Has(old.TxID()) || !m.Has(recent.TxID()) || removed[old.TxID()] != RemovalExpired {
+		t.Fatal("only the old transaction should expire")
+	}
+
+	unlimited := New(0, 0)
+	unlimited.Add(old)
+	unlimited.Expire(time.Now().Add(1000 * time.Hour))
+	if unlimited.Len() != 1 {
+		t.Fatal("transaction expired without a maximum age")
+	}
+}
+
+func TestSizeLimit(t *testing.T) {
+	txs := []message.Tx{}
+	for i := byte(1); i <= 3; i++ {
+		txs = append(txs, spend([]message.OutPoint{confirmed(i)}, 1000))
+	}
+	m := New(0, txs[0].VSize()*2)
+	removed := record(m)
+	for _, tx := range txs {
+		m.Add(tx)
+	}
+	if m.Len() != 2 || m.Has(txs[0].TxID()) || removed[txs[0].TxID()] != RemovalSize {
+		t.Fatal("oldest transaction not evicted over the size limit")
+	}
+	if m.VSize() > txs[0].VSize()*2 {
+		t.Fatalf("mempool is %d vbytes over its limit", m.VSize())
+	}
+}
+
+func TestMatchShortIDs(t *testing.T) {
+	m := New(0, 0)
+	plain := spend([]message.OutPoint{confirmed(1)}, 1000)
+	witness := spend([]message.OutPoint{confirmed(2)}, 1000)
+	witness.TxIn[0].Witness = [][]byte{{1, 2, 3}}
+	m.Add(plain)
+	m.Add(witness)
+
+	// Short ids are of the wtxid, so the txid of a witness transaction does not match
+	const k0, k1 = 0x0706050403020100, 0x0f0e0d0c0b0a0908
+	ids := map[uint64]int{
+		message.ShortID(k0, k1, plain.WTxID()):  4,
+		message.ShortID(k0, k1, witness.TxID()): 5,
+	}
+	matched := map[int][32]byte{}
+	m.MatchShortIDs(k0, k1, ids, func(pos int, tx message.Tx) {
+		matched[pos] = tx.TxID()
+	})
+	if len(matched) != 1 || matched[4] != plain.TxID() {
+		t.Fatalf("got matches %v, want only the plain transaction at 4", matched)
+	}
+
+	ids[message.ShortID(k0, k1, witness.WTxID())] = 6
+	matched = map[int][32]byte{}
+	m.MatchShortIDs(k0, k1, ids, func(pos int, tx message.Tx) {
+		matched[pos] = tx.TxID()
+	})
+	if len(matched) != 2 || matched[6] != witness.TxID() {
+		t.Fatalf("witness transaction not matched by wtxid: %v", matched)
+	}
+}
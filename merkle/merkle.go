@@ -0,0 +1,166 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package merkle
+
+import (
+	"errors"
+
+	"github.com/sanscentral/sansnetwork/typeconv"
+)
+
+var (
+	// ErrMutated is returned when a tree contains duplicated siblings (CVE-2012-2459)
+	ErrMutated = errors.New("merkle tree is mutated")
+
+	// ErrBadPartialTree is returned when a partial merkle tree cannot be decoded
+	ErrBadPartialTree = errors.New("invalid partial merkle tree")
+)
+
+// Most transactions a block can hold, its maximum weight over the weight of
+// the smallest transaction
+const maxBlockTransactions = 4000000 / 240
+
+// hashPair returns the parent hash of two nodes
+func hashPair(l, r [32]byte) [32]byte {
+	b := make([]byte, 0, 64)
+	b = append(b, l[:]...)
+	b = append(b, r[:]...)
+	return typeconv.DoubleHashFromBytes(b)
+}
+
+// WitnessCommitment returns the commitment a coinbase makes to the wtxids of
+// its block given the witness reserved value of its input (BIP0141)
+func WitnessCommitment(wtxids [][32]byte, reserved []byte) [32]byte {
+	root, _ := Root(wtxids)
+	return typeconv.DoubleHashFromBytes(append(root[:], reserved...))
+}
+
+// Root computes the merkle root of the given transaction hashes. It also
+// reports whether the tree was mutated by duplicating trailing hashes,
+// which would let a different transaction list produce the same root
+func Root(hashes [][32]byte) ([32]byte, bool) {
+	if len(hashes) == 0 {
+		return [32]byte{}, false
+	}
+	level := append([][32]byte{}, hashes...)
+	mutated := false
+	for len(level) > 1 {
+		next := make([][32]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				if level[i] == level[i+1] {
+					mutated = true
+				}
+				next = append(next, hashPair(level[i], level[i+1]))
+			} else {
+				next = append(next, hashPair(level[i], level[i]))
+			}
+		}
+		level = next
+	}
+	return level[0], mutated
+}
+
+// treeWidth returns the number of nodes at height in a tree of total leaves
+func treeWidth(total uint32, height uint) uint32 {
+	return (total + (1 << height) - 1) >> height
+}
+
+// partialTree walks a BIP0037 partial merkle tree
+type partialTree struct {
+	total   uint32
+	hashes  [][32]byte
+	flags   []byte
+	hashPos int
+	bitPos  int
+	matched [][32]byte
+	err     error
+}
+
+func (t *partialTree) bit() bool {
+	if t.bitPos >= len(t.flags)*8 {
+		t.err = ErrBadPartialTree
+		return false
+	}
+	b := t.flags[t.bitPos/8]&(1<<uint(t.bitPos%8)) != 0
+	t.bitPos++
+	return b
+}
+
+func (t *partialTree) hash() [32]byte {
+	if t.hashPos >= len(t.hashes) {
+		t.err = ErrBadPartialTree
+		return [32]byte{}
+	}
+	h := t.hashes[t.hashPos]
+	t.hashPos++
+	return h
+}
+
+// walk computes the hash of the node at height and pos, depth first
+func (t *partialTree) walk(height uint, pos uint32) [32]byte {
+	parentOfMatch := t.bit()
+	if t.err != nil {
+		return [32]byte{}
+	}
+	if height == 0 || !parentOfMatch {
+		h := t.hash()
+		if height == 0 && parentOfMatch && t.err == nil {
+			t.matched = append(t.matched, h)
+		}
+		return h
+	}
+
+	left := t.walk(height-1, pos*2)
+	right := left
+	if pos*2+1 < treeWidth(t.total, height-1) {
+		right = t.walk(height-1, pos*2+1)
+		if right == left {
+			t.err = ErrMutated
+		}
+	}
+	return hashPair(left, right)
+}
+
+// ExtractMatches decodes a partial merkle tree of total transactions as sent in
+// a merkleblock, returning the merkle root it commits to and the matched
+// transaction hashes in block order. The caller must compare the root with
+// the block header
+func ExtractMatches(total uint32, hashes [][32]byte, flags []byte) ([32]byte, [][32]byte, error) {
+	if total == 0 || total > maxBlockTransactions || len(hashes) == 0 || uint32(len(hashes)) > total {
+		return [32]byte{}, nil, ErrBadPartialTree
+	}
+	if len(flags)*8 < len(hashes) {
+		return [32]byte{}, nil, ErrBadPartialTree
+	}
+
+	height := uint(0)
+	for treeWidth(total, height) > 1 {
+		height++
+	}
+
+	t := &partialTree{total: total, hashes: hashes, flags: flags}
+	root := t.walk(height, 0)
+	if t.err != nil {
+		return [32]byte{}, nil, t.err
+	}
+
+	// Every hash and all but the padding bits of the last flag byte must be consumed
+	if t.hashPos != len(hashes) || (t.bitPos+7)/8 != len(flags) {
+		return [32]byte{}, nil, ErrBadPartialTree
+	}
+	return root, t.matched, nil
+}
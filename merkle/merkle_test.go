@@ -0,0 +1,170 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package merkle
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// buildPartial builds the partial merkle tree of txids proving the
+// matched ones, as a node does when sending a merkleblock
+func buildPartial(txids [][32]byte, match []bool) ([][32]byte, []byte) {
+	total := uint32(len(txids))
+	height := uint(0)
+	for treeWidth(total, height) > 1 {
+		height++
+	}
+
+	var hashes [][32]byte
+	var bits []bool
+	var nodeHash func(height uint, pos uint32) [32]byte
+	nodeHash = func(height uint, pos uint32) [32]byte {
+		if height == 0 {
+			return txids[pos]
+		}
+		left := nodeHash(height-1, pos*2)
+		right := left
+		if pos*2+1 < treeWidth(total, height-1) {
+			right = nodeHash(height-1, pos*2+1)
+		}
+		return hashPair(left, right)
+	}
+	var build func(height uint, pos uint32)
+	build = func(height uint, pos uint32) {
+		parentOfMatch := false
+		for p := pos << height; p < (pos+1)<<height && p < total; p++ {
+			parentOfMatch = parentOfMatch || match[p]
+		}
+		bits = append(bits, parentOfMatch)
+		if height == 0 || !parentOfMatch {
+			hashes = append(hashes, nodeHash(height, pos))
+			return
+		}
+		build(height-1, pos*2)
+		if pos*2+1 < treeWidth(total, height-1) {
+			build(height-1, pos*2+1)
+		}
+	}
+	build(height, 0)
+
+	flags := make([]byte, (len(bits)+7)/8)
+	for i, b := range bits {
+		if b {
+			flags[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return hashes, flags
+}
+
+// testTxIDs returns n distinct hashes
+func testTxIDs(r *rand.Rand, n int) [][32]byte {
+	txids := make([][32]byte, n)
+	for i := range txids {
+		r.Read(txids[i][:])
+	}
+	return txids
+}
+
+func TestPartialTreeRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, n := range []int{1, 4, 7, 17, 56, 100, 127, 256, 312, 513, 1000, 4095} {
+		txids := testTxIDs(r, n)
+		root, _ := Root(txids)
+
+		// Match about 1 in 2^k transactions, from all of them to none
+		for k := uint(0); k < 12; k++ {
+			match := make([]bool, n)
+			want := [][32]byte{}
+			for i := range match {
+				match[i] = r.Intn(1<<k) == 0
+				if match[i] {
+					want = append(want, txids[i])
+				}
+			}
+
+			hashes, flags := buildPartial(txids, match)
+			got, matched, err := ExtractMatches(uint32(n), hashes, flags)
+			if err != nil {
+				t.Fatalf("%d transactions, 1 in %d matched: %v", n, 1<<k, err)
+			}
+			if got != root {
+				t.Fatalf("%d transactions, 1 in %d matched: wrong root", n, 1<<k)
+			}
+			if len(matched) != len(want) {
+				t.Fatalf("%d transactions: got %d matches, want %d", n, len(matched), len(want))
+			}
+			for i := range want {
+				if matched[i] != want[i] {
+					t.Fatalf("%d transactions: match %d differs", n, i)
+				}
+			}
+		}
+	}
+}
+
+func TestPartialTreeMutated(t *testing.T) {
+	// Duplicating the last transaction of an odd list gives the same root (CVE-2012-2459)
+	r := rand.New(rand.NewSource(2))
+	txids := testTxIDs(r, 3)
+	mutated := append(append([][32]byte{}, txids...), txids[2])
+	root, _ := Root(txids)
+	if mutatedRoot, isMutated := Root(mutated); mutatedRoot != root || !isMutated {
+		t.Fatal("duplicated transaction not detected by Root")
+	}
+
+	hashes, flags := buildPartial(mutated, []bool{false, false, true, true})
+	if _, _, err := ExtractMatches(4, hashes, flags); err != ErrMutated {
+		t.Fatalf("got %v, want ErrMutated", err)
+	}
+}
+
+func TestPartialTreeInvalid(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	txids := testTxIDs(r, 10)
+	match := make([]bool, 10)
+	match[3], match[7] = true, true
+	hashes, flags := buildPartial(txids, match)
+	if _, _, err := ExtractMatches(10, hashes, flags); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		total  uint32
+		hashes [][32]byte
+		flags  []byte
+	}{
+		{"leftover hash", 10, append(append([][32]byte{}, hashes...), [32]byte{1}), flags},
+		{"missing hash", 10, hashes[:len(hashes)-1], flags},
+		{"unconsumed flag byte", 10, hashes, append(append([]byte{}, flags...), 0)},
+		{"missing flag bits", 10, hashes, flags[:1]},
+		{"no transactions", 0, hashes, flags},
+		{"too many transactions", maxBlockTransactions + 1, hashes, flags},
+		{"more hashes than transactions", uint32(len(hashes) - 1), hashes, flags},
+		{"no hashes", 10, nil, flags},
+	}
+	for _, test := range tests {
+		if _, _, err := ExtractMatches(test.total, test.hashes, test.flags); err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+
+	// A huge transaction count with a single hash is otherwise a valid tree
+	if _, _, err := ExtractMatches(0xffffffff, [][32]byte{{1}}, []byte{0}); err == nil {
+		t.Error("tree of 2^32-1 transactions accepted")
+	}
+}
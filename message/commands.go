@@ -98,5 +98,53 @@ const (
 	// CommandFilterLoad is related to Bloom filtering of connections and is defined in BIP 0037
 	CommandFilterLoad = "filterload"
 
+	/****
+	* Compact block filter commands (BIP 0157)
+	*****/
+
+	// CommandGetCFilters requests compact filters for a range of blocks
+	CommandGetCFilters = "getcfilters"
+	// CommandCFilter is a compact filter for a single block, in response to CommandGetCFilters
+	CommandCFilter = "cfilter"
+	// CommandGetCFHeaders requests compact filter headers for a range of blocks
+	CommandGetCFHeaders = "getcfheaders"
+	// CommandCFHeaders returns filter hashes for a range of blocks, in response to CommandGetCFHeaders
+	CommandCFHeaders = "cfheaders"
+	// CommandGetCFCheckpt requests compact filter headers at every 1000th block
+	CommandGetCFCheckpt = "getcfcheckpt"
+	// CommandCFCheckpt returns filter header checkpoints, in response to CommandGetCFCheckpt
+	CommandCFCheckpt = "cfcheckpt"
+
+	/****
+	* Feature negotiation commands, sent between version and verack
+	*****/
+
+	// CommandWtxidRelay announces transactions will be relayed by wtxid (BIP 0339)
+	CommandWtxidRelay = "wtxidrelay"
+	// CommandSendAddrV2 announces support for addrv2 address messages (BIP 0155)
+	CommandSendAddrV2 = "sendaddrv2"
+
+	/****
+	* Address relay commands
+	*****/
+
+	// CommandAddr relays addresses of known nodes
+	CommandAddr = "addr"
+	// CommandAddrV2 relays addresses of known nodes in the extended format (BIP 0155)
+	CommandAddrV2 = "addrv2"
+
+	/****
+	* Compact block relay commands (BIP 0152)
+	*****/
+
+	// CommandSendCmpct announces support for compact blocks and selects high or low bandwidth relay
+	CommandSendCmpct = "sendcmpct"
+	// CommandCmpctBlock is a block with transactions abbreviated to short ids
+	CommandCmpctBlock = "cmpctblock"
+	// CommandGetBlockTxn requests transactions from a compact block which could not be reconstructed
+	CommandGetBlockTxn = "getblocktxn"
+	// CommandBlockTxn returns transactions from a block, in response to CommandGetBlockTxn
+	CommandBlockTxn = "blocktxn"
+
 	// ***
 )
@@ -17,7 +17,7 @@ package message
 
 import (
 	"errors"
-	"net"
+	"io"
 
 	"github.com/sanscentral/sansnetwork/typeconv"
 )
@@ -30,6 +30,9 @@ const (
 	testnetMagicBytes = "\x0B\x11\x09\x07"
 
 	headerlen = 24
+
+	// MaxPayloadLength is the largest payload accepted in a single message
+	MaxPayloadLength = 32 * 1024 * 1024
 )
 
 // Header is structure of BTC message header
@@ -57,11 +60,17 @@ func MagicBytes(testnet bool) []byte {
 	return t
 }
 
-func (h *Header) verifyPayload(payload []byte) bool {
+// VerifyPayload returns true if payload matches the header checksum
+func (h *Header) VerifyPayload(payload []byte) bool {
 	chk := typeconv.CheckSumFromBytes(payload)
 	return h.Checksum == chk
 }
 
+// NewMessage creates a message with the given command and payload including header
+func NewMessage(command string, payload []byte, testnet bool) []byte {
+	return append(makeHeader(command, payload, testnet), payload...)
+}
+
 func makeHeader(command string, payload []byte, testnet bool) []byte {
 	cmd := typeconv.CommandFromBytes(command)
 	ln := typeconv.BytesFromUint32(uint32(len(payload)))
@@ -76,9 +85,9 @@ func makeHeader(command string, payload []byte, testnet bool) []byte {
 }
 
 // ReadHeader reads and parses header directly from TCP connection
-func ReadHeader(conn net.Conn) (Header, error) {
+func ReadHeader(conn io.Reader) (Header, error) {
 	responseHeader := make([]byte, headerlen)
-	_, err := conn.Read(responseHeader)
+	_, err := io.ReadFull(conn, responseHeader)
 	if err != nil {
 		return Header{}, err
 	}
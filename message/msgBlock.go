@@ -0,0 +1,121 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package message
+
+import (
+	"errors"
+
+	"github.com/sanscentral/sansnetwork/typeconv"
+)
+
+// BlockHeaderLength is the serialised length of a block header
+const BlockHeaderLength = 80
+
+// BlockHeader is a decoded 80 byte block header
+type BlockHeader struct {
+	Version    int32
+	PrevBlock  [32]byte
+	MerkleRoot [32]byte
+	Timestamp  uint32
+	Bits       uint32
+	Nonce      uint32
+}
+
+// Block is a decoded block with its transactions
+type Block struct {
+	Header BlockHeader
+	Tx     []Tx
+}
+
+// ParseBlockHeader decodes an 80 byte block header
+func ParseBlockHeader(b []byte) (BlockHeader, error) {
+	if len(b) < BlockHeaderLength {
+		return BlockHeader{}, errors.New(payloadLengthError)
+	}
+	r := newPayloadReader(b)
+	return parseBlockHeader(r), r.err
+}
+
+func parseBlockHeader(r *payloadReader) BlockHeader {
+	h := BlockHeader{}
+	h.Version = int32(r.uint32())
+	h.PrevBlock = r.hash()
+	h.MerkleRoot = r.hash()
+	h.Timestamp = r.uint32()
+	h.Bits = r.uint32()
+	h.Nonce = r.uint32()
+	return h
+}
+
+// Serialize encodes the block header
+func (h *BlockHeader) Serialize() []byte {
+	ver := typeconv.BytesFromInt32(h.Version)
+	ts := typeconv.BytesFromUint32(h.Timestamp)
+	bits := typeconv.BytesFromUint32(h.Bits)
+	nonce := typeconv.BytesFromUint32(h.Nonce)
+
+	b := make([]byte, 0, BlockHeaderLength)
+	b = append(b, ver[:]...)
+	b = append(b, h.PrevBlock[:]...)
+	b = append(b, h.MerkleRoot[:]...)
+	b = append(b, ts[:]...)
+	b = append(b, bits[:]...)
+	return append(b, nonce[:]...)
+}
+
+// BlockHash returns the hash identifying the block
+func (h *BlockHeader) BlockHash() [32]byte {
+	return typeconv.DoubleHashFromBytes(h.Serialize())
+}
+
+// ParseBlockPayload decodes a block payload with or without witness data
+func ParseBlockPayload(b []byte) (Block, error) {
+	r := newPayloadReader(b)
+	blk := Block{}
+	blk.Header = parseBlockHeader(r)
+	count := r.count(minTxInLen + minTxOutLen)
+	blk.Tx = make([]Tx, count)
+	for i := range blk.Tx {
+		blk.Tx[i] = parseTx(r)
+	}
+	if r.err != nil {
+		return Block{}, r.err
+	}
+	return blk, nil
+}
+
+// WTxIDs returns the wtxid of every transaction in the block in order, with
+// the coinbase as all zeros as the witness commitment requires (BIP0141)
+func (blk *Block) WTxIDs() [][32]byte {
+	ids := make([][32]byte, 0, len(blk.Tx))
+	for i := range blk.Tx {
+		if i == 0 {
+			ids = append(ids, [32]byte{})
+			continue
+		}
+		ids = append(ids, blk.Tx[i].WTxID())
+	}
+	return ids
+}
+
+// TxIDs returns the txid of every transaction in the block in order
+func (blk *Block) TxIDs() [][32]byte {
+	ids := make([][32]byte, 0, len(blk.Tx))
+	for i := range blk.Tx {
+		ids = append(ids, blk.Tx[i].TxID())
+	}
+	return ids
+}
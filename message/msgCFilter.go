@@ -0,0 +1,150 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package message
+
+import (
+	"github.com/sanscentral/sansnetwork/typeconv"
+)
+
+const (
+	// FilterTypeBasic is the basic compact filter type (BIP0158)
+	FilterTypeBasic uint8 = 0
+
+	// MaxCFiltersPerRequest is the most filters returned for a single getcfilters
+	MaxCFiltersPerRequest = 1000
+
+	// MaxCFHeadersPerRequest is the most filter hashes returned for a single getcfheaders
+	MaxCFHeadersPerRequest = 2000
+
+	// CFCheckptInterval is the block interval between filter header checkpoints
+	CFCheckptInterval = 1000
+)
+
+// CFilter is a decoded cfilter message
+type CFilter struct {
+	FilterType uint8
+	BlockHash  [32]byte
+	Filter     []byte
+}
+
+// CFHeaders is a decoded cfheaders message
+type CFHeaders struct {
+	FilterType       uint8
+	StopHash         [32]byte
+	PrevFilterHeader [32]byte   // Filter header of the block before the range
+	FilterHashes     [][32]byte // Filter hash of each block in the range
+}
+
+// Headers returns the filter header of each block in the range
+func (h *CFHeaders) Headers() [][32]byte {
+	res := make([][32]byte, 0, len(h.FilterHashes))
+	prev := h.PrevFilterHeader
+	for _, fh := range h.FilterHashes {
+		prev = FilterHeader(fh, prev)
+		res = append(res, prev)
+	}
+	return res
+}
+
+// CFCheckpt is a decoded cfcheckpt message
+type CFCheckpt struct {
+	FilterType    uint8
+	StopHash      [32]byte
+	FilterHeaders [][32]byte // Filter header at every CFCheckptInterval blocks up to StopHash
+}
+
+// FilterHeader chains a filter hash onto the previous filter header (BIP0157)
+func FilterHeader(filterHash, prevHeader [32]byte) [32]byte {
+	b := make([]byte, 0, 64)
+	b = append(b, filterHash[:]...)
+	b = append(b, prevHeader[:]...)
+	return typeconv.DoubleHashFromBytes(b)
+}
+
+// NewGetCFiltersMessage creates a 'getcfilters' message including header
+func NewGetCFiltersMessage(filterType uint8, startHeight uint32, stopHash [32]byte, testnet bool) []byte {
+	return newCFRangeMessage(CommandGetCFilters, filterType, startHeight, stopHash, testnet)
+}
+
+// NewGetCFHeadersMessage creates a 'getcfheaders' message including header
+func NewGetCFHeadersMessage(filterType uint8, startHeight uint32, stopHash [32]byte, testnet bool) []byte {
+	return newCFRangeMessage(CommandGetCFHeaders, filterType, startHeight, stopHash, testnet)
+}
+
+func newCFRangeMessage(command string, filterType uint8, startHeight uint32, stopHash [32]byte, testnet bool) []byte {
+	start := typeconv.BytesFromUint32(startHeight)
+	payload := []byte{filterType}
+	payload = append(payload, start[:]...)
+	payload = append(payload, stopHash[:]...)
+	header := makeHeader(command, payload, testnet)
+	return append(header, payload...)
+}
+
+// NewGetCFCheckptMessage creates a 'getcfcheckpt' message including header
+func NewGetCFCheckptMessage(filterType uint8, stopHash [32]byte, testnet bool) []byte {
+	payload := []byte{filterType}
+	payload = append(payload, stopHash[:]...)
+	header := makeHeader(CommandGetCFCheckpt, payload, testnet)
+	return append(header, payload...)
+}
+
+// ParseCFilterPayload decodes a cfilter payload
+func ParseCFilterPayload(b []byte) (CFilter, error) {
+	r := newPayloadReader(b)
+	n := CFilter{}
+	n.FilterType = r.uint8()
+	n.BlockHash = r.hash()
+	n.Filter = r.varBytes()
+	if r.err != nil {
+		return CFilter{}, r.err
+	}
+	return n, nil
+}
+
+// ParseCFHeadersPayload decodes a cfheaders payload
+func ParseCFHeadersPayload(b []byte) (CFHeaders, error) {
+	r := newPayloadReader(b)
+	n := CFHeaders{}
+	n.FilterType = r.uint8()
+	n.StopHash = r.hash()
+	n.PrevFilterHeader = r.hash()
+	count := r.count(32)
+	n.FilterHashes = make([][32]byte, count)
+	for i := range n.FilterHashes {
+		n.FilterHashes[i] = r.hash()
+	}
+	if r.err != nil {
+		return CFHeaders{}, r.err
+	}
+	return n, nil
+}
+
+// ParseCFCheckptPayload decodes a cfcheckpt payload
+func ParseCFCheckptPayload(b []byte) (CFCheckpt, error) {
+	r := newPayloadReader(b)
+	n := CFCheckpt{}
+	n.FilterType = r.uint8()
+	n.StopHash = r.hash()
+	count := r.count(32)
+	n.FilterHeaders = make([][32]byte, count)
+	for i := range n.FilterHeaders {
+		n.FilterHeaders[i] = r.hash()
+	}
+	if r.err != nil {
+		return CFCheckpt{}, r.err
+	}
+	return n, nil
+}
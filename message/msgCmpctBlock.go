@@ -0,0 +1,195 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package message
+
+import (
+	"crypto/sha256"
+	"errors"
+
+	"github.com/sanscentral/sansnetwork/siphash"
+	"github.com/sanscentral/sansnetwork/typeconv"
+)
+
+const (
+	// CompactBlocksVersion is the first protocol version supporting compact blocks (BIP0152)
+	CompactBlocksVersion = 70014
+
+	// CompactBlockWitnessVersion is the compact block version using wtxids for short ids
+	CompactBlockWitnessVersion uint64 = 2
+
+	// ShortIDLength is the length in bytes of a compact block short transaction id
+	ShortIDLength = 6
+)
+
+// ErrBadCompactIndex is returned for compact block transaction indexes which overflow the block
+var ErrBadCompactIndex = errors.New("Invalid compact block transaction index")
+
+// SendCmpct is a decoded sendcmpct message
+type SendCmpct struct {
+	HighBandwidth bool // Announce new blocks with cmpctblock before validating them
+	Version       uint64
+}
+
+// PrefilledTx is a transaction sent in full within a compact block
+type PrefilledTx struct {
+	Index int // Absolute position in the block
+	Tx    Tx
+}
+
+// CmpctBlock is a decoded cmpctblock message
+type CmpctBlock struct {
+	Header       BlockHeader
+	Nonce        uint64
+	ShortIDs     []uint64
+	PrefilledTxs []PrefilledTx
+}
+
+// GetBlockTxn is a decoded getblocktxn message
+type GetBlockTxn struct {
+	BlockHash [32]byte
+	Indexes   []int // Absolute positions in the block
+}
+
+// BlockTxn is a decoded blocktxn message
+type BlockTxn struct {
+	BlockHash [32]byte
+	Tx        []Tx
+}
+
+// NewSendCmpctMessage creates a 'sendcmpct' message including header
+func NewSendCmpctMessage(highBandwidth bool, version uint64, testnet bool) []byte {
+	payload := []byte{0}
+	if highBandwidth {
+		payload[0] = 1
+	}
+	v := typeconv.BytesFromUint64(version)
+	payload = append(payload, v[:]...)
+	header := makeHeader(CommandSendCmpct, payload, testnet)
+	return append(header, payload...)
+}
+
+// ParseSendCmpctPayload decodes a sendcmpct payload
+func ParseSendCmpctPayload(b []byte) (SendCmpct, error) {
+	r := newPayloadReader(b)
+	n := SendCmpct{}
+	n.HighBandwidth = r.uint8() == 1
+	n.Version = r.uint64()
+	if r.err != nil {
+		return SendCmpct{}, r.err
+	}
+	return n, nil
+}
+
+// ParseCmpctBlockPayload decodes a cmpctblock payload
+func ParseCmpctBlockPayload(b []byte) (CmpctBlock, error) {
+	r := newPayloadReader(b)
+	n := CmpctBlock{}
+	n.Header = parseBlockHeader(r)
+	n.Nonce = r.uint64()
+
+	count := r.count(ShortIDLength)
+	n.ShortIDs = make([]uint64, count)
+	for i := range n.ShortIDs {
+		id := r.next(ShortIDLength)
+		for j := ShortIDLength - 1; j >= 0; j-- {
+			n.ShortIDs[i] = n.ShortIDs[i]<<8 | uint64(id[j])
+		}
+	}
+
+	count = r.count(1 + minTxInLen + minTxOutLen)
+	n.PrefilledTxs = make([]PrefilledTx, count)
+	index := -1
+	for i := range n.PrefilledTxs {
+		index += int(r.varInt()) + 1
+		if r.err == nil && (index < 0 || index >= len(n.ShortIDs)+len(n.PrefilledTxs)) {
+			return CmpctBlock{}, ErrBadCompactIndex
+		}
+		n.PrefilledTxs[i] = PrefilledTx{Index: index, Tx: parseTx(r)}
+	}
+	if r.err != nil {
+		return CmpctBlock{}, r.err
+	}
+	return n, nil
+}
+
+// TxCount returns the number of transactions in the block
+func (b *CmpctBlock) TxCount() int {
+	return len(b.ShortIDs) + len(b.PrefilledTxs)
+}
+
+// ShortIDKey returns the SipHash key used for the block's short ids
+func (b *CmpctBlock) ShortIDKey() (k0, k1 uint64) {
+	nonce := typeconv.BytesFromUint64(b.Nonce)
+	h := sha256.Sum256(append(b.Header.Serialize(), nonce[:]...))
+	return siphash.KeyFromBytes(h[:16])
+}
+
+// ShortID returns the short id of the transaction with the given wtxid
+// (or txid for compact block version 1) under the key from ShortIDKey
+func ShortID(k0, k1 uint64, hash [32]byte) uint64 {
+	return siphash.Hash(k0, k1, hash[:]) & (1<<(8*ShortIDLength) - 1)
+}
+
+// NewGetBlockTxnMessage creates a 'getblocktxn' message requesting the
+// transactions at the given ascending positions in the block
+func NewGetBlockTxnMessage(blockHash [32]byte, indexes []int, testnet bool) []byte {
+	payload := append([]byte{}, blockHash[:]...)
+	payload = append(payload, typeconv.BytesFromVarInt(uint64(len(indexes)))...)
+	prev := -1
+	for _, i := range indexes {
+		payload = append(payload, typeconv.BytesFromVarInt(uint64(i-prev-1))...)
+		prev = i
+	}
+	header := makeHeader(CommandGetBlockTxn, payload, testnet)
+	return append(header, payload...)
+}
+
+// ParseGetBlockTxnPayload decodes a getblocktxn payload
+func ParseGetBlockTxnPayload(b []byte) (GetBlockTxn, error) {
+	r := newPayloadReader(b)
+	n := GetBlockTxn{}
+	n.BlockHash = r.hash()
+	count := r.count(1)
+	n.Indexes = make([]int, count)
+	index := -1
+	for i := range n.Indexes {
+		index += int(r.varInt()) + 1
+		if r.err == nil && index < 0 {
+			return GetBlockTxn{}, ErrBadCompactIndex
+		}
+		n.Indexes[i] = index
+	}
+	if r.err != nil {
+		return GetBlockTxn{}, r.err
+	}
+	return n, nil
+}
+
+// ParseBlockTxnPayload decodes a blocktxn payload
+func ParseBlockTxnPayload(b []byte) (BlockTxn, error) {
+	r := newPayloadReader(b)
+	n := BlockTxn{}
+	n.BlockHash = r.hash()
+	count := r.count(minTxInLen + minTxOutLen)
+	n.Tx = make([]Tx, count)
+	for i := range n.Tx {
+		n.Tx[i] = parseTx(r)
+	}
+	if r.err != nil {
+		return BlockTxn{}, r.err
+	}
+	return n, nil
+}
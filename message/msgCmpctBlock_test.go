@@ -0,0 +1,51 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package message
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+)
+
+func TestShortID(t *testing.T) {
+	// SipHash-2-4 of the 32 bytes 00 01 .. 1f under the key 00 01 .. 0f
+	// is 7127512f72f27cce, short ids are its low 6 bytes
+	var hash [32]byte
+	for i := range hash {
+		hash[i] = byte(i)
+	}
+	k0, k1 := uint64(0x0706050403020100), uint64(0x0f0e0d0c0b0a0908)
+	if got := ShortID(k0, k1, hash); got != 0x512f72f27cce {
+		t.Fatalf("short id %012x, want 512f72f27cce", got)
+	}
+}
+
+func TestShortIDKey(t *testing.T) {
+	cb := CmpctBlock{
+		Header: BlockHeader{Version: 2, PrevBlock: [32]byte{1}, MerkleRoot: [32]byte{2}, Timestamp: 3, Bits: 4, Nonce: 5},
+		Nonce:  0x0102030405060708,
+	}
+
+	// The key is the first 16 bytes of a single SHA256 of the header and nonce
+	b := cb.Header.Serialize()
+	b = append(b, 8, 7, 6, 5, 4, 3, 2, 1)
+	h := sha256.Sum256(b)
+	k0, k1 := cb.ShortIDKey()
+	if k0 != binary.LittleEndian.Uint64(h[:8]) || k1 != binary.LittleEndian.Uint64(h[8:16]) {
+		t.Fatalf("key %016x %016x from header hash %x", k0, k1, h)
+	}
+}
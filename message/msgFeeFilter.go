@@ -0,0 +1,45 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package message
+
+import (
+	"errors"
+
+	"github.com/sanscentral/sansnetwork/typeconv"
+)
+
+// FeeFilterVersion is the first protocol version supporting feefilter (BIP0133)
+const FeeFilterVersion = 70013
+
+// NewFeeFilterMessage creates a 'feefilter' message asking the node not to
+// announce transactions paying less than feeRate satoshis per kilobyte
+func NewFeeFilterMessage(feeRate int64, testnet bool) []byte {
+	payload := typeconv.BytesFromInt64(feeRate)
+	header := makeHeader(CommandFeeFilter, payload[:], testnet)
+	return append(header, payload[:]...)
+}
+
+// ReadFeeFilterPayload returns the fee rate in satoshis per kilobyte for given feefilter
+func ReadFeeFilterPayload(b []byte) (int64, error) {
+	if len(b) != 8 {
+		return 0, errors.New(payloadLengthError)
+	}
+	feeRate := int64(typeconv.Uint64FromBytes(b))
+	if feeRate < 0 {
+		return 0, errors.New("Invalid fee filter")
+	}
+	return feeRate, nil
+}
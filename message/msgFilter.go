@@ -0,0 +1,45 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package message
+
+import (
+	"github.com/sanscentral/sansnetwork/typeconv"
+)
+
+// NewFilterLoadMessage creates a 'filterload' message (BIP0037) including header
+func NewFilterLoadMessage(filter []byte, hashFuncs uint32, tweak uint32, flags uint8, testnet bool) []byte {
+	funcs := typeconv.BytesFromUint32(hashFuncs)
+	twk := typeconv.BytesFromUint32(tweak)
+
+	payload := typeconv.BytesFromVarString(filter)
+	payload = append(payload, funcs[:]...)
+	payload = append(payload, twk[:]...)
+	payload = append(payload, flags)
+	header := makeHeader(CommandFilterLoad, payload, testnet)
+	return append(header, payload...)
+}
+
+// NewFilterAddMessage creates a 'filteradd' message (BIP0037) adding data to the loaded filter
+func NewFilterAddMessage(data []byte, testnet bool) []byte {
+	payload := typeconv.BytesFromVarString(data)
+	header := makeHeader(CommandFilterAdd, payload, testnet)
+	return append(header, payload...)
+}
+
+// NewFilterClearMessage creates a 'filterclear' message (BIP0037) removing the loaded filter
+func NewFilterClearMessage(testnet bool) []byte {
+	return makeHeader(CommandFilterClear, []byte(""), testnet)
+}
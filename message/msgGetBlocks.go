@@ -0,0 +1,26 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package message
+
+// MaxBlocksResults is the most block hashes announced in reply to a single getblocks
+const MaxBlocksResults = 500
+
+// NewGetBlocksMessage creates a 'getblocks' message asking the node to announce
+// with inv the blocks following the first locator hash it knows, up to but
+// excluding stopHash or MaxBlocksResults blocks
+func NewGetBlocksMessage(locator [][32]byte, stopHash [32]byte, testnet bool) []byte {
+	return newLocatorMessage(CommandGetBlocks, locator, stopHash, testnet)
+}
@@ -0,0 +1,74 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package message
+
+import (
+	"github.com/sanscentral/sansnetwork/typeconv"
+)
+
+const (
+	// MaxHeadersResults is the most headers returned for a single getheaders
+	MaxHeadersResults = 2000
+
+	// MaxBlocksToAnnounce is the most headers a node sends unsolicited
+	// to announce new blocks, longer runs are announced with inv
+	MaxBlocksToAnnounce = 8
+)
+
+// NewGetHeadersMessage creates a 'getheaders' message asking for the headers
+// following the first locator hash the node knows, up to stopHash or
+// MaxHeadersResults. With no locator only the header of stopHash is returned
+func NewGetHeadersMessage(locator [][32]byte, stopHash [32]byte, testnet bool) []byte {
+	return newLocatorMessage(CommandGetHeaders, locator, stopHash, testnet)
+}
+
+func newLocatorMessage(command string, locator [][32]byte, stopHash [32]byte, testnet bool) []byte {
+	ver := typeconv.BytesFromUint32(protocolVersion)
+	payload := append([]byte{}, ver[:]...)
+	payload = append(payload, typeconv.BytesFromVarInt(uint64(len(locator)))...)
+	for _, h := range locator {
+		payload = append(payload, h[:]...)
+	}
+	payload = append(payload, stopHash[:]...)
+	header := makeHeader(command, payload, testnet)
+	return append(header, payload...)
+}
+
+// NewHeadersMessage creates a 'headers' message
+func NewHeadersMessage(headers []BlockHeader, testnet bool) []byte {
+	payload := typeconv.BytesFromVarInt(uint64(len(headers)))
+	for i := range headers {
+		payload = append(payload, headers[i].Serialize()...)
+		payload = append(payload, 0) // Transaction count, always zero
+	}
+	header := makeHeader(CommandHeaders, payload, testnet)
+	return append(header, payload...)
+}
+
+// ParseHeadersPayload decodes a headers payload
+func ParseHeadersPayload(b []byte) ([]BlockHeader, error) {
+	r := newPayloadReader(b)
+	count := r.count(BlockHeaderLength + 1)
+	headers := make([]BlockHeader, count)
+	for i := range headers {
+		headers[i] = parseBlockHeader(r)
+		r.varInt()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return headers, nil
+}
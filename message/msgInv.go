@@ -24,28 +24,61 @@ import (
 
 const (
 	entryLen = 36
-	typeLen  = 4
-	countlen = 1
+
+	// MaxInventoryEntries is the most entries allowed in a single inv, getdata or notfound message
+	MaxInventoryEntries = 50000
 )
 
-// ParseInventoryPayload parses byte payload into inventory structure
+// ParseInventoryPayload parses byte payload into inventory structure,
+// getdata and notfound payloads share the same structure
 func ParseInventoryPayload(b []byte) (inventory.Item, error) {
 	n := inventory.Item{}
 	n.Entry = []inventory.Entry{}
-	n.Count = typeconv.Uint8FromBytes(b[:countlen])
+	r := newPayloadReader(b)
+	count := r.count(entryLen)
+	if r.err != nil {
+		return n, errors.New("invalid inv payload length")
+	}
+	if count > MaxInventoryEntries {
+		return n, errors.New("too many inv entries")
+	}
+	n.Count = uint64(count)
 
-	for index := 0; index < int(n.Count); index++ {
-		s := (entryLen * index) + countlen
-		bytes := b[s:(s + typeLen)]
+	for index := 0; index < count; index++ {
 		new := inventory.Entry{}
-		e := (s + entryLen)
-		new.Type = typeconv.Uint32FromBytes(bytes)
-		if len(b) < e {
-			return n, errors.New("invalid inv payload length")
-		}
-		copy(new.Hash[:], b[(s+typeLen):e])
+		new.Type = inventory.Type(r.uint32())
+		new.Hash = r.hash()
 		n.Entry = append(n.Entry, new)
 	}
+	if r.err != nil {
+		return n, errors.New("invalid inv payload length")
+	}
 
 	return n, nil
 }
+
+// NewInventoryMessage creates an 'inv' message announcing entries including header
+func NewInventoryMessage(entries []inventory.Entry, testnet bool) []byte {
+	return newInventoryMessage(CommandInventory, entries, testnet)
+}
+
+// NewGetDataMessage creates a 'getdata' message requesting entries including header
+func NewGetDataMessage(entries []inventory.Entry, testnet bool) []byte {
+	return newInventoryMessage(CommandGetData, entries, testnet)
+}
+
+// NewNotFoundMessage creates a 'notfound' message for entries which cannot be served including header
+func NewNotFoundMessage(entries []inventory.Entry, testnet bool) []byte {
+	return newInventoryMessage(CommandNotFound, entries, testnet)
+}
+
+func newInventoryMessage(command string, entries []inventory.Entry, testnet bool) []byte {
+	payload := typeconv.BytesFromVarInt(uint64(len(entries)))
+	for _, e := range entries {
+		t := typeconv.BytesFromUint32(uint32(e.Type))
+		payload = append(payload, t[:]...)
+		payload = append(payload, e.Hash[:]...)
+	}
+	header := makeHeader(command, payload, testnet)
+	return append(header, payload...)
+}
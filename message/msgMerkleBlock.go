@@ -0,0 +1,42 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package message
+
+// MerkleBlock is a decoded merkleblock message (BIP0037)
+type MerkleBlock struct {
+	Header       BlockHeader
+	Transactions uint32     // Number of transactions in the full block
+	Hashes       [][32]byte // Partial merkle tree hashes in depth first order
+	Flags        []byte     // Partial merkle tree flag bits
+}
+
+// ParseMerkleBlockPayload decodes a merkleblock payload
+func ParseMerkleBlockPayload(b []byte) (MerkleBlock, error) {
+	r := newPayloadReader(b)
+	mb := MerkleBlock{}
+	mb.Header = parseBlockHeader(r)
+	mb.Transactions = r.uint32()
+	count := r.count(32)
+	mb.Hashes = make([][32]byte, count)
+	for i := range mb.Hashes {
+		mb.Hashes[i] = r.hash()
+	}
+	mb.Flags = r.varBytes()
+	if r.err != nil {
+		return MerkleBlock{}, r.err
+	}
+	return mb, nil
+}
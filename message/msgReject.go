@@ -0,0 +1,120 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package message
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sanscentral/sansnetwork/typeconv"
+)
+
+// RejectCode is the reason code of a reject message
+type RejectCode uint8
+
+const (
+	// RejectMalformed is sent for messages which could not be decoded
+	RejectMalformed RejectCode = 0x01
+
+	// RejectInvalid is sent for transactions or blocks failing consensus rules
+	RejectInvalid RejectCode = 0x10
+
+	// RejectObsolete is sent for messages using an obsolete version
+	RejectObsolete RejectCode = 0x11
+
+	// RejectDuplicate is sent for transactions or blocks already known
+	RejectDuplicate RejectCode = 0x12
+
+	// RejectNonstandard is sent for transactions failing standardness policy
+	RejectNonstandard RejectCode = 0x40
+
+	// RejectDust is sent for transactions with outputs below the dust limit
+	RejectDust RejectCode = 0x41
+
+	// RejectInsufficientFee is sent for transactions paying too little fee
+	RejectInsufficientFee RejectCode = 0x42
+
+	// RejectCheckpoint is sent for blocks conflicting with a checkpoint
+	RejectCheckpoint RejectCode = 0x43
+)
+
+var rejectCodeNames = map[RejectCode]string{
+	RejectMalformed:       "malformed",
+	RejectInvalid:         "invalid",
+	RejectObsolete:        "obsolete",
+	RejectDuplicate:       "duplicate",
+	RejectNonstandard:     "nonstandard",
+	RejectDust:            "dust",
+	RejectInsufficientFee: "insufficient fee",
+	RejectCheckpoint:      "checkpoint",
+}
+
+// String returns a readable name for the code
+func (c RejectCode) String() string {
+	if n, ok := rejectCodeNames[c]; ok {
+		return n
+	}
+	return fmt.Sprintf("unknown(0x%02x)", uint8(c))
+}
+
+// Reject is a decoded reject message
+type Reject struct {
+	Message string     // Command of the rejected message
+	Code    RejectCode // Reason code
+	Reason  string     // Human readable reason
+	Data    [32]byte   // Hash of the rejected transaction or block, if HasData
+	HasData bool
+}
+
+// Error describes the rejection
+func (r Reject) Error() string {
+	return fmt.Sprintf("%s rejected (%s): %s", r.Message, r.Code, r.Reason)
+}
+
+// ParseRejectPayload decodes a reject payload
+func ParseRejectPayload(b []byte) (Reject, error) {
+	r := newPayloadReader(b)
+	n := Reject{}
+	n.Message = string(r.varBytes())
+	n.Code = RejectCode(r.uint8())
+	n.Reason = string(r.varBytes())
+	if r.err != nil {
+		return Reject{}, r.err
+	}
+	// Only the hash of a rejected transaction or block may follow the reason
+	switch r.remaining() {
+	case 0:
+	case 32:
+		n.Data = r.hash()
+		n.HasData = true
+	default:
+		return Reject{}, errors.New(payloadLengthError)
+	}
+	return n, nil
+}
+
+// NewRejectMessage creates a 'reject' message including header,
+// the hash is included if rej.HasData
+func NewRejectMessage(rej Reject, testnet bool) []byte {
+	payload := typeconv.BytesFromVarString([]byte(rej.Message))
+	payload = append(payload, byte(rej.Code))
+	payload = append(payload, typeconv.BytesFromVarString([]byte(rej.Reason))...)
+	if rej.HasData {
+		payload = append(payload, rej.Data[:]...)
+	}
+	header := makeHeader(CommandReject, payload, testnet)
+	return append(header, payload...)
+}
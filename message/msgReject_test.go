@@ -0,0 +1,52 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package message
+
+import "testing"
+
+func TestRejectRoundTrip(t *testing.T) {
+	tests := []Reject{
+		{Message: CommandTx, Code: RejectDust, Reason: "dust", Data: [32]byte{1, 2, 3}, HasData: true},
+		{Message: CommandVersion, Code: RejectObsolete, Reason: "Version must be 31800 or greater"},
+		{Message: "", Code: RejectMalformed, Reason: ""},
+	}
+	for _, want := range tests {
+		msg := NewRejectMessage(want, false)
+		got, err := ParseRejectPayload(msg[HeaderLength():])
+		if err != nil {
+			t.Fatalf("%s: %v", want.Message, err)
+		}
+		if got != want {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestRejectPayloadLength(t *testing.T) {
+	rej := Reject{Message: CommandBlock, Code: RejectInvalid, Reason: "bad-txnmrklroot", Data: [32]byte{9}, HasData: true}
+	payload := NewRejectMessage(rej, false)[HeaderLength():]
+
+	// Only the full payload or the payload without the hash are valid
+	for n := 0; n < len(payload); n++ {
+		_, err := ParseRejectPayload(payload[:n])
+		if valid := n == len(payload)-32; valid != (err == nil) {
+			t.Fatalf("payload truncated to %d bytes: got error %v", n, err)
+		}
+	}
+	if _, err := ParseRejectPayload(append(append([]byte{}, payload...), 0)); err == nil {
+		t.Fatal("data after the hash accepted")
+	}
+}
@@ -16,17 +16,21 @@
 package message
 
 import (
-	"net"
+	"io"
 
 	"github.com/sanscentral/sansnetwork/typeconv"
 )
 
-// makeSendHeadersMessage
-func makeSendHeadersMessage(testnet bool) []byte {
+// SendHeadersVersion is the first protocol version supporting sendheaders (BIP0130)
+const SendHeadersVersion = 70012
+
+// NewSendHeadersMessage creates a 'sendheaders' message asking the node to
+// announce new blocks with their headers instead of inv (BIP0130)
+func NewSendHeadersMessage(testnet bool) []byte {
 	return makeHeader(CommandSendHeaders, []byte(""), testnet)
 }
 
-func readSendHeadersMessage(conn net.Conn) (bool, error) {
+func readSendHeadersMessage(conn io.Reader) (bool, error) {
 	h, err := ReadHeader(conn)
 	if err != nil {
 		return false, err
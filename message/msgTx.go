@@ -0,0 +1,202 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package message
+
+import (
+	"errors"
+
+	"github.com/sanscentral/sansnetwork/typeconv"
+)
+
+const (
+	witnessScaleFactor = 4
+	minTxInLen         = 41 // outpoint, empty script and sequence
+	minTxOutLen        = 9  // value and empty script
+)
+
+// OutPoint references a single output of a previous transaction
+type OutPoint struct {
+	Hash  [32]byte // txid of the previous transaction
+	Index uint32
+}
+
+// TxIn is a single transaction input
+type TxIn struct {
+	PreviousOutPoint OutPoint
+	SignatureScript  []byte
+	Witness          [][]byte
+	Sequence         uint32
+}
+
+// TxOut is a single transaction output
+type TxOut struct {
+	Value    int64 // Satoshis
+	PkScript []byte
+}
+
+// Tx is a decoded bitcoin transaction
+type Tx struct {
+	Version  int32
+	TxIn     []TxIn
+	TxOut    []TxOut
+	LockTime uint32
+	Full     []byte // Raw full payload bytes
+}
+
+// ParseTxPayload decodes a tx payload with or without witness data
+func ParseTxPayload(b []byte) (Tx, error) {
+	r := newPayloadReader(b)
+	tx := parseTx(r)
+	if r.err != nil {
+		return Tx{}, r.err
+	}
+	if r.remaining() != 0 {
+		return Tx{}, errors.New("Unexpected data after transaction")
+	}
+	return tx, nil
+}
+
+// parseTx decodes a single transaction from r, as used by tx and block payloads
+func parseTx(r *payloadReader) Tx {
+	start := r.pos
+	tx := Tx{}
+	tx.Version = int32(r.uint32())
+
+	// Segregated witness marker and flag (BIP0144)
+	witness := false
+	if r.remaining() >= 2 && r.b[r.pos] == 0x00 && r.b[r.pos+1] == 0x01 {
+		witness = true
+		r.next(2)
+	}
+
+	inCount := r.count(minTxInLen)
+	tx.TxIn = make([]TxIn, inCount)
+	for i := range tx.TxIn {
+		tx.TxIn[i].PreviousOutPoint.Hash = r.hash()
+		tx.TxIn[i].PreviousOutPoint.Index = r.uint32()
+		tx.TxIn[i].SignatureScript = r.varBytes()
+		tx.TxIn[i].Sequence = r.uint32()
+	}
+
+	outCount := r.count(minTxOutLen)
+	tx.TxOut = make([]TxOut, outCount)
+	for i := range tx.TxOut {
+		tx.TxOut[i].Value = int64(r.uint64())
+		tx.TxOut[i].PkScript = r.varBytes()
+	}
+
+	if witness {
+		for i := range tx.TxIn {
+			items := r.count(1)
+			tx.TxIn[i].Witness = make([][]byte, items)
+			for j := range tx.TxIn[i].Witness {
+				tx.TxIn[i].Witness[j] = r.varBytes()
+			}
+		}
+	}
+
+	tx.LockTime = r.uint32()
+	if r.err == nil {
+		tx.Full = r.b[start:r.pos]
+	}
+	return tx
+}
+
+// HasWitness returns true if any input carries witness data
+func (tx *Tx) HasWitness() bool {
+	for _, in := range tx.TxIn {
+		if len(in.Witness) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Serialize encodes the transaction, including witness data if witness is true
+func (tx *Tx) Serialize(witness bool) []byte {
+	witness = witness && tx.HasWitness()
+	ver := typeconv.BytesFromInt32(tx.Version)
+	b := append([]byte{}, ver[:]...)
+	if witness {
+		b = append(b, 0x00, 0x01)
+	}
+
+	b = append(b, typeconv.BytesFromVarInt(uint64(len(tx.TxIn)))...)
+	for _, in := range tx.TxIn {
+		idx := typeconv.BytesFromUint32(in.PreviousOutPoint.Index)
+		seq := typeconv.BytesFromUint32(in.Sequence)
+		b = append(b, in.PreviousOutPoint.Hash[:]...)
+		b = append(b, idx[:]...)
+		b = append(b, typeconv.BytesFromVarString(in.SignatureScript)...)
+		b = append(b, seq[:]...)
+	}
+
+	b = append(b, typeconv.BytesFromVarInt(uint64(len(tx.TxOut)))...)
+	for _, out := range tx.TxOut {
+		val := typeconv.BytesFromInt64(out.Value)
+		b = append(b, val[:]...)
+		b = append(b, typeconv.BytesFromVarString(out.PkScript)...)
+	}
+
+	if witness {
+		for _, in := range tx.TxIn {
+			b = append(b, typeconv.BytesFromVarInt(uint64(len(in.Witness)))...)
+			for _, item := range in.Witness {
+				b = append(b, typeconv.BytesFromVarString(item)...)
+			}
+		}
+	}
+
+	lt := typeconv.BytesFromUint32(tx.LockTime)
+	return append(b, lt[:]...)
+}
+
+// TxID returns the transaction hash excluding witness data
+func (tx *Tx) TxID() [32]byte {
+	return typeconv.DoubleHashFromBytes(tx.Serialize(false))
+}
+
+// WTxID returns the transaction hash including witness data (BIP0141),
+// equal to TxID for transactions without witness data
+func (tx *Tx) WTxID() [32]byte {
+	return typeconv.DoubleHashFromBytes(tx.Serialize(true))
+}
+
+// Weight returns the transaction weight (BIP0141)
+func (tx *Tx) Weight() int {
+	base := len(tx.Serialize(false))
+	total := len(tx.Serialize(true))
+	return base*(witnessScaleFactor-1) + total
+}
+
+// VSize returns the virtual transaction size in vbytes (BIP0141)
+func (tx *Tx) VSize() int {
+	return (tx.Weight() + witnessScaleFactor - 1) / witnessScaleFactor
+}
+
+// IsCoinBase returns true if the transaction is a coinbase transaction
+func (tx *Tx) IsCoinBase() bool {
+	return len(tx.TxIn) == 1 && tx.TxIn[0].PreviousOutPoint.Index == 0xffffffff &&
+		tx.TxIn[0].PreviousOutPoint.Hash == [32]byte{}
+}
+
+// NewTxMessage creates a 'tx' message including header,
+// witness data is only included if witness is true
+func NewTxMessage(tx Tx, witness bool, testnet bool) []byte {
+	payload := tx.Serialize(witness)
+	header := makeHeader(CommandTx, payload, testnet)
+	return append(header, payload...)
+}
@@ -16,7 +16,7 @@
 package message
 
 import (
-	"net"
+	"io"
 
 	"github.com/sanscentral/sansnetwork/typeconv"
 )
@@ -27,7 +27,7 @@ func NewVerackMessage(testnet bool) []byte {
 }
 
 // ReadVerackMessage reads verack message directly from TCP connection
-func ReadVerackMessage(conn net.Conn) (bool, error) {
+func ReadVerackMessage(conn io.Reader) (bool, error) {
 	h, err := ReadHeader(conn)
 	if err != nil {
 		return false, err
@@ -17,7 +17,7 @@ package message
 
 import (
 	"errors"
-	"net"
+	"io"
 	"time"
 
 	"github.com/sanscentral/sansnetwork/seed"
@@ -25,7 +25,7 @@ import (
 )
 
 const (
-	protocolVersion    = 70015              // Bitcoin Core 0.13.2
+	protocolVersion    = 70016              // Bitcoin Core 0.21.0
 	services           = 0                  // No services supported on this node
 	ip                 = "::ffff:127.0.0.1" // always return loopback
 	nonce              = 0
@@ -56,10 +56,10 @@ type Version struct {
 var userAgent = []byte{00}
 
 // ReadVersionPayload reads and parses version payload directly from TCP connection
-func ReadVersionPayload(conn net.Conn, h Header) (Version, error) {
+func ReadVersionPayload(conn io.Reader, h Header) (Version, error) {
 	len := typeconv.Uint32FromBytes(h.PayloadLen[:])
 	vpl := make([]byte, len)
-	_, err := conn.Read(vpl)
+	_, err := io.ReadFull(conn, vpl)
 	if err != nil {
 		return Version{}, err
 	}
@@ -0,0 +1,109 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package message
+
+import (
+	"errors"
+
+	"github.com/sanscentral/sansnetwork/typeconv"
+)
+
+// errPayloadLength is returned when a payload ends before a field
+var errPayloadLength = errors.New(payloadLengthError)
+
+// payloadReader decodes consecutive fields from a payload,
+// remembering the first error so it can be checked once at the end
+type payloadReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func newPayloadReader(b []byte) *payloadReader {
+	return &payloadReader{b: b}
+}
+
+// next returns the next n bytes of the payload
+func (r *payloadReader) next(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	if n < 0 || len(r.b)-r.pos < n {
+		r.err = errPayloadLength
+		return make([]byte, n)
+	}
+	b := r.b[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *payloadReader) uint8() uint8 {
+	return r.next(1)[0]
+}
+
+func (r *payloadReader) uint16() uint16 {
+	b := r.next(2)
+	return uint16(b[0]) | uint16(b[1])<<8
+}
+
+func (r *payloadReader) uint32() uint32 {
+	return typeconv.Uint32FromBytes(r.next(4))
+}
+
+func (r *payloadReader) uint64() uint64 {
+	return typeconv.Uint64FromBytes(r.next(8))
+}
+
+func (r *payloadReader) hash() [32]byte {
+	h := [32]byte{}
+	copy(h[:], r.next(32))
+	return h
+}
+
+// varInt reads a variable length integer
+func (r *payloadReader) varInt() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n, err := typeconv.VarIntFromBytes(r.b[r.pos:])
+	if err != nil {
+		r.err = err
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+// count reads a variable length item count, failing if the remaining
+// payload cannot hold that many items of at least minSize bytes
+func (r *payloadReader) count(minSize int) int {
+	c := r.varInt()
+	if r.err == nil && c > uint64(r.remaining()/minSize) {
+		r.err = errPayloadLength
+		return 0
+	}
+	return int(c)
+}
+
+// varBytes reads a variable length byte string
+func (r *payloadReader) varBytes() []byte {
+	n := r.count(1)
+	return r.next(n)
+}
+
+func (r *payloadReader) remaining() int {
+	return len(r.b) - r.pos
+}
@@ -0,0 +1,65 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"errors"
+
+	"github.com/sanscentral/sansnetwork/message"
+)
+
+// ErrCompactBlocksNotSupported is returned when requesting compact blocks from a node without witness compact block support
+var ErrCompactBlocksNotSupported = errors.New("node does not support compact blocks")
+
+// CompactBlockVersion returns the highest compact block version the node
+// announced with sendcmpct, 0 if it has not announced compact block support
+func (n *Connection) CompactBlockVersion() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.cmpctVersion
+}
+
+// HighBandwidth reports whether the node was last asked to announce new blocks in high bandwidth mode
+func (n *Connection) HighBandwidth() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.cmpctHigh
+}
+
+// SendCmpct announces witness compact block support to the node. In high
+// bandwidth mode the node sends cmpctblock for new blocks without announcing
+// them first, otherwise it announces them and cmpctblock must be requested
+func (n *Connection) SendCmpct(highBandwidth bool) error {
+	if n.ProtocolVersion() < message.CompactBlocksVersion || !serviceSupported(n.services, ServiceWitness) {
+		return ErrCompactBlocksNotSupported
+	}
+	n.mu.Lock()
+	n.cmpctHigh = highBandwidth
+	n.mu.Unlock()
+	return n.QueueMessage(message.NewSendCmpctMessage(highBandwidth, message.CompactBlockWitnessVersion, n.testnet), nil)
+}
+
+// handleSendCmpct records the compact block versions supported by the node
+func (n *Connection) handleSendCmpct(sc message.SendCmpct) {
+	if sc.Version != 1 && sc.Version != message.CompactBlockWitnessVersion {
+		return
+	}
+	n.mu.Lock()
+	if sc.Version > n.cmpctVersion {
+		n.cmpctVersion = sc.Version
+	}
+	n.mu.Unlock()
+}
@@ -0,0 +1,215 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of events buffered for a channel subscriber before further events are dropped
+const subscriptionBufferLen = 1024
+
+// EventType identifies the kind of event published on a Bus
+type EventType int
+
+const (
+	// EventPeerConnected is published when a connection starts running
+	EventPeerConnected EventType = iota
+
+	// EventPeerDisconnected is published when a connection stops, Err holds the cause if any
+	EventPeerDisconnected
+
+	// EventVersionReceived is published with the version the peer sent during the handshake
+	EventVersionReceived
+
+	// EventMessage is published for every message received from the peer
+	EventMessage
+
+	// EventPingUpdated is published when a pong updates the measured round trip time
+	EventPingUpdated
+
+	// EventMisbehaviour is published when the peer sends something invalid, Err describes it
+	EventMisbehaviour
+
+	// EventReject is published when the peer rejects a message, Message holds a Rejection
+	EventReject
+
+	// EventFilteredBlock is published for a verified merkleblock once its matched
+	// transactions have been received, Message holds a FilteredBlock
+	EventFilteredBlock
+
+	// EventBlock is published for a complete block obtained through compact
+	// block relay, Message holds the message.Block
+	EventBlock
+
+	// EventNewBlock is published by a pool the first time a new block is
+	// announced by any of its nodes, Message holds the message.BlockHeader
+	// and Command the headers or cmpctblock command announcing it
+	EventNewBlock
+)
+
+// Event is a single connection or message event
+type Event struct {
+	Type    EventType
+	Peer    *Connection   // Originating peer
+	Command string        // Command of the received message (EventMessage, EventNewBlock)
+	Payload []byte        // Raw payload of the received message (EventMessage)
+	Message interface{}   // Decoded payload where the command is understood (EventMessage, EventVersionReceived, EventReject, EventFilteredBlock)
+	Ping    time.Duration // Round trip time (EventPingUpdated)
+	Err     error         // Cause (EventPeerDisconnected, EventMisbehaviour)
+}
+
+// EventHandler is type for event callbacks
+type EventHandler func(Event)
+
+// EventFilter selects which events a subscriber receives, nil matches all events
+type EventFilter func(Event) bool
+
+// ByType returns a filter matching events of the given types
+func ByType(types ...EventType) EventFilter {
+	return func(e Event) bool {
+		for _, t := range types {
+			if e.Type == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ByCommand returns a filter matching received messages with the given commands
+func ByCommand(cmds ...string) EventFilter {
+	return func(e Event) bool {
+		if e.Type != EventMessage {
+			return false
+		}
+		for _, c := range cmds {
+			if e.Command == c {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Bus delivers events to any number of independent subscribers
+type Bus struct {
+	mu   sync.RWMutex
+	subs []*Subscription
+}
+
+// Subscription is a registered subscriber of a Bus
+type Subscription struct {
+	dropped uint64 // Accessed atomically, first for 64 bit alignment
+	bus     *Bus
+	filter  EventFilter
+	handler EventHandler
+	quit    chan struct{}
+	once    sync.Once
+}
+
+// NewBus creates an empty event bus
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe calls h for every event matching f. Handlers are called
+// synchronously from the goroutine publishing the event, which may
+// be the reader of any connection, so they must not block for long
+func (b *Bus) Subscribe(f EventFilter, h EventHandler) *Subscription {
+	return b.register(&Subscription{bus: b, filter: f, handler: h, quit: make(chan struct{})})
+}
+
+// SubscribeChan sends every event matching f to ch in order. Events are handed
+// to a goroutine owned by the subscription so a slow reader of ch never blocks
+// the publisher. Up to subscriptionBufferLen events are buffered, further events
+// are dropped and counted by Dropped until the reader catches up
+func (b *Bus) SubscribeChan(f EventFilter, ch chan<- Event) *Subscription {
+	s := &Subscription{bus: b, filter: f, quit: make(chan struct{})}
+	pending := make(chan Event, subscriptionBufferLen)
+	s.handler = func(e Event) {
+		select {
+		case pending <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+	go func() {
+		for {
+			select {
+			case e := <-pending:
+				select {
+				case ch <- e:
+				case <-s.quit:
+					return
+				}
+			case <-s.quit:
+				return
+			}
+		}
+	}()
+	return b.register(s)
+}
+
+func (b *Bus) register(s *Subscription) *Subscription {
+	b.mu.Lock()
+	b.subs = append(b.subs, s)
+	b.mu.Unlock()
+	return s
+}
+
+// Dropped returns the number of events discarded because a channel
+// subscriber fell more than subscriptionBufferLen events behind
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Unsubscribe stops delivery of further events to this subscriber
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.bus.mu.Lock()
+		subs := make([]*Subscription, 0, len(s.bus.subs))
+		for _, e := range s.bus.subs {
+			if e != s {
+				subs = append(subs, e)
+			}
+		}
+		s.bus.subs = subs
+		s.bus.mu.Unlock()
+		close(s.quit)
+	})
+}
+
+// Publish delivers e to all matching subscribers in subscription order
+func (b *Bus) Publish(e Event) {
+	b.mu.RLock()
+	subs := b.subs
+	b.mu.RUnlock()
+
+	for _, s := range subs {
+		if s.filter != nil && !s.filter(e) {
+			continue
+		}
+		select {
+		case <-s.quit:
+			continue
+		default:
+		}
+		s.handler(e)
+	}
+}
@@ -0,0 +1,70 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubscribeChanDoesNotBlockPublisher(t *testing.T) {
+	b := NewBus()
+	ch := make(chan Event)
+	sub := b.SubscribeChan(nil, ch)
+	defer sub.Unsubscribe()
+
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < subscriptionBufferLen+10; i++ {
+			b.Publish(Event{Type: EventMessage, Ping: time.Duration(i)})
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish blocked on an unread channel subscriber")
+	}
+
+	// One event may already be held by the delivery goroutine
+	if d := sub.Dropped(); d < 9 || d > 10 {
+		t.Fatalf("dropped %d events, want 9 or 10", d)
+	}
+	for i := 0; i < subscriptionBufferLen; i++ {
+		e := <-ch
+		if e.Ping != time.Duration(i) {
+			t.Fatalf("event %d delivered out of order as %d", i, e.Ping)
+		}
+	}
+}
+
+func TestUnsubscribeStopsDelivery(t *testing.T) {
+	b := NewBus()
+	ch := make(chan Event, 1)
+	sub := b.SubscribeChan(ByType(EventPingUpdated), ch)
+	b.Publish(Event{Type: EventMessage})
+	b.Publish(Event{Type: EventPingUpdated})
+	if e := <-ch; e.Type != EventPingUpdated {
+		t.Fatalf("got event type %d", e.Type)
+	}
+	sub.Unsubscribe()
+	b.Publish(Event{Type: EventPingUpdated})
+	select {
+	case <-ch:
+		t.Fatal("event delivered after unsubscribe")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,88 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"errors"
+
+	"github.com/sanscentral/sansnetwork/bloom"
+	"github.com/sanscentral/sansnetwork/message"
+)
+
+var (
+	// ErrBloomNotSupported is returned when filtering a node which does not offer bloom filtering
+	ErrBloomNotSupported = errors.New("node does not support bloom filtering")
+
+	// ErrFilterTooLarge is returned when a filter or element exceeds the limits nodes accept
+	ErrFilterTooLarge = errors.New("filter exceeds size limits")
+)
+
+// LoadFilter sends f to the node with filterload (BIP0037). The node will
+// then only relay transactions matching the filter and serve filtered blocks
+func (n *Connection) LoadFilter(f *bloom.Filter) error {
+	if !serviceSupported(n.services, ServiceBloom) {
+		return ErrBloomNotSupported
+	}
+	data := f.Bytes()
+	if len(data) > bloom.MaxFilterSize || f.HashFuncs() > bloom.MaxHashFuncs {
+		return ErrFilterTooLarge
+	}
+	msg := message.NewFilterLoadMessage(data, f.HashFuncs(), f.Tweak(), uint8(f.Flags()), n.testnet)
+	if err := n.QueueMessage(msg, nil); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.filter = f
+	n.mu.Unlock()
+	return nil
+}
+
+// AddToFilter adds data to the filter loaded on the node with filteradd,
+// and to the local copy of the filter
+func (n *Connection) AddToFilter(data []byte) error {
+	if len(data) > bloom.MaxFilterAddSize {
+		return ErrFilterTooLarge
+	}
+	n.mu.Lock()
+	f := n.filter
+	n.mu.Unlock()
+	if f == nil {
+		return errors.New("no filter loaded")
+	}
+	if err := n.QueueMessage(message.NewFilterAddMessage(data, n.testnet), nil); err != nil {
+		return err
+	}
+	f.Add(data)
+	return nil
+}
+
+// ClearFilter removes the filter loaded on the node with filterclear
+func (n *Connection) ClearFilter() error {
+	if err := n.QueueMessage(message.NewFilterClearMessage(n.testnet), nil); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.filter = nil
+	n.mu.Unlock()
+	return nil
+}
+
+// Filter returns the filter loaded on the node, nil if none
+func (n *Connection) Filter() *bloom.Filter {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.filter
+}
@@ -0,0 +1,107 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"errors"
+
+	"github.com/sanscentral/sansnetwork/inventory"
+	"github.com/sanscentral/sansnetwork/merkle"
+	"github.com/sanscentral/sansnetwork/message"
+)
+
+// FilteredBlock is a verified merkleblock paired with the matched
+// transactions the node sent after it
+type FilteredBlock struct {
+	Header   message.BlockHeader
+	Hash     [32]byte
+	Proof    message.MerkleBlock // Partial merkle tree proving inclusion of Matched
+	Matched  [][32]byte          // txids matching the filter in block order
+	Tx       []message.Tx        // Matched transactions received, in the order received
+	Complete bool                // True if a transaction was received for every matched txid
+}
+
+// GetFilteredBlocks requests merkleblocks for the given block hashes, matched
+// against the loaded filter. Each is published as an EventFilteredBlock
+func (n *Connection) GetFilteredBlocks(hashes [][32]byte) error {
+	entries := make([]inventory.Entry, 0, len(hashes))
+	for _, h := range hashes {
+		entries = append(entries, inventory.Entry{Type: inventory.TypeFilteredBlock, Hash: h})
+	}
+	return n.QueueMessage(message.NewGetDataMessage(entries, n.testnet), nil)
+}
+
+// handleMerkleBlock verifies a merkleblock and waits for its matched transactions.
+// Only called from the reader goroutine
+func (n *Connection) handleMerkleBlock(payload []byte) (message.MerkleBlock, error) {
+	mb, err := message.ParseMerkleBlockPayload(payload)
+	if err != nil {
+		return mb, err
+	}
+	root, matched, err := merkle.ExtractMatches(mb.Transactions, mb.Hashes, mb.Flags)
+	if err != nil {
+		return mb, err
+	}
+	if root != mb.Header.MerkleRoot {
+		return mb, errors.New("merkleblock does not match merkle root")
+	}
+
+	n.pendingBlock = &FilteredBlock{
+		Header:  mb.Header,
+		Proof:   mb,
+		Hash:    mb.Header.BlockHash(),
+		Matched: matched,
+	}
+	n.pendingWant = map[[32]byte]bool{}
+	for _, h := range matched {
+		n.pendingWant[h] = true
+	}
+	if len(matched) == 0 {
+		n.flushFilteredBlock()
+	}
+	return mb, nil
+}
+
+// pairFilteredTx adds tx to the pending filtered block if it was matched.
+// Only called from the reader goroutine
+func (n *Connection) pairFilteredTx(tx message.Tx) {
+	if n.pendingBlock == nil {
+		return
+	}
+	txid := tx.TxID()
+	if !n.pendingWant[txid] {
+		return
+	}
+	delete(n.pendingWant, txid)
+	n.pendingBlock.Tx = append(n.pendingBlock.Tx, tx)
+	if len(n.pendingWant) == 0 {
+		n.flushFilteredBlock()
+	}
+}
+
+// flushFilteredBlock publishes the pending filtered block. Transactions the
+// node already announced are not resent, so blocks are also flushed incomplete
+// when any message other than a tx follows. Only called from the reader goroutine
+func (n *Connection) flushFilteredBlock() {
+	if n.pendingBlock == nil {
+		return
+	}
+	fb := *n.pendingBlock
+	fb.Complete = len(n.pendingWant) == 0
+	n.pendingBlock = nil
+	n.pendingWant = nil
+	n.publish(Event{Type: EventFilteredBlock, Message: fb})
+}
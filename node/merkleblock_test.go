@@ -0,0 +1,71 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/merkle"
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/typeconv"
+)
+
+// merkleBlockMessage returns a merkleblock for a block of two transactions
+// proving the second, and the header it is for
+func merkleBlockMessage(txids [2][32]byte) ([]byte, message.BlockHeader) {
+	root, _ := merkle.Root(txids[:])
+	header := message.BlockHeader{Version: 4, MerkleRoot: root, Timestamp: 1, Bits: 0x207fffff}
+	total := typeconv.BytesFromUint32(2)
+	payload := append(header.Serialize(), total[:]...)
+	payload = append(payload, typeconv.BytesFromVarInt(2)...)
+	payload = append(payload, txids[0][:]...)
+	payload = append(payload, txids[1][:]...)
+
+	// Root and second leaf are on the path to the match, the first leaf is not
+	payload = append(payload, typeconv.BytesFromVarString([]byte{0x05})...)
+	return message.NewMessage(message.CommandMerkleBlock, payload, false), header
+}
+
+func TestFilteredBlockFlushedWhenComplete(t *testing.T) {
+	a, b := pipePair(t)
+	blocks := make(chan Event, 1)
+	a.SubscribeChan(ByType(EventFilteredBlock), blocks)
+	stop := runPair(a, b)
+	defer stop()
+
+	in := []message.TxIn{{PreviousOutPoint: message.OutPoint{Hash: [32]byte{1}}}}
+	other := message.Tx{Version: 1, TxIn: in, TxOut: []message.TxOut{{Value: 1}}}
+	tx := message.Tx{Version: 1, TxIn: in, TxOut: []message.TxOut{{Value: 2}}}
+	msg, header := merkleBlockMessage([2][32]byte{other.TxID(), tx.TxID()})
+
+	// Queued together, as otherwise a ping may be sent in between
+	msg = append(msg, message.NewTxMessage(tx, false, false)...)
+	if err := b.QueueMessage(msg, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing follows the matched transaction, the block is delivered anyway
+	select {
+	case e := <-blocks:
+		fb := e.Message.(FilteredBlock)
+		if !fb.Complete || fb.Hash != header.BlockHash() || len(fb.Tx) != 1 || fb.Tx[0].TxID() != tx.TxID() {
+			t.Fatalf("got filtered block %+v", fb)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("filtered block not delivered after its last transaction")
+	}
+}
@@ -17,55 +17,137 @@ package node
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"math/rand"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/sanscentral/sansnetwork/bloom"
 	"github.com/sanscentral/sansnetwork/inventory"
 	"github.com/sanscentral/sansnetwork/message"
 	"github.com/sanscentral/sansnetwork/seed"
 	"github.com/sanscentral/sansnetwork/typeconv"
+	"github.com/sanscentral/sansnetwork/v2transport"
 )
 
 const (
 	initialConnectionTimeoutSec = 1
+	handshakeTimeoutSec         = 10
 	maxConnectionAttempts       = 10
 	pingDelaySec                = 5
 	nonceVal                    = 78
 )
 
+// ErrConnectionClosed is returned when using a connection which has been closed
+var ErrConnectionClosed = errors.New("connection closed")
+
+var (
+	loggerMu sync.Mutex
+	logger   *log.Logger
+)
+
+// SetLogger sets the logger connection attempts are reported to,
+// nil disables logging which is the default
+func SetLogger(l *log.Logger) {
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+	logger = l
+}
+
+func logf(format string, v ...interface{}) {
+	loggerMu.Lock()
+	l := logger
+	loggerMu.Unlock()
+	if l != nil {
+		l.Printf(format, v...)
+	}
+}
+
 // TODO: Import and export known nodes (Then use DNS only as fallback)
 
 var (
+	nodesMu    sync.Mutex
 	knownNodes []net.IP
 	inUseNodes []net.IP
 )
 
-// Connection is a single network node connection
+// Connection is a single network node connection.
+// Messages are read by a single reader goroutine and written by a single
+// writer goroutine fed from the prioritised sendQueue, mutable state is guarded by mu
 type Connection struct {
-	useragent    string
-	host         string
-	nonce        string
-	services     ServiceFlag // Bitfield for enabled services
-	conn         net.Conn
+	useragent  string
+	host       string
+	nonce      string
+	services   ServiceFlag // Bitfield for enabled services
+	conn       net.Conn
+	testnet    bool
+	endpoint   net.IP
+	version    message.Version
+	wtxidRelay bool              // Transactions are announced by wtxid (BIP0339)
+	timeOffset time.Duration     // Node clock minus ours when the version was received
+	v2         *v2transport.Conn // Encrypted transport, nil for v1
+	sendQueue  sendQueue
+	events     *Bus
+
+	mu           sync.Mutex
 	sendHeaders  bool
-	handling     bool
-	die          bool
+	feeFilter    int64
 	connected    bool
-	ping         int64
-	pendingPings map[uint64]int64
-	testnet      bool
-	endpoint     net.IP
+	running      bool
+	queueClosed  bool
+	ping         time.Duration
+	pendingPings map[uint64]time.Time
+	sent         []sentItem
+	filter       *bloom.Filter
+	cmpctVersion uint64 // Highest compact block version announced by the node
+	cmpctHigh    bool   // Node was asked to announce blocks in high bandwidth mode
+
+	// Owned by the reader goroutine
+	pendingBlock *FilteredBlock
+	pendingWant  map[[32]byte]bool
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Close single node connection, cancelling Run and waiting for it to return
+func (n *Connection) Close() error {
+	n.cancel()
+	err := n.closeConn()
+
+	n.mu.Lock()
+	running := n.running
+	n.mu.Unlock()
+	if running {
+		<-n.done
+	} else {
+		// Run will not start now, so fail anything queued before it
+		n.drainQueue()
+	}
+	return err
 }
 
-// Close single node connection
-func (n *Connection) Close() {
-	n.die = true
-	n.conn.Close()
-	n.connected = false
-	removeFromInUseNodes(n.endpoint)
+// closeConn closes the underlying network connection exactly once
+func (n *Connection) closeConn() error {
+	n.closeOnce.Do(func() {
+		n.closeErr = n.conn.Close()
+		n.mu.Lock()
+		n.connected = false
+		n.mu.Unlock()
+		if n.endpoint != nil {
+			removeFromInUseNodes(n.endpoint)
+		}
+	})
+	return n.closeErr
 }
 
 // UserAgent returns node useragent
@@ -73,250 +155,724 @@ func (n *Connection) UserAgent() string {
 	return n.useragent
 }
 
-// startHandling indicates that a node event is currently being handled
-func (n *Connection) startHandling() {
-	n.handling = true
+// Host returns the remote address of the node
+func (n *Connection) Host() string {
+	return n.host
 }
 
-// endHandling indicates that a node event has finished being handled
-func (n *Connection) endHandling() {
-	n.handling = false
+// Services returns the services advertised by the node
+func (n *Connection) Services() ServiceFlag {
+	return n.services
 }
 
-// startHeartBeat starts keep alive pings every X seconds
-func (n *Connection) startHeartBeat() {
-	n.performPing()
-	for range time.Tick(pingDelaySec * time.Second) {
-		if n.die {
-			break
-		}
-		n.performPing()
+// Version returns the version message the node sent during the handshake
+func (n *Connection) Version() message.Version {
+	return n.version
+}
+
+// Subscribe calls h for every event of this connection matching f
+func (n *Connection) Subscribe(f EventFilter, h EventHandler) *Subscription {
+	return n.events.Subscribe(f, h)
+}
+
+// SubscribeChan sends every event of this connection matching f to ch
+// without blocking the reader, see Bus.SubscribeChan
+func (n *Connection) SubscribeChan(f EventFilter, ch chan<- Event) *Subscription {
+	return n.events.SubscribeChan(f, ch)
+}
+
+// publish sends e from this connection to its subscribers
+func (n *Connection) publish(e Event) {
+	e.Peer = n
+	n.events.Publish(e)
+}
+
+// WTxIDRelay reports whether wtxid relay was negotiated with the node, in
+// which case it announces and requests transactions by wtxid (BIP0339)
+func (n *Connection) WTxIDRelay() bool {
+	return n.wtxidRelay
+}
+
+// TxEntry returns the inventory entry the node expects transactions to be announced with
+func (n *Connection) TxEntry(txid, wtxid [32]byte) inventory.Entry {
+	if n.wtxidRelay {
+		return inventory.Entry{Type: inventory.TypeWTX, Hash: wtxid}
+	}
+	return inventory.Entry{Type: inventory.TypeTx, Hash: txid}
+}
+
+// SessionID returns the v2 transport session id, which both sides may compare
+// to detect a man in the middle. ok is false for unencrypted v1 connections
+func (n *Connection) SessionID() (id [32]byte, ok bool) {
+	if n.v2 == nil {
+		return id, false
+	}
+	return n.v2.SessionID(), true
+}
+
+// ProtocolVersion returns the protocol version advertised by the node
+func (n *Connection) ProtocolVersion() int32 {
+	return int32(typeconv.Uint32FromBytes(n.version.Version[:]))
+}
+
+// TimeOffset returns how far the node's clock was ahead of ours when
+// it sent its version, to the second
+func (n *Connection) TimeOffset() time.Duration {
+	return n.timeOffset
+}
+
+// FeeFilter returns the minimum fee rate in satoshis per kilobyte of
+// transactions the node wants announced, 0 if it sent no feefilter
+func (n *Connection) FeeFilter() int64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.feeFilter
+}
+
+// SendFeeFilter asks the node not to announce transactions paying less
+// than feeRate satoshis per kilobyte (BIP0133)
+func (n *Connection) SendFeeFilter(feeRate int64) error {
+	if n.ProtocolVersion() < message.FeeFilterVersion {
+		return errors.New("node does not support feefilter")
+	}
+	return n.QueueMessage(message.NewFeeFilterMessage(feeRate, n.testnet), nil)
+}
+
+// Connected returns false once the connection has been closed
+func (n *Connection) Connected() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.connected
+}
+
+// Ping returns the most recently measured round trip time to the node
+func (n *Connection) Ping() time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ping
+}
+
+// SendHeaders returns true if the node asked for headers announcements
+func (n *Connection) SendHeaders() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.sendHeaders
+}
+
+// Run services the connection until ctx is cancelled, Close is called
+// or the node goes away. It returns the error that ended the connection,
+// or nil if it was closed by Close.
+func (n *Connection) Run(ctx context.Context) error {
+	n.mu.Lock()
+	if n.running || n.ctx.Err() != nil {
+		n.mu.Unlock()
+		return ErrConnectionClosed
 	}
+	n.running = true
+	n.mu.Unlock()
+	defer close(n.done)
+
+	// Ask for new blocks to be announced with their headers (BIP0130)
+	// Control messages only fail to queue once the connection is closing,
+	// which the loops below notice straight away
+	if n.ProtocolVersion() >= message.SendHeadersVersion {
+		n.QueueMessage(message.NewSendHeadersMessage(n.testnet), nil)
+	}
+
+	n.publish(Event{Type: EventPeerConnected})
+	n.publish(Event{Type: EventVersionReceived, Message: n.version})
+
+	var wg sync.WaitGroup
+	errc := make(chan error, 2)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		errc <- n.readLoop()
+	}()
+	go func() {
+		defer wg.Done()
+		errc <- n.writeLoop()
+	}()
+
+	var err error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-n.ctx.Done():
+	case err = <-errc:
+	}
+
+	// Unblock the reader and stop the writer
+	n.cancel()
+	n.closeConn()
+	wg.Wait()
+	n.publish(Event{Type: EventPeerDisconnected, Err: err})
+	return err
 }
 
-// performPing sends ping command to node
-func (n *Connection) performPing() {
-	if n.connected && !n.handling {
-		nonce := time.Now().UnixNano() + nonceVal
-		ping := message.NewPingMessage(uint64(nonce), n.testnet)
-		_, err := n.conn.Write(ping)
+// writeLoop is the only goroutine which writes to the node, it also
+// sends keep alive pings every X seconds
+func (n *Connection) writeLoop() error {
+	ticker := time.NewTicker(pingDelaySec * time.Second)
+	defer ticker.Stop()
+	defer n.drainQueue()
+
+	if err := n.write(n.newPing()); err != nil {
+		return n.connError(err)
+	}
+	for {
+		m, ok := n.sendQueue.next()
+		if !ok {
+			select {
+			case <-n.ctx.Done():
+				return nil
+			case <-ticker.C:
+				m.msg = n.newPing()
+			case m = <-n.sendQueue.control:
+			case m = <-n.sendQueue.normal:
+			case m = <-n.sendQueue.bulk:
+			}
+		}
+		// Record before writing as the node may reject it before write returns
+		n.recordSent(m.msg)
+		err := n.write(m.msg)
+		n.notify(m, err)
 		if err != nil {
-			n.Close()
-			n.connected = false
-			removeFromInUseNodes(n.endpoint)
+			return n.connError(err)
 		}
-		n.pendingPings[uint64(nonce)] = time.Now().UnixNano()
 	}
 }
 
+// write sends msg to the node within the write deadline, failures
+// caused by closing the connection are reported as ErrConnectionClosed
+func (n *Connection) write(msg []byte) error {
+	n.conn.SetWriteDeadline(time.Now().Add(writeTimeoutSec * time.Second))
+	_, err := n.conn.Write(msg)
+	if err != nil && n.ctx.Err() != nil {
+		return ErrConnectionClosed
+	}
+	return err
+}
+
+// newPing creates a ping message and records it as pending
+func (n *Connection) newPing() []byte {
+	now := time.Now()
+	nonce := uint64(now.UnixNano() + nonceVal)
+	n.mu.Lock()
+	n.pendingPings[nonce] = now
+	n.mu.Unlock()
+	return message.NewPingMessage(nonce, n.testnet)
+}
+
 // handle is the primay function for handling incoming node events
-func (n *Connection) handle(b []byte) {
-	n.startHandling()
-	defer n.endHandling()
-	if bytes.HasPrefix(b, message.MagicBytes(n.testnet)) {
-		h, err := message.ParseHeader(b)
-		var cmd string
-		var payload []byte
-		if err == nil {
-			cmd = typeconv.CleanStringFromBytes(h.Command[:])
-			payloadlength := typeconv.Uint32FromBytes(h.PayloadLen[:])
-			if payloadlength > 0 {
-				payload = make([]byte, payloadlength)
-				n.conn.Read(payload)
-			}
-		} else {
-			cmd = message.CommandError
-		}
+func (n *Connection) handle(h message.Header, payload []byte) {
+	cmd := typeconv.CleanStringFromBytes(h.Command[:])
 
-		fmt.Printf("Command: %s\n", h.Command)
-		//fmt.Printf("Payload: %v\n", payload)
+	e := Event{Type: EventMessage, Command: cmd, Payload: payload}
 
-		// Handle command and payloads for this node
-		switch cmd {
-		case message.CommandSendHeaders:
-			n.sendHeaders = true
-		case message.CommandInventory:
-			inv, _ := message.ParseInventoryPayload(payload)
-			if len(inv.Entry) > 0 {
-				inventory.CallHandler(inv.Entry)
-			}
-		case message.CommandPing:
-			// Respond to ping with pong
-			nonce := message.ReadPingPayload(payload)
-			ping := message.NewPongMessage(nonce, n.testnet)
-			n.conn.Write(ping)
-		case message.CommandPong:
-			// Recieved pong
-			nonce := message.ReadPongPayload(payload)
-			tm := ((time.Now().UnixNano() - n.pendingPings[nonce]) / int64(time.Millisecond))
+	// Transactions matching a merkleblock follow it immediately
+	if cmd != message.CommandTx {
+		n.flushFilteredBlock()
+	}
+
+	// Handle command and payloads for this node
+	switch cmd {
+	case message.CommandSendHeaders:
+		n.mu.Lock()
+		n.sendHeaders = true
+		n.mu.Unlock()
+	case message.CommandInventory:
+		inv, err := message.ParseInventoryPayload(payload)
+		if err != nil {
+			n.misbehaving(err)
+			return
+		}
+		e.Message = inv
+		if len(inv.Entry) > 0 {
+			inventory.CallHandler(inv.Entry)
+		}
+	case message.CommandHeaders:
+		headers, err := message.ParseHeadersPayload(payload)
+		if err != nil {
+			n.misbehaving(err)
+			return
+		}
+		e.Message = headers
+	case message.CommandPing:
+		// Respond to ping with pong
+		nonce := message.ReadPingPayload(payload)
+		e.Message = nonce
+		if err := n.QueueMessage(message.NewPongMessage(nonce, n.testnet), nil); err != nil {
+			// The connection is closing as the node stopped reading
+			return
+		}
+	case message.CommandPong:
+		// Recieved pong
+		nonce := message.ReadPongPayload(payload)
+		e.Message = nonce
+		n.mu.Lock()
+		sent, ok := n.pendingPings[nonce]
+		if ok {
 			delete(n.pendingPings, nonce)
-			n.ping = tm
-		case message.CommandError:
-			// Handle node error
+			n.ping = time.Since(sent)
+		}
+		ping := n.ping
+		n.mu.Unlock()
+		if ok {
+			n.publish(Event{Type: EventPingUpdated, Ping: ping})
+		}
+	case message.CommandFeeFilter:
+		feeRate, err := message.ReadFeeFilterPayload(payload)
+		if err != nil {
+			n.misbehaving(err)
+			return
+		}
+		e.Message = feeRate
+		n.mu.Lock()
+		n.feeFilter = feeRate
+		n.mu.Unlock()
+	case message.CommandMerkleBlock:
+		mb, err := n.handleMerkleBlock(payload)
+		if err != nil {
+			n.misbehaving(err)
+			return
 		}
+		e.Message = mb
+	case message.CommandTx:
+		tx, err := message.ParseTxPayload(payload)
+		if err != nil {
+			n.misbehaving(err)
+			return
+		}
+		e.Message = tx
+		defer n.pairFilteredTx(tx)
+	case message.CommandWtxidRelay, message.CommandSendAddrV2:
+		// Only valid before verack
+		n.misbehaving(fmt.Errorf("%s received after verack", cmd))
+		return
+	case message.CommandSendCmpct:
+		sc, err := message.ParseSendCmpctPayload(payload)
+		if err != nil {
+			n.misbehaving(err)
+			return
+		}
+		e.Message = sc
+		n.handleSendCmpct(sc)
+	case message.CommandCmpctBlock:
+		cb, err := message.ParseCmpctBlockPayload(payload)
+		if err != nil {
+			n.misbehaving(err)
+			return
+		}
+		e.Message = cb
+	case message.CommandBlockTxn:
+		bt, err := message.ParseBlockTxnPayload(payload)
+		if err != nil {
+			n.misbehaving(err)
+			return
+		}
+		e.Message = bt
+	case message.CommandCFilter:
+		cf, err := message.ParseCFilterPayload(payload)
+		if err != nil {
+			n.misbehaving(err)
+			return
+		}
+		e.Message = cf
+	case message.CommandCFHeaders:
+		cfh, err := message.ParseCFHeadersPayload(payload)
+		if err != nil {
+			n.misbehaving(err)
+			return
+		}
+		e.Message = cfh
+	case message.CommandCFCheckpt:
+		cfc, err := message.ParseCFCheckptPayload(payload)
+		if err != nil {
+			n.misbehaving(err)
+			return
+		}
+		e.Message = cfc
+	case message.CommandReject:
+		rej, err := message.ParseRejectPayload(payload)
+		if err != nil {
+			n.misbehaving(err)
+			return
+		}
+		e.Message = rej
+		n.publish(Event{Type: EventReject, Message: n.matchReject(rej)})
+	case message.CommandError:
+		// Handle node error
 	}
+	n.publish(e)
+}
+
+// misbehaving reports invalid data sent by the node
+func (n *Connection) misbehaving(err error) {
+	n.publish(Event{Type: EventMisbehaviour, Err: err})
+}
+
+// ReportMisbehaviour publishes an EventMisbehaviour for invalid data from
+// the node detected outside the connection, such as a lying filter
+func (n *Connection) ReportMisbehaviour(err error) {
+	n.misbehaving(err)
 }
 
-// listen starts listening to the node
-func (n *Connection) listen() {
+// readLoop is the only goroutine which reads from the node,
+// it runs until the connection is closed
+func (n *Connection) readLoop() error {
 	for {
-		if n.die {
-			break
-		}
-		if !n.handling {
-			response := make([]byte, message.HeaderLength())
-			n.conn.Read(response)
-			if len(response) != 0 {
-				n.handle(response)
+		h, err := message.ReadHeader(n.conn)
+		if err != nil {
+			return n.connError(err)
+		}
+		if !bytes.Equal(h.Start[:], message.MagicBytes(n.testnet)) {
+			err := errors.New("Unexpected message start bytes")
+			n.misbehaving(err)
+			return n.connError(err)
+		}
+
+		var payload []byte
+		payloadlength := typeconv.Uint32FromBytes(h.PayloadLen[:])
+		if payloadlength > message.MaxPayloadLength {
+			err := errors.New("Payload exceeds maximum length")
+			n.misbehaving(err)
+			return n.connError(err)
+		}
+		if payloadlength > 0 {
+			payload = make([]byte, payloadlength)
+			if _, err := io.ReadFull(n.conn, payload); err != nil {
+				return n.connError(err)
 			}
 		}
+		if !h.VerifyPayload(payload) {
+			n.misbehaving(errors.New("Invalid payload checksum"))
+			continue
+		}
+		n.handle(h, payload)
 	}
 }
 
-// NewConnection creates a single new node connection
-func NewConnection(testnet bool) (Connection, error) {
-	if len(knownNodes) == 0 {
+// connError hides errors caused by the connection being closed on purpose
+func (n *Connection) connError(err error) error {
+	if n.ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// NewConnection creates a single new node connection, ctx bounds
+// node discovery and the handshake. Call Run to start servicing it.
+func NewConnection(ctx context.Context, testnet bool) (*Connection, error) {
+	return NewConnectionWithServices(ctx, testnet, DefaultRequiredServices)
+}
+
+// NewConnectionWithServices is like NewConnection but only accepts full
+// witness nodes which also offer the required services
+func NewConnectionWithServices(ctx context.Context, testnet bool, required ServiceFlag) (*Connection, error) {
+	return NewConnectionWithOptions(ctx, testnet, Options{RequiredServices: required})
+}
+
+// Options configures which nodes NewConnectionWithOptions accepts and how it connects
+type Options struct {
+	RequiredServices ServiceFlag // In addition to being a full witness node
+	V2Transport      bool        // Try the v2 encrypted transport first, falling back to v1
+}
+
+// NewConnectionWithOptions is like NewConnection but configured by opts
+func NewConnectionWithOptions(ctx context.Context, testnet bool, opts Options) (*Connection, error) {
+	if len(getKnownNodes()) == 0 {
 		seeds, err := seed.GetNodeIPs(testnet)
 		if err != nil || len(seeds) == 0 {
-			return Connection{}, errors.New("Failed to find a node")
+			return nil, errors.New("Failed to find a node")
 		}
-		knownNodes = append(knownNodes, seeds...)
+		addKnownNodes(seeds)
 	}
 
 	s := rand.NewSource(time.Now().UnixNano())
 	attempts := 0
-	new := Connection{
-		testnet: testnet,
-	}
-	var conn net.Conn
-	var attemptedNode net.IP
+	dialer := net.Dialer{Timeout: initialConnectionTimeoutSec * time.Second}
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		aNodes := getAvailableNodes()
 		if len(aNodes) <= 0 {
 			//No nodes left
-			return Connection{}, errors.New("Failed to find a valid node")
+			return nil, errors.New("Failed to find a valid node")
 		}
 
 		r := rand.New(s)
-		attemptedNode = aNodes[r.Intn(len(aNodes))]
+		attemptedNode := aNodes[r.Intn(len(aNodes))]
 
 		port := seed.MainnetPort
 		if testnet {
 			port = seed.TestnetPort
 		}
 
-		serv := fmt.Sprintf("%s:%d", attemptedNode.String(), port)
-		var err error
+		serv := net.JoinHostPort(attemptedNode.String(), strconv.Itoa(port))
 
 		attempts++
 		if attempts >= maxConnectionAttempts {
-			return Connection{}, errors.New("Cannot connect to node exceeded max attempts")
+			return nil, errors.New("Cannot connect to node exceeded max attempts")
 		}
 
-		conn, err = net.DialTimeout("tcp", serv, initialConnectionTimeoutSec*time.Second)
+		conn, err := dialer.DialContext(ctx, "tcp", serv)
 		if err != nil {
 			removeFromKnownNodes(attemptedNode)
 			continue
 		}
 
-		// Send version
-		versionMsg := message.NewVersionMessage(testnet)
-		_, err = conn.Write(versionMsg)
-		if err != nil {
-			conn.Close()
-			removeFromKnownNodes(attemptedNode)
-			fmt.Printf("Failed to write version: %s\n", err.Error())
-			continue
+		var v2 *v2transport.Conn
+		if opts.V2Transport {
+			v2, err = initiateV2(ctx, conn, testnet)
+			if err == v2transport.ErrV1Peer {
+				conn, err = dialer.DialContext(ctx, "tcp", serv)
+			}
+			if err != nil {
+				removeFromKnownNodes(attemptedNode)
+				logf("V2 handshake with %s failed: %s", serv, err)
+				continue
+			}
+			if v2 != nil {
+				conn = v2
+			}
 		}
 
-		// Recieve version
-		header, err := message.ReadHeader(conn)
+		versionResponse, wtxidRelay, err := handshake(ctx, conn, testnet)
 		if err != nil {
 			conn.Close()
 			removeFromKnownNodes(attemptedNode)
-			fmt.Printf("Header not understood: %s\n", err.Error())
+			logf("Handshake with %s failed: %s", serv, err)
 			continue
 		}
 
-		versionResponse, err := message.ReadVersionPayload(conn, header)
-		if err != nil {
+		services := ServiceFlag(typeconv.Uint64FromBytes(versionResponse.Services[:]))
+		desiredNode, reason := isDesiredNode(services, opts.RequiredServices)
+		if !desiredNode {
 			conn.Close()
 			removeFromKnownNodes(attemptedNode)
-			fmt.Printf("Version message not understood: %s\n", err.Error())
+			logf("Skipping %s because %s", serv, reason)
 			continue
 		}
 
-		// Send verack
-		verackMsg := message.NewVerackMessage(testnet)
-		_, err = conn.Write(verackMsg)
-		if err != nil {
-			conn.Close()
-			removeFromKnownNodes(attemptedNode)
-			fmt.Printf("Failed to write ver ack: %s\n", err.Error())
-			continue
-		}
+		addToInUseNodes(attemptedNode)
+		new := newConnection(conn, versionResponse, wtxidRelay, testnet)
+		new.endpoint = attemptedNode
+		new.v2 = v2
+
+		// Bloom filters are loaded on demand with LoadFilter
+
+		// TODO: Desired nodes may be likely to have desired peers,
+		// get peers from this node and append this to knownNodes
+		logf("Connected to %s %s", serv, new.UserAgent())
+		return new, nil
+	}
+}
 
-		// Recieve verack
-		ready, err := message.ReadVerackMessage(conn)
+// NewConnectionFromConn performs the handshake over an already established
+// connection such as an accepted socket or an in-memory pipe
+func NewConnectionFromConn(ctx context.Context, conn net.Conn, testnet bool) (*Connection, error) {
+	versionResponse, wtxidRelay, err := handshake(ctx, conn, testnet)
+	if err != nil {
+		return nil, err
+	}
+	return newConnection(conn, versionResponse, wtxidRelay, testnet), nil
+}
+
+// NewV2ConnectionFromConn is like NewConnectionFromConn but first performs the
+// v2 transport handshake, as the initiating or accepting side. An accepting
+// side falls back to v1 if the peer starts a v1 handshake
+func NewV2ConnectionFromConn(ctx context.Context, conn net.Conn, testnet bool, initiator bool) (*Connection, error) {
+	var err error
+	var v2 *v2transport.Conn
+	if initiator {
+		v2, err = initiateV2(ctx, conn, testnet)
 		if err != nil {
-			conn.Close()
-			removeFromKnownNodes(attemptedNode)
-			fmt.Printf("Verack not understood: %s\n", err.Error())
-			continue
+			return nil, err
 		}
-		if ready {
-			// Connection success
-			new.connected = true
-		} else {
-			conn.Close()
-			removeFromKnownNodes(attemptedNode)
-			fmt.Printf("Did not recieve verack where expected skipping host\n")
-			continue
+		conn = v2
+	} else {
+		done := handshakeDeadline(ctx, conn)
+		conn, err = v2transport.Accept(conn, testnet)
+		done()
+		if err != nil {
+			return nil, err
 		}
+		v2, _ = conn.(*v2transport.Conn)
+	}
 
-		new.conn = conn
-		new.useragent = typeconv.CleanStringFromBytes(versionResponse.Useragent[:])
-		new.host = conn.RemoteAddr().String()
-		new.nonce = fmt.Sprintf("%d", versionResponse.Nonce)
-		new.services = ServiceFlag(typeconv.Uint64FromBytes(versionResponse.Services[:]))
-		new.pendingPings = map[uint64]int64{}
+	n, err := NewConnectionFromConn(ctx, conn, testnet)
+	if err != nil {
+		return nil, err
+	}
+	n.v2 = v2
+	return n, nil
+}
 
-		desiredNode, reason := isDesiredNode(new.services)
-		if !desiredNode {
-			conn.Close()
-			removeFromKnownNodes(attemptedNode)
-			fmt.Printf("Skipping host because %s\n", reason)
-			continue
+// initiateV2 performs the v2 transport handshake on a newly dialed connection
+func initiateV2(ctx context.Context, conn net.Conn, testnet bool) (*v2transport.Conn, error) {
+	done := handshakeDeadline(ctx, conn)
+	defer done()
+	return v2transport.Initiate(conn, testnet)
+}
+
+// newConnection creates a connection ready to Run for a completed handshake
+func newConnection(conn net.Conn, versionResponse message.Version, wtxidRelay bool, testnet bool) *Connection {
+	new := &Connection{
+		wtxidRelay:   wtxidRelay,
+		conn:         conn,
+		testnet:      testnet,
+		connected:    true,
+		useragent:    typeconv.CleanStringFromBytes(versionResponse.Useragent[:]),
+		host:         conn.RemoteAddr().String(),
+		nonce:        fmt.Sprintf("%d", versionResponse.Nonce),
+		services:     ServiceFlag(typeconv.Uint64FromBytes(versionResponse.Services[:])),
+		version:      versionResponse,
+		timeOffset:   time.Duration(int64(typeconv.Uint64FromBytes(versionResponse.Timestamp[:]))-time.Now().Unix()) * time.Second,
+		pendingPings: map[uint64]time.Time{},
+		events:       NewBus(),
+		sendQueue:    newSendQueue(),
+		done:         make(chan struct{}),
+	}
+	new.ctx, new.cancel = context.WithCancel(context.Background())
+	return new
+}
+
+// handshake exchanges version and verack messages with a newly dialed node,
+// negotiating wtxid relay with nodes which support it
+func handshake(ctx context.Context, conn net.Conn, testnet bool) (message.Version, bool, error) {
+	defer handshakeDeadline(ctx, conn)()
+
+	w := newHandshakeWriter(conn)
+	versionResponse, wtxidRelay, err := exchangeVersions(conn, w, testnet)
+	if err != nil {
+		// Abort pending writes
+		conn.SetDeadline(time.Now())
+		w.close()
+		return message.Version{}, false, err
+	}
+	if err := w.close(); err != nil {
+		return message.Version{}, false, fmt.Errorf("Failed to write handshake: %s", err.Error())
+	}
+	return versionResponse, wtxidRelay, nil
+}
+
+// exchangeVersions sends version and verack through w while reading the
+// peer's, negotiating wtxid relay with nodes which support it
+func exchangeVersions(conn net.Conn, w *handshakeWriter, testnet bool) (message.Version, bool, error) {
+	// Send version
+	w.write(message.NewVersionMessage(testnet))
+
+	// Recieve version
+	header, err := message.ReadHeader(conn)
+	if err != nil {
+		return message.Version{}, false, fmt.Errorf("Header not understood: %s", err.Error())
+	}
+
+	versionResponse, err := message.ReadVersionPayload(conn, header)
+	if err != nil {
+		return message.Version{}, false, fmt.Errorf("Version message not understood: %s", err.Error())
+	}
+
+	// Offer wtxid relay before verack (BIP0339)
+	sentWtxidRelay := int32(typeconv.Uint32FromBytes(versionResponse.Version[:])) >= message.WtxidRelayVersion
+	if sentWtxidRelay {
+		w.write(message.NewWtxidRelayMessage(testnet))
+	}
+
+	// Send verack
+	w.write(message.NewVerackMessage(testnet))
+
+	// Recieve verack, after any feature negotiation messages
+	wtxidRelay := false
+	for {
+		h, err := message.ReadHeader(conn)
+		if err != nil {
+			return message.Version{}, false, fmt.Errorf("Verack not understood: %s", err.Error())
+		}
+		if typeconv.Uint32FromBytes(h.PayloadLen[:]) != 0 {
+			return message.Version{}, false, errors.New("Did not recieve verack where expected")
+		}
+		switch typeconv.CleanStringFromBytes(h.Command[:]) {
+		case message.CommandVersionAcknowledge:
+			return versionResponse, sentWtxidRelay && wtxidRelay, nil
+		case message.CommandWtxidRelay:
+			wtxidRelay = true
+		case message.CommandSendAddrV2:
+			// addrv2 is not used
+		default:
+			return message.Version{}, false, errors.New("Did not recieve verack where expected")
 		}
-		break
 	}
+}
 
-	inUseNodes = append(inUseNodes, attemptedNode)
-	new.endpoint = attemptedNode
+// Most messages written during a handshake
+const handshakeMessages = 3
 
-	// TODO: Send bloom filter to node
+// handshakeWriter writes handshake messages in the background so the peer's
+// can be read while writes are pending, as an unbuffered pipe requires
+type handshakeWriter struct {
+	ch   chan []byte
+	done chan error
+}
 
-	// TODO: Desired nodes may be likely to have desired peers,
-	// get peers from this node and append this to knownNodes
-	fmt.Printf("Connected to:%s\n", new.UserAgent())
+func newHandshakeWriter(conn net.Conn) *handshakeWriter {
+	w := &handshakeWriter{ch: make(chan []byte, handshakeMessages), done: make(chan error, 1)}
+	go func() {
+		var err error
+		for msg := range w.ch {
+			if err == nil {
+				_, err = conn.Write(msg)
+			}
+		}
+		w.done <- err
+	}()
+	return w
+}
 
-	go new.listen()
-	go new.startHeartBeat()
-	return new, nil
+func (w *handshakeWriter) write(msg []byte) {
+	w.ch <- msg
 }
 
-// isDesiredNode determines if this node is desired based on the services it offers
-func isDesiredNode(connservices ServiceFlag) (result bool, reason string) {
-	if !serviceSupported(connservices, ServiceFullNode) {
-		return false, "node is not a full node"
-	}
+// close waits for pending writes, returning the first error
+func (w *handshakeWriter) close() error {
+	close(w.ch)
+	return <-w.done
+}
 
-	if !serviceSupported(connservices, ServiceBloom) {
-		return false, "node does not support bloom filtering"
+// handshakeDeadline bounds reads and writes on conn by the handshake timeout
+// and ctx, the returned function must be called once the handshake is over
+func handshakeDeadline(ctx context.Context, conn net.Conn) func() {
+	deadline := time.Now().Add(handshakeTimeoutSec * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	// Abort blocked reads and writes if ctx is cancelled mid handshake
+	finished := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-finished:
+		}
+	}()
+	return func() {
+		close(finished)
+		<-stopped
+		conn.SetDeadline(time.Time{})
 	}
+}
 
-	if !serviceSupported(connservices, ServiceWitness) {
-		return false, "node does not support witness"
+// isDesiredNode determines if this node is desired based on the services it offers
+func isDesiredNode(connservices ServiceFlag, required ServiceFlag) (result bool, reason string) {
+	if !serviceSupported(connservices, ServiceFullNode) {
+		return false, "node is not a full node"
 	}
 
 	if !serviceSupported(connservices, ServiceWitness) {
@@ -327,6 +883,18 @@ func isDesiredNode(connservices ServiceFlag) (result bool, reason string) {
 		return false, "node is a bitcoin cash node"
 	}
 
+	if serviceSupported(required, ServiceBloom) && !serviceSupported(connservices, ServiceBloom) {
+		return false, "node does not support bloom filtering"
+	}
+
+	if serviceSupported(required, ServiceCompactFilters) && !serviceSupported(connservices, ServiceCompactFilters) {
+		return false, "node does not serve compact filters"
+	}
+
+	if !serviceSupported(connservices, required) {
+		return false, "node does not offer required services"
+	}
+
 	return true, ""
 }
 
@@ -334,7 +902,27 @@ func serviceSupported(hostServices, desiredService ServiceFlag) bool {
 	return hostServices&desiredService == desiredService
 }
 
+func getKnownNodes() []net.IP {
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+	return knownNodes
+}
+
+func addKnownNodes(ips []net.IP) {
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+	knownNodes = append(knownNodes, ips...)
+}
+
+func addToInUseNodes(ip net.IP) {
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+	inUseNodes = append(inUseNodes, ip)
+}
+
 func removeFromKnownNodes(ip net.IP) {
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
 	newKnown := []net.IP{}
 	for _, e := range knownNodes {
 		if !e.Equal(ip) {
@@ -345,6 +933,8 @@ func removeFromKnownNodes(ip net.IP) {
 }
 
 func removeFromInUseNodes(ip net.IP) {
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
 	newInUse := []net.IP{}
 	for _, e := range inUseNodes {
 		if !e.Equal(ip) {
@@ -355,6 +945,8 @@ func removeFromInUseNodes(ip net.IP) {
 }
 
 func getAvailableNodes() []net.IP {
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
 	avail := []net.IP{}
 	vacant := map[string]bool{}
 
@@ -0,0 +1,174 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/message"
+)
+
+// pipePair returns two connections handshaken with each other over an in-memory pipe
+func pipePair(t *testing.T) (*Connection, *Connection) {
+	return pipePairWith(t, func(conn net.Conn) (*Connection, error) {
+		return NewConnectionFromConn(context.Background(), conn, false)
+	}, func(conn net.Conn) (*Connection, error) {
+		return NewConnectionFromConn(context.Background(), conn, false)
+	})
+}
+
+// pipePairWith handshakes the two ends of an in-memory pipe concurrently
+func pipePairWith(t *testing.T, dial, accept func(net.Conn) (*Connection, error)) (*Connection, *Connection) {
+	a, b := net.Pipe()
+	var peer *Connection
+	var peerErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		peer, peerErr = accept(b)
+	}()
+	n, err := dial(a)
+	wg.Wait()
+	if err != nil || peerErr != nil {
+		t.Fatalf("handshake failed: %v, %v", err, peerErr)
+	}
+	return n, peer
+}
+
+// runPair runs both connections until the returned function is called
+func runPair(a, b *Connection) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	var runs sync.WaitGroup
+	runs.Add(2)
+	for _, n := range []*Connection{a, b} {
+		go func(n *Connection) {
+			defer runs.Done()
+			n.Run(ctx)
+		}(n)
+	}
+	return func() {
+		cancel()
+		runs.Wait()
+	}
+}
+
+func TestPipeHandshake(t *testing.T) {
+	a, b := pipePair(t)
+	defer a.Close()
+	defer b.Close()
+
+	if a.ProtocolVersion() < message.WtxidRelayVersion || !a.WTxIDRelay() || !b.WTxIDRelay() {
+		t.Fatal("wtxid relay not negotiated")
+	}
+}
+
+func TestPipeConcurrentUse(t *testing.T) {
+	a, b := pipePair(t)
+	const pings = 20
+
+	pongs := make(chan Event, pings)
+	sub := a.SubscribeChan(ByCommand(message.CommandPong), pongs)
+	defer sub.Unsubscribe()
+
+	stop := runPair(a, b)
+
+	var wg sync.WaitGroup
+	for i := 0; i < pings; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := a.QueueMessage(message.NewPingMessage(uint64(i), false), nil); err != nil {
+				t.Error(err)
+			}
+			a.Ping()
+			b.Connected()
+			b.SendHeaders()
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < pings; i++ {
+		select {
+		case <-pongs:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d pongs", i, pings)
+		}
+	}
+
+	stop()
+	if a.Connected() || b.Connected() {
+		t.Fatal("connections still open after Run returned")
+	}
+	if err := a.QueueMessage(message.NewPingMessage(1, false), nil); err != ErrConnectionClosed {
+		t.Fatalf("queue on closed connection: %v", err)
+	}
+}
+
+func TestPipeV2Handshake(t *testing.T) {
+	a, b := pipePairWith(t, func(conn net.Conn) (*Connection, error) {
+		return NewV2ConnectionFromConn(context.Background(), conn, false, true)
+	}, func(conn net.Conn) (*Connection, error) {
+		return NewV2ConnectionFromConn(context.Background(), conn, false, false)
+	})
+	idA, okA := a.SessionID()
+	idB, okB := b.SessionID()
+	if !okA || !okB || idA != idB {
+		t.Fatal("v2 session ids missing or different")
+	}
+
+	pongs := make(chan Event, 4)
+	sub := a.SubscribeChan(ByCommand(message.CommandPong), pongs)
+	defer sub.Unsubscribe()
+	stop := runPair(a, b)
+	defer stop()
+
+	if err := a.QueueMessage(message.NewPingMessage(7, false), nil); err != nil {
+		t.Fatal(err)
+	}
+	// Keep alive pings are answered too
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-pongs:
+			if nonce, _ := e.Message.(uint64); nonce == 7 {
+				return
+			}
+		case <-timeout:
+			t.Fatal("no pong over v2 transport")
+		}
+	}
+}
+
+func TestPipeV2AcceptFallsBackToV1(t *testing.T) {
+	a, b := pipePairWith(t, func(conn net.Conn) (*Connection, error) {
+		return NewConnectionFromConn(context.Background(), conn, false)
+	}, func(conn net.Conn) (*Connection, error) {
+		return NewV2ConnectionFromConn(context.Background(), conn, false, false)
+	})
+	defer a.Close()
+	defer b.Close()
+	if _, ok := b.SessionID(); ok {
+		t.Fatal("v1 peer accepted as v2")
+	}
+	if !a.WTxIDRelay() || !b.WTxIDRelay() {
+		t.Fatal("wtxid relay not negotiated")
+	}
+}
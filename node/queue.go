@@ -0,0 +1,177 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"errors"
+
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/typeconv"
+)
+
+const (
+	controlQueueLen = 32
+	normalQueueLen  = 128
+	bulkQueueLen    = 32
+	writeTimeoutSec = 30
+)
+
+// ErrSendQueueFull is returned when the outbound lane for a message is full
+var ErrSendQueueFull = errors.New("send queue full")
+
+// Priority is the outbound lane a message is queued in
+type Priority int
+
+const (
+	// PriorityControl messages such as ping, pong and verack are always written first
+	PriorityControl Priority = iota
+
+	// PriorityNormal messages such as inv and getdata are written after control messages
+	PriorityNormal
+
+	// PriorityBulk messages such as block and tx are written when nothing else is pending
+	PriorityBulk
+)
+
+// outboundMessage is a raw message waiting to be written
+type outboundMessage struct {
+	msg  []byte
+	done chan<- error
+}
+
+// sendQueue holds the bounded outbound lanes of a connection
+type sendQueue struct {
+	control chan outboundMessage
+	normal  chan outboundMessage
+	bulk    chan outboundMessage
+}
+
+func newSendQueue() sendQueue {
+	return sendQueue{
+		control: make(chan outboundMessage, controlQueueLen),
+		normal:  make(chan outboundMessage, normalQueueLen),
+		bulk:    make(chan outboundMessage, bulkQueueLen),
+	}
+}
+
+// lane returns the channel for the given priority
+func (q sendQueue) lane(p Priority) chan outboundMessage {
+	switch p {
+	case PriorityControl:
+		return q.control
+	case PriorityBulk:
+		return q.bulk
+	}
+	return q.normal
+}
+
+// next returns the highest priority pending message without blocking
+func (q sendQueue) next() (outboundMessage, bool) {
+	for _, lane := range []chan outboundMessage{q.control, q.normal, q.bulk} {
+		select {
+		case m := <-lane:
+			return m, true
+		default:
+		}
+	}
+	return outboundMessage{}, false
+}
+
+// PriorityForCommand returns the outbound lane used for a protocol command
+func PriorityForCommand(cmd string) Priority {
+	switch cmd {
+	case message.CommandVersion, message.CommandVersionAcknowledge, message.CommandPing,
+		message.CommandPong, message.CommandSendHeaders, message.CommandFeeFilter, message.CommandReject,
+		message.CommandSendCmpct:
+		return PriorityControl
+	case message.CommandBlock, message.CommandTx, message.CommandMerkleBlock, message.CommandBlockTxn:
+		return PriorityBulk
+	}
+	return PriorityNormal
+}
+
+// messagePriority returns the outbound lane for a raw message including header
+func messagePriority(msg []byte) Priority {
+	if len(msg) < message.HeaderLength() {
+		return PriorityNormal
+	}
+	h, err := message.ParseHeader(msg[:message.HeaderLength()])
+	if err != nil {
+		return PriorityNormal
+	}
+	return PriorityForCommand(typeconv.CleanStringFromBytes(h.Command[:]))
+}
+
+// QueueMessage queues a raw message including header to be written to the node.
+// Control messages are written ahead of bulk data. If done is not nil it receives
+// nil once the bytes have been flushed to the connection, or the error that
+// prevented it. done should be buffered or read promptly as the writer blocks on it,
+// and must be buffered to be sure of a result when the connection closes.
+// ErrSendQueueFull is returned without queueing when a normal or bulk lane is full.
+// Control messages never fail to queue on a live connection: a node which lets the
+// control lane fill up is not reading, so it is disconnected and ErrConnectionClosed
+// is returned instead
+func (n *Connection) QueueMessage(msg []byte, done chan<- error) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.queueClosed {
+		return ErrConnectionClosed
+	}
+	p := messagePriority(msg)
+	select {
+	case n.sendQueue.lane(p) <- outboundMessage{msg: msg, done: done}:
+		return nil
+	default:
+	}
+	if p == PriorityControl {
+		n.queueClosed = true
+		n.cancel()
+		return ErrConnectionClosed
+	}
+	return ErrSendQueueFull
+}
+
+// notify reports the result of writing m to its sender. Once the connection
+// is closing the result is dropped unless done has room for it
+func (n *Connection) notify(m outboundMessage, err error) {
+	if m.done == nil {
+		return
+	}
+	select {
+	case m.done <- err:
+	case <-n.ctx.Done():
+		// Don't block shutdown on a sender which is not reading
+		select {
+		case m.done <- err:
+		default:
+		}
+	}
+}
+
+// drainQueue stops further queueing and fails every message
+// still queued when the writer exits
+func (n *Connection) drainQueue() {
+	n.mu.Lock()
+	n.queueClosed = true
+	n.mu.Unlock()
+	for {
+		m, ok := n.sendQueue.next()
+		if !ok {
+			return
+		}
+		n.notify(m, ErrConnectionClosed)
+	}
+}
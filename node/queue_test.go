@@ -0,0 +1,157 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/message"
+)
+
+func TestControlOvertakesBulk(t *testing.T) {
+	a, b := pipePair(t)
+	const blocks = 5
+
+	var mu sync.Mutex
+	var order []string
+	received := make(chan struct{}, blocks)
+	b.Subscribe(nil, func(e Event) {
+		if e.Type != EventMessage {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case e.Command == message.CommandBlock:
+			order = append(order, e.Command)
+			received <- struct{}{}
+		case e.Command == message.CommandPing && e.Message == uint64(7):
+			order = append(order, e.Command)
+		}
+	})
+
+	// Queue bulk data before the writer starts, then a ping behind it
+	for i := 0; i < blocks; i++ {
+		if err := a.QueueMessage(message.NewMessage(message.CommandBlock, []byte{byte(i)}, false), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := make(chan error, 1)
+	if err := a.QueueMessage(message.NewPingMessage(7, false), done); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := runPair(a, b)
+	defer stop()
+	for i := 0; i < blocks; i++ {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d blocks", i, blocks)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("ping not flushed: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != blocks+1 || order[0] != message.CommandPing {
+		t.Fatalf("messages written in order %v, want the ping first", order)
+	}
+}
+
+func TestSendQueueFull(t *testing.T) {
+	a, b := pipePair(t)
+	defer b.Close()
+
+	// Nothing is written until Run, so the lanes fill up
+	inv := message.NewGetDataMessage(nil, false)
+	for i := 0; i < normalQueueLen; i++ {
+		if err := a.QueueMessage(inv, nil); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	if err := a.QueueMessage(inv, nil); err != ErrSendQueueFull {
+		t.Fatalf("full normal lane: got %v, want ErrSendQueueFull", err)
+	}
+	block := message.NewMessage(message.CommandBlock, nil, false)
+	for i := 0; i < bulkQueueLen; i++ {
+		if err := a.QueueMessage(block, nil); err != nil {
+			t.Fatalf("bulk message %d: %v", i, err)
+		}
+	}
+	if err := a.QueueMessage(block, nil); err != ErrSendQueueFull {
+		t.Fatalf("full bulk lane: got %v, want ErrSendQueueFull", err)
+	}
+
+	// A full control lane means the node is not reading, so it is disconnected
+	ping := message.NewPingMessage(1, false)
+	for i := 0; i < controlQueueLen; i++ {
+		if err := a.QueueMessage(ping, nil); err != nil {
+			t.Fatalf("control message %d: %v", i, err)
+		}
+	}
+	if err := a.QueueMessage(ping, nil); err != ErrConnectionClosed {
+		t.Fatalf("full control lane: got %v, want ErrConnectionClosed", err)
+	}
+	if err := a.QueueMessage(inv, nil); err != ErrConnectionClosed {
+		t.Fatalf("queue after disconnect: got %v, want ErrConnectionClosed", err)
+	}
+}
+
+func TestQueuedMessageFailsOnClose(t *testing.T) {
+	a, b := pipePair(t)
+	defer b.Close()
+
+	// b never reads, so the writer blocks on its first ping
+	running := make(chan Event, 1)
+	a.SubscribeChan(ByType(EventPeerConnected), running)
+	go a.Run(context.Background())
+	<-running
+	done := make(chan error, 1)
+	if err := a.QueueMessage(message.NewMessage(message.CommandBlock, nil, false), done); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	select {
+	case err := <-done:
+		if err != ErrConnectionClosed {
+			t.Fatalf("got %v, want ErrConnectionClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no result for a message queued when the connection closed")
+	}
+
+	// Messages queued on a connection closed before Run also get a result
+	c, d := pipePair(t)
+	defer d.Close()
+	if err := c.QueueMessage(message.NewMessage(message.CommandBlock, nil, false), done); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	select {
+	case err := <-done:
+		if err != ErrConnectionClosed {
+			t.Fatalf("closed before Run: got %v, want ErrConnectionClosed", err)
+		}
+	default:
+		t.Fatal("no result for a message queued before Run")
+	}
+}
@@ -0,0 +1,97 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package node
+
+import (
+	"time"
+
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/typeconv"
+)
+
+// Number of recently sent transactions and blocks remembered for matching rejects
+const sentHistoryLen = 1000
+
+// Rejection is a reject message received from a node, matched where
+// possible against a transaction or block previously sent on the connection
+type Rejection struct {
+	message.Reject
+	Peer    string    // Address of the rejecting node
+	Matched bool      // True if Data is the hash of a transaction or block we sent
+	SentAt  time.Time // When the matched transaction or block was written
+}
+
+// sentItem is a transaction or block written to the node
+type sentItem struct {
+	hash [32]byte
+	at   time.Time
+}
+
+// recordSent remembers transactions and blocks written to the node so
+// rejects can be traced back to them
+func (n *Connection) recordSent(msg []byte) {
+	if len(msg) < message.HeaderLength() {
+		return
+	}
+	h, err := message.ParseHeader(msg[:message.HeaderLength()])
+	if err != nil {
+		return
+	}
+	payload := msg[message.HeaderLength():]
+
+	item := sentItem{at: time.Now()}
+	switch typeconv.CleanStringFromBytes(h.Command[:]) {
+	case message.CommandTx:
+		tx, err := message.ParseTxPayload(payload)
+		if err != nil {
+			return
+		}
+		item.hash = tx.TxID()
+	case message.CommandBlock:
+		bh, err := message.ParseBlockHeader(payload)
+		if err != nil {
+			return
+		}
+		item.hash = bh.BlockHash()
+	default:
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sent = append(n.sent, item)
+	if len(n.sent) > sentHistoryLen {
+		n.sent = n.sent[len(n.sent)-sentHistoryLen:]
+	}
+}
+
+// matchReject looks up the transaction or block a reject refers to
+func (n *Connection) matchReject(rej message.Reject) Rejection {
+	res := Rejection{Reject: rej, Peer: n.Host()}
+	if !rej.HasData {
+		return res
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i := len(n.sent) - 1; i >= 0; i-- {
+		if n.sent[i].hash == rej.Data {
+			res.Matched = true
+			res.SentAt = n.sent[i].at
+			break
+		}
+	}
+	return res
+}
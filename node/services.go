@@ -20,4 +20,20 @@ const (
 
 	// ServiceBCH indicates node is for bitcoin cash
 	ServiceBCH
+
+	// ServiceCompactFilters is a flag used to indicate a peer serves compact block filters (BIP0157).
+	ServiceCompactFilters
+
+	_
+	_
+	_
+
+	// ServiceNetworkLimited is a flag used to indicate a peer only serves the last 288 blocks (BIP0159).
+	ServiceNetworkLimited
+
+	// ServiceP2PV2 is a flag used to indicate a peer supports the v2 encrypted transport (BIP0324).
+	ServiceP2PV2
 )
+
+// DefaultRequiredServices are the services required of nodes unless configured otherwise
+const DefaultRequiredServices = ServiceBloom
@@ -0,0 +1,203 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package propagation
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/inventory"
+)
+
+// Stats summarises how an inventory entry propagated across the pool
+type Stats struct {
+	Hash      string          `json:"hash"`
+	Type      string          `json:"type"`
+	FirstSeen time.Time       `json:"first_seen"`
+	FirstPeer string          `json:"first_peer"`
+	ToMedian  time.Duration   `json:"to_median_ns"` // Time from first to median announcement
+	ToLast    time.Duration   `json:"to_last_ns"`   // Time from first to last announcement
+	Peers     int             `json:"peers"`        // Number of peers which announced the entry
+	PoolSize  int             `json:"pool_size"`
+	Coverage  float64         `json:"coverage"` // Peers as a fraction of PoolSize
+	Delays    []time.Duration `json:"delays_ns"`
+}
+
+// Recorder keeps announcement timestamps for at most limit entries in an
+// inventory.SeenCache, dropping the least recently announced entries first.
+// Transactions linked with Link are reported once, whether peers announced
+// them by txid or by wtxid
+type Recorder struct {
+	seen     *inventory.SeenCache
+	limit    int
+	mu       sync.Mutex
+	poolSize map[[32]byte]int // Largest pool size by sighting key
+}
+
+// NewRecorder creates a recorder remembering at most limit entries
+func NewRecorder(limit int) *Recorder {
+	if limit < 1 {
+		limit = 1
+	}
+	return &Recorder{
+		seen:     inventory.NewSeenCache(limit),
+		limit:    limit,
+		poolSize: map[[32]byte]int{},
+	}
+}
+
+// Record notes that peer announced e at t while poolSize peers were connected.
+// Repeated announcements by the same peer are ignored
+func (r *Recorder) Record(e inventory.Entry, peer string, t time.Time, poolSize int) {
+	r.seen.Record(e, peer, t)
+	key := r.seen.Key(e.Hash)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if poolSize > r.poolSize[key] {
+		r.poolSize[key] = poolSize
+	}
+	if len(r.poolSize) > 2*r.limit {
+		r.prune()
+	}
+}
+
+// Link reports announcements of a transaction by txid and by wtxid as one entry
+func (r *Recorder) Link(txid, wtxid [32]byte) {
+	r.seen.Link(txid, wtxid)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if size, ok := r.poolSize[wtxid]; ok && r.seen.Key(wtxid) == txid {
+		if size > r.poolSize[txid] {
+			r.poolSize[txid] = size
+		}
+		delete(r.poolSize, wtxid)
+	}
+}
+
+// prune forgets the pool sizes of entries evicted from the cache. The caller must hold r.mu
+func (r *Recorder) prune() {
+	for key := range r.poolSize {
+		if _, ok := r.seen.Lookup(key); !ok {
+			delete(r.poolSize, key)
+		}
+	}
+}
+
+// Len returns the number of recorded entries
+func (r *Recorder) Len() int {
+	return r.seen.Len()
+}
+
+// Lookup returns the statistics for hash if it is still recorded,
+// linked transactions can be looked up by txid or wtxid
+func (r *Recorder) Lookup(hash [32]byte) (Stats, bool) {
+	s, ok := r.seen.Lookup(hash)
+	if !ok {
+		return Stats{}, false
+	}
+	return r.stats(s), true
+}
+
+// Stats returns statistics for every recorded entry in first seen order
+func (r *Recorder) Stats() []Stats {
+	sightings := r.seen.Sightings()
+	res := make([]Stats, 0, len(sightings))
+	for _, s := range sightings {
+		res = append(res, r.stats(s))
+	}
+	return res
+}
+
+// stats summarises s with the largest pool size seen while it was announced
+func (r *Recorder) stats(rec inventory.Sighting) Stats {
+	key := r.seen.Key(rec.Entry.Hash)
+	r.mu.Lock()
+	poolSize := r.poolSize[key]
+	r.mu.Unlock()
+	return summarise(rec, poolSize)
+}
+
+func summarise(rec inventory.Sighting, poolSize int) Stats {
+	s := Stats{
+		Hash:      rec.Entry.HexString(),
+		Type:      rec.Entry.Type.String(),
+		FirstSeen: rec.FirstSeen,
+		Peers:     len(rec.Announcements),
+		PoolSize:  poolSize,
+	}
+	if len(rec.Announcements) == 0 {
+		return s
+	}
+	s.FirstPeer = rec.Announcements[0].Peer
+
+	s.Delays = make([]time.Duration, 0, len(rec.Announcements))
+	for _, a := range rec.Announcements {
+		s.Delays = append(s.Delays, a.Time.Sub(rec.FirstSeen))
+	}
+	sort.Slice(s.Delays, func(i, j int) bool { return s.Delays[i] < s.Delays[j] })
+
+	mid := len(s.Delays) / 2
+	s.ToMedian = s.Delays[mid]
+	if len(s.Delays)%2 == 0 {
+		s.ToMedian = (s.Delays[mid-1] + s.Delays[mid]) / 2
+	}
+	s.ToLast = s.Delays[len(s.Delays)-1]
+	if s.PoolSize > 0 {
+		s.Coverage = float64(s.Peers) / float64(s.PoolSize)
+	}
+	return s
+}
+
+// WriteJSON writes statistics for every recorded entry as a JSON array
+func (r *Recorder) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r.Stats())
+}
+
+// WriteCSV writes statistics for every recorded entry as CSV with a header row,
+// durations are in milliseconds
+func (r *Recorder) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"hash", "type", "first_seen", "first_peer", "to_median_ms", "to_last_ms", "peers", "pool_size", "coverage"})
+	for _, s := range r.Stats() {
+		cw.Write([]string{
+			s.Hash,
+			s.Type,
+			s.FirstSeen.UTC().Format(time.RFC3339Nano),
+			s.FirstPeer,
+			millis(s.ToMedian),
+			millis(s.ToLast),
+			strconv.Itoa(s.Peers),
+			strconv.Itoa(s.PoolSize),
+			strconv.FormatFloat(s.Coverage, 'f', 4, 64),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func millis(d time.Duration) string {
+	return fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond))
+}
@@ -0,0 +1,69 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package propagation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/inventory"
+)
+
+func TestRecorderLinksTxIDs(t *testing.T) {
+	r := NewRecorder(10)
+	txid := [32]byte{1}
+	wtxid := [32]byte{2}
+	start := time.Unix(1000, 0)
+
+	r.Record(inventory.Entry{Type: inventory.TypeTx, Hash: txid}, "a", start, 4)
+	r.Record(inventory.Entry{Type: inventory.TypeWTX, Hash: wtxid}, "b", start.Add(time.Second), 5)
+	r.Record(inventory.Entry{Type: inventory.TypeWTX, Hash: wtxid}, "a", start.Add(2*time.Second), 5)
+	if r.Len() != 2 {
+		t.Fatalf("recorded %d entries before linking, want 2", r.Len())
+	}
+
+	r.Link(txid, wtxid)
+	if r.Len() != 1 {
+		t.Fatalf("recorded %d entries after linking, want 1", r.Len())
+	}
+	for _, h := range [][32]byte{txid, wtxid} {
+		s, ok := r.Lookup(h)
+		if !ok {
+			t.Fatalf("lookup of %x failed", h[:1])
+		}
+		if s.Peers != 2 || s.PoolSize != 5 || s.FirstPeer != "a" || s.ToLast != time.Second {
+			t.Fatalf("unexpected stats %+v", s)
+		}
+	}
+}
+
+func TestRecorderLimit(t *testing.T) {
+	r := NewRecorder(2)
+	now := time.Now()
+	for i := byte(0); i < 5; i++ {
+		r.Record(inventory.Entry{Type: inventory.TypeTx, Hash: [32]byte{i}}, "a", now.Add(time.Duration(i)), 1)
+	}
+	stats := r.Stats()
+	if len(stats) != 2 {
+		t.Fatalf("kept %d entries, want 2", len(stats))
+	}
+	if _, ok := r.Lookup([32]byte{4}); !ok {
+		t.Fatal("newest entry was dropped")
+	}
+	if _, ok := r.Lookup([32]byte{0}); ok {
+		t.Fatal("oldest entry was kept")
+	}
+}
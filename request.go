@@ -0,0 +1,66 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sansnetwork
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/sanscentral/sansnetwork/node"
+)
+
+// ErrPeerDisconnected is returned when a node disconnects before answering a request
+var ErrPeerDisconnected = errors.New("node disconnected before responding")
+
+// exchange sends msg to n and passes each received event matching f to
+// handle until handle returns true, n disconnects or ctx is done
+func exchange(ctx context.Context, n *node.Connection, msg []byte, f node.EventFilter, handle func(node.Event) bool) error {
+	var mu sync.Mutex
+	finished := false
+	done := make(chan error, 1)
+	finish := func(err error) {
+		finished = true
+		done <- err
+	}
+
+	sub := n.Subscribe(nil, func(e node.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if finished {
+			return
+		}
+		if e.Type == node.EventPeerDisconnected {
+			finish(ErrPeerDisconnected)
+			return
+		}
+		if f(e) && handle(e) {
+			finish(nil)
+		}
+	})
+	defer sub.Unsubscribe()
+
+	if err := n.QueueMessage(msg, nil); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
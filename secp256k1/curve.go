@@ -0,0 +1,142 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package secp256k1 implements the secp256k1 curve arithmetic and
+// ElligatorSwift encoding needed for x-only ECDH (BIP0324). Operations are
+// not constant time and are intended for ephemeral keys only
+package secp256k1
+
+import (
+	"math/big"
+)
+
+var (
+	// P is the field prime
+	P, _ = new(big.Int).SetString("fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f", 16)
+
+	// N is the group order
+	N, _ = new(big.Int).SetString("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141", 16)
+
+	gx, _ = new(big.Int).SetString("79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798", 16)
+	gy, _ = new(big.Int).SetString("483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8", 16)
+
+	seven    = big.NewInt(7)
+	sqrtExp  = new(big.Int).Rsh(new(big.Int).Add(P, big.NewInt(1)), 2) // (p+1)/4
+	infinity = point{}
+)
+
+// point is an affine curve point, x nil is the point at infinity
+type point struct {
+	x, y *big.Int
+}
+
+func mod(a *big.Int) *big.Int {
+	return a.Mod(a, P)
+}
+
+func fmul(a, b *big.Int) *big.Int {
+	return mod(new(big.Int).Mul(a, b))
+}
+
+func fadd(a, b *big.Int) *big.Int {
+	return mod(new(big.Int).Add(a, b))
+}
+
+func fsub(a, b *big.Int) *big.Int {
+	return mod(new(big.Int).Sub(a, b))
+}
+
+func fneg(a *big.Int) *big.Int {
+	return mod(new(big.Int).Neg(a))
+}
+
+// finv returns 1/a, a must be non zero
+func finv(a *big.Int) *big.Int {
+	return new(big.Int).ModInverse(a, P)
+}
+
+func fdiv(a, b *big.Int) *big.Int {
+	return fmul(a, finv(b))
+}
+
+// fsqrt returns a square root of a, or nil if a is not a square
+func fsqrt(a *big.Int) *big.Int {
+	r := new(big.Int).Exp(a, sqrtExp, P)
+	if fmul(r, r).Cmp(mod(new(big.Int).Set(a))) != 0 {
+		return nil
+	}
+	return r
+}
+
+// curveRHS returns x^3 + 7
+func curveRHS(x *big.Int) *big.Int {
+	return fadd(fmul(fmul(x, x), x), seven)
+}
+
+// IsValidX reports whether x is the x coordinate of a point on the curve
+func IsValidX(x *big.Int) bool {
+	return fsqrt(curveRHS(x)) != nil
+}
+
+// liftX returns the point with x coordinate x and even y
+func liftX(x *big.Int) (point, bool) {
+	y := fsqrt(curveRHS(x))
+	if y == nil {
+		return infinity, false
+	}
+	if y.Bit(0) == 1 {
+		y = fneg(y)
+	}
+	return point{new(big.Int).Set(x), y}, true
+}
+
+func (a point) add(b point) point {
+	if a.x == nil {
+		return b
+	}
+	if b.x == nil {
+		return a
+	}
+	var lambda *big.Int
+	if a.x.Cmp(b.x) == 0 {
+		if fadd(a.y, b.y).Sign() == 0 {
+			return infinity
+		}
+		// Doubling: 3x^2 / 2y
+		lambda = fdiv(fmul(big.NewInt(3), fmul(a.x, a.x)), fmul(big.NewInt(2), a.y))
+	} else {
+		lambda = fdiv(fsub(b.y, a.y), fsub(b.x, a.x))
+	}
+	x := fsub(fsub(fmul(lambda, lambda), a.x), b.x)
+	y := fsub(fmul(lambda, fsub(a.x, x)), a.y)
+	return point{x, y}
+}
+
+// mul returns k*a by double and add
+func (a point) mul(k *big.Int) point {
+	res := infinity
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		res = res.add(res)
+		if k.Bit(i) == 1 {
+			res = res.add(a)
+		}
+	}
+	return res
+}
+
+// ScalarBaseMultX returns the x coordinate of k*G
+func ScalarBaseMultX(k *big.Int) *big.Int {
+	return point{gx, gy}.mul(k).x
+}
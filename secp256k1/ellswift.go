@@ -0,0 +1,170 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package secp256k1
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+)
+
+// EllSwiftSize is the size in bytes of an ElligatorSwift encoded public key
+const EllSwiftSize = 64
+
+// ErrInvalidPrivateKey is returned for private keys outside [1, N)
+var ErrInvalidPrivateKey = errors.New("secp256k1: invalid private key")
+
+// minus3Sqrt is the square root of -3 used by ElligatorSwift, as (p+1)/4 exponentiation returns it
+var minus3Sqrt = fsqrt(new(big.Int).Sub(P, big.NewInt(3)))
+
+// XSwiftEC decodes the field elements u and t to the x coordinate of a curve point
+func XSwiftEC(u, t *big.Int) *big.Int {
+	u = mod(new(big.Int).Set(u))
+	t = mod(new(big.Int).Set(t))
+	if u.Sign() == 0 {
+		u.SetInt64(1)
+	}
+	if t.Sign() == 0 {
+		t.SetInt64(1)
+	}
+	u3 := fadd(fmul(fmul(u, u), u), seven) // u^3 + 7
+	if fadd(u3, fmul(t, t)).Sign() == 0 {
+		t = fadd(t, t)
+	}
+	x := fdiv(fsub(u3, fmul(t, t)), fadd(t, t))
+	y := fdiv(fadd(x, t), fmul(minus3Sqrt, u))
+
+	// The first of the three candidates on the curve is chosen
+	xy := fdiv(x, y)
+	half := finv(big.NewInt(2))
+	for _, c := range []*big.Int{
+		fadd(u, fmul(big.NewInt(4), fmul(y, y))),
+		fmul(fsub(fneg(xy), u), half),
+		fmul(fsub(xy, u), half),
+	} {
+		if IsValidX(c) {
+			return c
+		}
+	}
+	// Unreachable, one candidate is always valid
+	return nil
+}
+
+// xSwiftECInv returns t such that XSwiftEC(u, t) == x, or nil if the given
+// case, from 0 to 7, has no solution. It follows the BIP0324 reference exactly
+// so the same case selects the same t
+func xSwiftECInv(x, u *big.Int, c int) *big.Int {
+	var v, s *big.Int
+	u3 := fadd(fmul(fmul(u, u), u), seven)
+	if c&2 == 0 {
+		if IsValidX(fsub(fneg(x), u)) {
+			return nil
+		}
+		v = x
+		den := fadd(fadd(fmul(u, u), fmul(u, v)), fmul(v, v))
+		if den.Sign() == 0 {
+			return nil
+		}
+		s = fneg(fdiv(u3, den))
+	} else {
+		s = fsub(x, u)
+		if s.Sign() == 0 {
+			return nil
+		}
+		r := fsqrt(fneg(fmul(s, fadd(fmul(big.NewInt(4), u3), fmul(fmul(big.NewInt(3), s), fmul(u, u))))))
+		if r == nil || (c&1 == 1 && r.Sign() == 0) {
+			return nil
+		}
+		v = fmul(fsub(fdiv(r, s), u), finv(big.NewInt(2)))
+	}
+	w := fsqrt(s)
+	if w == nil {
+		return nil
+	}
+	// Cases 0 and 5 use -w, cases 1 and 4 use w
+	if c&5 == 0 || c&5 == 5 {
+		w = fneg(w)
+	}
+	half := finv(big.NewInt(2))
+	if c&1 == 0 {
+		return fmul(w, fadd(fmul(u, fmul(fsub(big.NewInt(1), minus3Sqrt), half)), v))
+	}
+	return fmul(w, fadd(fmul(u, fmul(fadd(big.NewInt(1), minus3Sqrt), half)), v))
+}
+
+// EllSwiftEncode returns a random ElligatorSwift encoding of the curve x coordinate x
+func EllSwiftEncode(x *big.Int) ([EllSwiftSize]byte, error) {
+	var enc [EllSwiftSize]byte
+	var b [33]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return enc, err
+		}
+		u := mod(new(big.Int).SetBytes(b[:32]))
+		if u.Sign() == 0 {
+			continue
+		}
+		t := xSwiftECInv(x, u, int(b[32]&7))
+		if t == nil || XSwiftEC(u, t).Cmp(x) != 0 {
+			continue
+		}
+		putBytes(enc[:32], u)
+		putBytes(enc[32:], t)
+		return enc, nil
+	}
+}
+
+// EllSwiftDecode returns the x coordinate encoded by enc
+func EllSwiftDecode(enc [EllSwiftSize]byte) *big.Int {
+	return XSwiftEC(new(big.Int).SetBytes(enc[:32]), new(big.Int).SetBytes(enc[32:]))
+}
+
+// GenerateEllSwiftKey creates a random private key and its ElligatorSwift encoded public key
+func GenerateEllSwiftKey() ([32]byte, [EllSwiftSize]byte, error) {
+	var priv [32]byte
+	for {
+		if _, err := rand.Read(priv[:]); err != nil {
+			return priv, [EllSwiftSize]byte{}, err
+		}
+		d := new(big.Int).SetBytes(priv[:])
+		if d.Sign() == 0 || d.Cmp(N) >= 0 {
+			continue
+		}
+		pub, err := EllSwiftEncode(ScalarBaseMultX(d))
+		return priv, pub, err
+	}
+}
+
+// EllSwiftECDH returns the x coordinate of priv times the point encoded by theirs
+func EllSwiftECDH(theirs [EllSwiftSize]byte, priv [32]byte) ([32]byte, error) {
+	var res [32]byte
+	d := new(big.Int).SetBytes(priv[:])
+	if d.Sign() == 0 || d.Cmp(N) >= 0 {
+		return res, ErrInvalidPrivateKey
+	}
+	p, _ := liftX(EllSwiftDecode(theirs))
+	putBytes(res[:], p.mul(d).x)
+	return res, nil
+}
+
+// putBytes writes x big endian into dst, left padded with zeros
+func putBytes(dst []byte, x *big.Int) {
+	b := x.Bytes()
+	for i := range dst[:len(dst)-len(b)] {
+		dst[i] = 0
+	}
+	copy(dst[len(dst)-len(b):], b)
+}
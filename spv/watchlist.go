@@ -0,0 +1,450 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package spv
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/address"
+	"github.com/sanscentral/sansnetwork/bloom"
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/node"
+)
+
+const (
+	// False positive rate of the bloom filter sent to nodes
+	defaultFPRate = 0.0001
+
+	// Headroom allowed for new elements before the filter is resized
+	minFilterElements = 10
+
+	// Depth below the tip after which filtered blocks are forgotten
+	maxBlockDepth = 2016
+)
+
+// EventType identifies the kind of watch list event
+type EventType int
+
+const (
+	// EventPaymentSeen is published when an unconfirmed payment is first seen
+	EventPaymentSeen EventType = iota
+
+	// EventPaymentConfirmed is published when a payment is first included in a block
+	EventPaymentConfirmed
+
+	// EventConfirmationsChanged is published when a new block changes the confirmations of a payment
+	EventConfirmationsChanged
+
+	// EventFilterChanged is published when watched elements change and filters must be reloaded
+	EventFilterChanged
+)
+
+// Output is a transaction output paying a watched script
+type Output struct {
+	Index  uint32
+	Value  int64
+	Script []byte
+}
+
+// Payment is a transaction paying to a watched script or spending a watched outpoint
+type Payment struct {
+	TxID          [32]byte
+	Tx            message.Tx
+	Received      []Output           // Outputs paying watched scripts
+	Spent         []message.OutPoint // Watched outpoints spent
+	FirstSeen     time.Time
+	Confirmed     bool
+	BlockHash     [32]byte
+	Proof         message.MerkleBlock // Inclusion proof, valid if Confirmed
+	Confirmations int                 // 0 while unconfirmed or if the block left the best chain, see SetHeaderChain
+}
+
+// HeaderChain reports the depth of a block in the best header chain, 0 if
+// it is not in it. *chain.Chain implements it
+type HeaderChain interface {
+	Confirmations(hash [32]byte) int
+}
+
+// Event is a single watch list event
+type Event struct {
+	Type    EventType
+	Payment Payment // Not set for EventFilterChanged
+}
+
+// Handler is type for watch list event callbacks
+type Handler func(Event)
+
+// Subscription is a registered watch list event handler
+type Subscription struct {
+	w       *WatchList
+	handler Handler
+}
+
+// block is a filtered block header with its height relative to the first block seen
+type block struct {
+	header message.BlockHeader
+	hash   [32]byte
+	height int
+}
+
+// match is a txid matched in a filtered block before its transaction arrived
+type match struct {
+	hash  [32]byte
+	proof message.MerkleBlock
+}
+
+// WatchList tracks payments to watched scripts and spends of watched
+// outpoints using filtered blocks and relayed transactions
+type WatchList struct {
+	mu        sync.Mutex
+	testnet   bool
+	tweak     uint32
+	scripts   map[string]bool
+	outpoints map[message.OutPoint]bool
+	payments  map[[32]byte]*Payment
+	blocks    map[[32]byte]*block
+	buried    map[[32]byte]int // Heights of forgotten best chain blocks confirming payments
+	pending   map[[32]byte]match
+	tip       *block
+	chain     HeaderChain
+	subs      []*Subscription
+}
+
+// NewWatchList creates an empty watch list for mainnet or testnet addresses
+func NewWatchList(testnet bool) *WatchList {
+	return &WatchList{
+		testnet:   testnet,
+		tweak:     rand.New(rand.NewSource(time.Now().UnixNano())).Uint32(),
+		scripts:   map[string]bool{},
+		outpoints: map[message.OutPoint]bool{},
+		payments:  map[[32]byte]*Payment{},
+		blocks:    map[[32]byte]*block{},
+		buried:    map[[32]byte]int{},
+		pending:   map[[32]byte]match{},
+	}
+}
+
+// Subscribe calls h for every watch list event, from the goroutine making the change
+func (w *WatchList) Subscribe(h Handler) *Subscription {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := &Subscription{w: w, handler: h}
+	w.subs = append(w.subs, s)
+	return s
+}
+
+// Unsubscribe stops delivery of further events to this handler
+func (s *Subscription) Unsubscribe() {
+	w := s.w
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	subs := make([]*Subscription, 0, len(w.subs))
+	for _, e := range w.subs {
+		if e != s {
+			subs = append(subs, e)
+		}
+	}
+	w.subs = subs
+}
+
+// notify delivers events to subscribers, it must be called without holding mu
+func (w *WatchList) notify(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	w.mu.Lock()
+	subs := w.subs
+	w.mu.Unlock()
+	for _, e := range events {
+		for _, s := range subs {
+			s.handler(e)
+		}
+	}
+}
+
+// AddScript watches for payments to an output script
+func (w *WatchList) AddScript(script []byte) {
+	w.mu.Lock()
+	added := !w.scripts[string(script)]
+	w.scripts[string(script)] = true
+	w.mu.Unlock()
+	if added {
+		w.notify([]Event{{Type: EventFilterChanged}})
+	}
+}
+
+// AddAddress watches for payments to a P2PKH, P2SH or segwit address
+func (w *WatchList) AddAddress(addr string) error {
+	script, err := address.ToScript(addr, w.testnet)
+	if err != nil {
+		return err
+	}
+	w.AddScript(script)
+	return nil
+}
+
+// AddOutPoint watches for transactions spending an outpoint
+func (w *WatchList) AddOutPoint(op message.OutPoint) {
+	w.mu.Lock()
+	added := !w.outpoints[op]
+	w.outpoints[op] = true
+	w.mu.Unlock()
+	if added {
+		w.notify([]Event{{Type: EventFilterChanged}})
+	}
+}
+
+// Filter builds a bloom filter matching every watched script and outpoint
+func (w *WatchList) Filter() *bloom.Filter {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	elements := [][]byte{}
+	for s := range w.scripts {
+		elements = append(elements, bloom.ScriptElements([]byte(s))...)
+	}
+	for op := range w.outpoints {
+		elements = append(elements, outPointBytes(op))
+	}
+
+	size := len(elements)
+	if size < minFilterElements {
+		size = minFilterElements
+	}
+	f := bloom.NewFilter(size, defaultFPRate, w.tweak, bloom.UpdateAll)
+	for _, e := range elements {
+		f.Add(e)
+	}
+	return f
+}
+
+func outPointBytes(op message.OutPoint) []byte {
+	b := make([]byte, 36)
+	copy(b, op.Hash[:])
+	binary.LittleEndian.PutUint32(b[32:], op.Index)
+	return b
+}
+
+// ProcessTx checks a transaction against the watch list, recording it as an
+// unconfirmed payment if it pays a watched script or spends a watched outpoint.
+// Outputs paying watched scripts are watched for spends in turn. A payment
+// already matched in a filtered block is confirmed in that block
+func (w *WatchList) ProcessTx(tx message.Tx) bool {
+	w.mu.Lock()
+	txid := tx.TxID()
+	if _, ok := w.payments[txid]; ok {
+		w.mu.Unlock()
+		return true
+	}
+	m, matched := w.pending[txid]
+	delete(w.pending, txid)
+
+	p := &Payment{TxID: txid, Tx: tx, FirstSeen: time.Now()}
+	for i, out := range tx.TxOut {
+		if w.scripts[string(out.PkScript)] {
+			p.Received = append(p.Received, Output{Index: uint32(i), Value: out.Value, Script: out.PkScript})
+		}
+	}
+	for _, in := range tx.TxIn {
+		if w.outpoints[in.PreviousOutPoint] {
+			p.Spent = append(p.Spent, in.PreviousOutPoint)
+		}
+	}
+	if len(p.Received) == 0 && len(p.Spent) == 0 {
+		w.mu.Unlock()
+		return false
+	}
+
+	w.payments[txid] = p
+	for _, out := range p.Received {
+		w.outpoints[message.OutPoint{Hash: txid, Index: out.Index}] = true
+	}
+	events := []Event{{Type: EventPaymentSeen, Payment: *p}}
+	if matched {
+		events = w.confirm(events, p, m.hash, m.proof)
+	}
+	if len(p.Received) > 0 {
+		events = append(events, Event{Type: EventFilterChanged})
+	}
+	w.mu.Unlock()
+
+	w.notify(events)
+	return true
+}
+
+// ProcessFilteredBlock records a filtered block, processing its transactions
+// and marking matched payments as confirmed with the block's inclusion proof.
+// Matched transactions not yet received are confirmed when they arrive
+func (w *WatchList) ProcessFilteredBlock(fb node.FilteredBlock) {
+	for _, tx := range fb.Tx {
+		w.ProcessTx(tx)
+	}
+
+	w.mu.Lock()
+	events := []Event{}
+	if _, ok := w.blocks[fb.Hash]; !ok {
+		b := &block{header: fb.Header, hash: fb.Hash}
+		if parent, ok := w.blocks[fb.Header.PrevBlock]; ok {
+			b.height = parent.height + 1
+		}
+		w.blocks[fb.Hash] = b
+		if w.tip == nil || b.height > w.tip.height {
+			w.tip = b
+		}
+	}
+
+	for _, txid := range fb.Matched {
+		p, ok := w.payments[txid]
+		if !ok {
+			w.pending[txid] = match{hash: fb.Hash, proof: fb.Proof}
+			continue
+		}
+		if !p.Confirmed || p.BlockHash != fb.Hash {
+			events = w.confirm(events, p, fb.Hash, fb.Proof)
+		}
+	}
+
+	w.prune()
+	events = w.updateConfirmations(events)
+	w.mu.Unlock()
+
+	w.notify(events)
+}
+
+// confirm marks p as confirmed in the block hash, appending the event to
+// events. mu must be held
+func (w *WatchList) confirm(events []Event, p *Payment, hash [32]byte, proof message.MerkleBlock) []Event {
+	p.Confirmed = true
+	p.BlockHash = hash
+	p.Proof = proof
+	p.Confirmations = w.confirmations(hash)
+	return append(events, Event{Type: EventPaymentConfirmed, Payment: *p})
+}
+
+// prune forgets blocks more than maxBlockDepth below the tip, with the
+// matches pending in them. Payments confirmed in a forgotten best chain
+// block keep counting confirmations from its height. mu must be held
+func (w *WatchList) prune() {
+	cutoff := w.tip.height - maxBlockDepth
+	if cutoff < 0 {
+		return
+	}
+	confirming := map[[32]byte]bool{}
+	for _, p := range w.payments {
+		if p.Confirmed {
+			confirming[p.BlockHash] = true
+		}
+	}
+	best := map[[32]byte]bool{}
+	for b := w.tip; b != nil; b = w.blocks[b.header.PrevBlock] {
+		best[b.hash] = true
+	}
+	for hash, b := range w.blocks {
+		if b.height > cutoff {
+			continue
+		}
+		if best[hash] && confirming[hash] {
+			w.buried[hash] = b.height
+		}
+		delete(w.blocks, hash)
+	}
+	for txid, m := range w.pending {
+		if _, ok := w.blocks[m.hash]; !ok {
+			delete(w.pending, txid)
+		}
+	}
+}
+
+// SetHeaderChain counts confirmations in the header chain c instead of over the
+// filtered blocks received. Without a header chain a block missed while no node
+// had the filter loaded ends the count, so confirmations stop increasing and
+// reorgs to blocks never filtered go unnoticed. UpdateConfirmations should be
+// called whenever the best chain of c changes
+func (w *WatchList) SetHeaderChain(c HeaderChain) {
+	w.mu.Lock()
+	w.chain = c
+	w.mu.Unlock()
+	w.UpdateConfirmations()
+}
+
+// UpdateConfirmations recounts the confirmations of every confirmed payment,
+// publishing EventConfirmationsChanged for those which changed
+func (w *WatchList) UpdateConfirmations() {
+	w.mu.Lock()
+	events := w.updateConfirmations(nil)
+	w.mu.Unlock()
+	w.notify(events)
+}
+
+// updateConfirmations appends an event to events for every payment whose
+// confirmations changed. mu must be held
+func (w *WatchList) updateConfirmations(events []Event) []Event {
+	for _, p := range w.payments {
+		if !p.Confirmed {
+			continue
+		}
+		c := w.confirmations(p.BlockHash)
+		if c != p.Confirmations {
+			p.Confirmations = c
+			events = append(events, Event{Type: EventConfirmationsChanged, Payment: *p})
+		}
+	}
+	return events
+}
+
+// confirmations returns the depth of hash below the tip, 0 if it
+// is not in the best chain. mu must be held
+func (w *WatchList) confirmations(hash [32]byte) int {
+	if w.chain != nil {
+		return w.chain.Confirmations(hash)
+	}
+	b := w.tip
+	for depth := 1; b != nil; depth++ {
+		if b.hash == hash {
+			return depth
+		}
+		b = w.blocks[b.header.PrevBlock]
+	}
+	if height, ok := w.buried[hash]; ok {
+		return w.tip.height - height + 1
+	}
+	return 0
+}
+
+// Payments returns every recorded payment
+func (w *WatchList) Payments() []Payment {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	res := make([]Payment, 0, len(w.payments))
+	for _, p := range w.payments {
+		res = append(res, *p)
+	}
+	return res
+}
+
+// Payment returns the recorded payment with the given txid
+func (w *WatchList) Payment(txid [32]byte) (Payment, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	p, ok := w.payments[txid]
+	if !ok {
+		return Payment{}, false
+	}
+	return *p, true
+}
@@ -0,0 +1,166 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package spv
+
+import (
+	"testing"
+
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/node"
+)
+
+var watched = []byte{0x00, 0x14, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+
+// payment returns a transaction paying value to script
+func payment(script []byte, value int64) message.Tx {
+	return message.Tx{
+		Version: 2,
+		TxIn:    []message.TxIn{{PreviousOutPoint: message.OutPoint{Hash: [32]byte{1}}, Sequence: 0xffffffff}},
+		TxOut:   []message.TxOut{{Value: value, PkScript: script}},
+	}
+}
+
+// chainBlocks returns n filtered blocks each building on the previous one
+func chainBlocks(n int) []node.FilteredBlock {
+	blocks := make([]node.FilteredBlock, n)
+	for i := range blocks {
+		blocks[i].Hash = [32]byte{byte(i), byte(i >> 8), 0xbb}
+		if i > 0 {
+			blocks[i].Header.PrevBlock = blocks[i-1].Hash
+		}
+	}
+	return blocks
+}
+
+// record returns the types of the events published by w
+func record(w *WatchList) *[]EventType {
+	events := &[]EventType{}
+	w.Subscribe(func(e Event) {
+		*events = append(*events, e.Type)
+	})
+	return events
+}
+
+func TestProcessTx(t *testing.T) {
+	w := NewWatchList(false)
+	w.AddScript(watched)
+	events := record(w)
+
+	if w.ProcessTx(payment([]byte{0x51}, 1000)) {
+		t.Fatal("unrelated transaction recorded")
+	}
+	tx := payment(watched, 1000)
+	if !w.ProcessTx(tx) || !w.ProcessTx(tx) {
+		t.Fatal("payment not recorded")
+	}
+	if len(*events) != 2 || (*events)[0] != EventPaymentSeen || (*events)[1] != EventFilterChanged {
+		t.Fatalf("events %v, want payment seen and filter changed", *events)
+	}
+
+	// Spends of received outputs are watched in turn
+	spend := payment([]byte{0x51}, 900)
+	spend.TxIn[0].PreviousOutPoint = message.OutPoint{Hash: tx.TxID()}
+	if !w.ProcessTx(spend) {
+		t.Fatal("spend of a received output not recorded")
+	}
+	if p, _ := w.Payment(spend.TxID()); len(p.Spent) != 1 || len(p.Received) != 0 {
+		t.Fatalf("spend recorded as %+v", p)
+	}
+}
+
+func TestBlockBeforeTx(t *testing.T) {
+	w := NewWatchList(false)
+	w.AddScript(watched)
+	events := record(w)
+
+	tx := payment(watched, 1000)
+	blocks := chainBlocks(2)
+	blocks[0].Matched = [][32]byte{tx.TxID()}
+	w.ProcessFilteredBlock(blocks[0])
+	if len(*events) != 0 {
+		t.Fatalf("events %v before the transaction arrived", *events)
+	}
+
+	w.ProcessTx(tx)
+	p, ok := w.Payment(tx.TxID())
+	if !ok || !p.Confirmed || p.BlockHash != blocks[0].Hash || p.Confirmations != 1 {
+		t.Fatalf("payment %+v not confirmed in the matching block", p)
+	}
+	want := []EventType{EventPaymentSeen, EventPaymentConfirmed, EventFilterChanged}
+	if len(*events) != len(want) {
+		t.Fatalf("events %v, want %v", *events, want)
+	}
+	for i := range want {
+		if (*events)[i] != want[i] {
+			t.Fatalf("events %v, want %v", *events, want)
+		}
+	}
+
+	w.ProcessFilteredBlock(blocks[1])
+	if p, _ := w.Payment(tx.TxID()); p.Confirmations != 2 {
+		t.Fatalf("%d confirmations, want 2", p.Confirmations)
+	}
+}
+
+func TestFalsePositiveMatch(t *testing.T) {
+	w := NewWatchList(false)
+	w.AddScript(watched)
+
+	tx := payment([]byte{0x51}, 1000)
+	block := chainBlocks(1)[0]
+	block.Matched = [][32]byte{tx.TxID()}
+	w.ProcessFilteredBlock(block)
+	if w.ProcessTx(tx) {
+		t.Fatal("unrelated transaction recorded")
+	}
+	if len(w.pending) != 0 {
+		t.Fatal("match kept after its transaction arrived")
+	}
+}
+
+func TestBlocksPruned(t *testing.T) {
+	w := NewWatchList(false)
+	w.AddScript(watched)
+
+	tx := payment(watched, 1000)
+	late := payment(watched, 2000)
+	blocks := chainBlocks(maxBlockDepth + 10)
+	blocks[0].Tx = []message.Tx{tx}
+	blocks[0].Matched = [][32]byte{tx.TxID()}
+	blocks[1].Matched = [][32]byte{late.TxID()}
+	for _, b := range blocks {
+		w.ProcessFilteredBlock(b)
+	}
+
+	if len(w.blocks) > maxBlockDepth+1 {
+		t.Fatalf("%d blocks kept, want at most %d", len(w.blocks), maxBlockDepth+1)
+	}
+	if len(w.pending) != 0 {
+		t.Fatal("match kept after its block was forgotten")
+	}
+	if p, _ := w.Payment(tx.TxID()); p.Confirmations != len(blocks) {
+		t.Fatalf("%d confirmations, want %d", p.Confirmations, len(blocks))
+	}
+	w.ProcessFilteredBlock(node.FilteredBlock{Hash: [32]byte{0xff}, Header: message.BlockHeader{PrevBlock: blocks[len(blocks)-1].Hash}})
+	if p, _ := w.Payment(tx.TxID()); p.Confirmations != len(blocks)+1 {
+		t.Fatalf("%d confirmations after a new block, want %d", p.Confirmations, len(blocks)+1)
+	}
+
+	w.ProcessTx(late)
+	if p, _ := w.Payment(late.TxID()); p.Confirmed {
+		t.Fatal("payment confirmed in a forgotten block")
+	}
+}
@@ -0,0 +1,104 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package typeconv
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+)
+
+var errVarIntLength = errors.New("Invalid varint length")
+
+// VarIntFromBytes decodes a bitcoin variable length integer from the start of b,
+// returning the value and number of bytes read
+func VarIntFromBytes(b []byte) (uint64, int, error) {
+	if len(b) < 1 {
+		return 0, 0, errVarIntLength
+	}
+	switch b[0] {
+	case 0xfd:
+		if len(b) < 3 {
+			return 0, 0, errVarIntLength
+		}
+		return uint64(binary.LittleEndian.Uint16(b[1:3])), 3, nil
+	case 0xfe:
+		if len(b) < 5 {
+			return 0, 0, errVarIntLength
+		}
+		return uint64(binary.LittleEndian.Uint32(b[1:5])), 5, nil
+	case 0xff:
+		if len(b) < 9 {
+			return 0, 0, errVarIntLength
+		}
+		return binary.LittleEndian.Uint64(b[1:9]), 9, nil
+	}
+	return uint64(b[0]), 1, nil
+}
+
+// BytesFromVarInt encodes i as a bitcoin variable length integer
+func BytesFromVarInt(i uint64) []byte {
+	switch {
+	case i < 0xfd:
+		return []byte{byte(i)}
+	case i <= 0xffff:
+		b := []byte{0xfd, 0, 0}
+		binary.LittleEndian.PutUint16(b[1:], uint16(i))
+		return b
+	case i <= 0xffffffff:
+		b := []byte{0xfe, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(b[1:], uint32(i))
+		return b
+	}
+	b := []byte{0xff, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint64(b[1:], i)
+	return b
+}
+
+// BytesFromVarString encodes b prefixed with its length as a variable length integer
+func BytesFromVarString(b []byte) []byte {
+	return append(BytesFromVarInt(uint64(len(b))), b...)
+}
+
+// DoubleHashFromBytes computes a twice iterated SHA256 of given slice
+func DoubleHashFromBytes(b []byte) [32]byte {
+	h := sha256.Sum256(b)
+	return sha256.Sum256(h[:])
+}
+
+// ReverseHash returns hash in reverse byte order, as used when displaying hashes
+func ReverseHash(h [32]byte) [32]byte {
+	for i, j := 0, len(h)-1; i < j; i, j = i+1, j-1 {
+		h[i], h[j] = h[j], h[i]
+	}
+	return h
+}
+
+// HashFromString decodes a hash displayed as hex, as returned by
+// blockchain explorers and RPC, into byte order used on the wire
+func HashFromString(s string) ([32]byte, error) {
+	var h [32]byte
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return h, err
+	}
+	if len(b) != len(h) {
+		return h, errors.New("hash must be 32 bytes")
+	}
+	copy(h[:], b)
+	return ReverseHash(h), nil
+}
@@ -0,0 +1,120 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package v2transport
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/sanscentral/sansnetwork/chacha20poly1305"
+)
+
+// Number of chunks or packets after which ciphers are rekeyed
+const rekeyInterval = 224
+
+// fsChaCha20 encrypts packet lengths, each call to crypt is one chunk of a
+// continuous keystream which is rekeyed from its own output every rekeyInterval chunks
+type fsChaCha20 struct {
+	c      *chacha20poly1305.Cipher
+	chunks uint32
+	rekeys uint64
+}
+
+func newFSChaCha20(key [32]byte) *fsChaCha20 {
+	return &fsChaCha20{c: chacha20poly1305.NewCipher(key, nonce(0, 0), 0)}
+}
+
+func (f *fsChaCha20) crypt(b []byte) {
+	f.c.XORKeyStream(b, b)
+	f.chunks++
+	if f.chunks == rekeyInterval {
+		var key [32]byte
+		f.c.Keystream(key[:])
+		f.c.SetKey(key)
+		f.rekeys++
+		f.c.Seek(nonce(0, f.rekeys), 0)
+		f.chunks = 0
+	}
+}
+
+// fsChaCha20Poly1305 encrypts packet contents with a new nonce per packet,
+// rekeying every rekeyInterval packets
+type fsChaCha20Poly1305 struct {
+	key     [32]byte
+	packets uint32
+	rekeys  uint64
+}
+
+func (f *fsChaCha20Poly1305) seal(plaintext, aad []byte) []byte {
+	ct := chacha20poly1305.Seal(f.key, nonce(f.packets, f.rekeys), plaintext, aad)
+	f.next()
+	return ct
+}
+
+func (f *fsChaCha20Poly1305) open(ciphertext, aad []byte) ([]byte, error) {
+	pt, err := chacha20poly1305.Open(f.key, nonce(f.packets, f.rekeys), ciphertext, aad)
+	f.next()
+	return pt, err
+}
+
+func (f *fsChaCha20Poly1305) next() {
+	f.packets++
+	if f.packets == rekeyInterval {
+		zero := make([]byte, 32)
+		copy(f.key[:], chacha20poly1305.Seal(f.key, nonce(0xffffffff, f.rekeys), zero, nil))
+		f.packets = 0
+		f.rekeys++
+	}
+}
+
+// nonce encodes a 96 bit nonce as a little endian 32 bit and 64 bit counter
+func nonce(a uint32, b uint64) [chacha20poly1305.NonceSize]byte {
+	var n [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint32(n[0:], a)
+	binary.LittleEndian.PutUint64(n[4:], b)
+	return n
+}
+
+// hkdfExtract and hkdfExpand32 implement HKDF-SHA256 (RFC 5869) for 32 byte outputs
+func hkdfExtract(salt, ikm []byte) []byte {
+	m := hmac.New(sha256.New, salt)
+	m.Write(ikm)
+	return m.Sum(nil)
+}
+
+func hkdfExpand32(prk []byte, info string) [32]byte {
+	m := hmac.New(sha256.New, prk)
+	m.Write([]byte(info))
+	m.Write([]byte{1})
+	var out [32]byte
+	copy(out[:], m.Sum(nil))
+	return out
+}
+
+// taggedHash is SHA256(SHA256(tag) || SHA256(tag) || msg) (BIP0340)
+func taggedHash(tag string, msg ...[]byte) [32]byte {
+	t := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(t[:])
+	h.Write(t[:])
+	for _, m := range msg {
+		h.Write(m)
+	}
+	var out [32]byte
+	copy(out[:], h.Sum(nil))
+	return out
+}
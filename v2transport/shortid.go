@@ -0,0 +1,60 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package v2transport
+
+import "github.com/sanscentral/sansnetwork/message"
+
+// shortIDs maps one byte message type ids to commands (BIP0324), index 0
+// means the command follows in full
+var shortIDs = []string{
+	"",
+	message.CommandAddr,
+	message.CommandBlock,
+	message.CommandBlockTxn,
+	message.CommandCmpctBlock,
+	message.CommandFeeFilter,
+	message.CommandFilterAdd,
+	message.CommandFilterClear,
+	message.CommandFilterLoad,
+	message.CommandGetBlocks,
+	message.CommandGetBlockTxn,
+	message.CommandGetData,
+	message.CommandGetHeaders,
+	message.CommandHeaders,
+	message.CommandInventory,
+	message.CommandMempool,
+	message.CommandMerkleBlock,
+	message.CommandNotFound,
+	message.CommandPing,
+	message.CommandPong,
+	message.CommandSendCmpct,
+	message.CommandTx,
+	message.CommandGetCFilters,
+	message.CommandCFilter,
+	message.CommandGetCFHeaders,
+	message.CommandCFHeaders,
+	message.CommandGetCFCheckpt,
+	message.CommandCFCheckpt,
+	message.CommandAddrV2,
+}
+
+var shortIDByCommand = func() map[string]byte {
+	m := map[string]byte{}
+	for i, c := range shortIDs[1:] {
+		m[c] = byte(i + 1)
+	}
+	return m
+}()
@@ -0,0 +1,393 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package v2transport implements the BIP0324 encrypted transport. A Conn
+// translates between v1 framed messages and encrypted v2 packets so the
+// message layer is unaware which transport is in use
+package v2transport
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/secp256k1"
+	"github.com/sanscentral/sansnetwork/typeconv"
+)
+
+const (
+	// MaxGarbageLength is the most garbage bytes allowed after the public key
+	MaxGarbageLength = 4095
+
+	garbageTerminatorLength = 16
+	lengthFieldLength       = 3
+	packetHeaderLength      = 1
+	ignoreBit               = 0x80
+	commandLength           = 12
+)
+
+var (
+	// ErrV1Peer is returned by Initiate when the peer does not speak v2, the
+	// connection must be closed and a new v1 connection made instead
+	ErrV1Peer = errors.New("peer does not support v2 transport")
+
+	// ErrNoGarbageTerminator is returned when the garbage terminator is not found
+	ErrNoGarbageTerminator = errors.New("v2 garbage terminator not found")
+
+	// ErrPacketTooLarge is returned for packets which cannot hold a valid message
+	ErrPacketTooLarge = errors.New("v2 packet too large")
+)
+
+// Conn is an established v2 connection. Writes take complete or partial v1
+// framed messages, reads return v1 framed messages
+type Conn struct {
+	net.Conn
+	testnet   bool
+	sessionID [32]byte
+
+	rmu   sync.Mutex
+	r     *bufio.Reader
+	recvL *fsChaCha20
+	recvP *fsChaCha20Poly1305
+	rbuf  []byte // Decoded v1 bytes not yet read
+
+	wmu   sync.Mutex
+	sendL *fsChaCha20
+	sendP *fsChaCha20Poly1305
+	wbuf  []byte // Written v1 bytes not yet forming a whole message
+}
+
+// SessionID returns the session id both sides derive, which may be compared
+// out of band to detect a man in the middle
+func (c *Conn) SessionID() [32]byte {
+	return c.sessionID
+}
+
+// Initiate performs the v2 handshake as the connecting side, closing conn on
+// failure. ErrV1Peer is returned if the peer closes the connection before
+// sending its public key, as v1 nodes do on receiving one
+func Initiate(conn net.Conn, testnet bool) (*Conn, error) {
+	c := &Conn{Conn: conn, testnet: testnet, r: bufio.NewReader(conn)}
+	w := newAsyncWriter(conn)
+	if err := c.finish(w, c.handshake(w, true, nil)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Accept performs the v2 handshake as the accepting side, closing conn on
+// failure. If the peer starts a v1 handshake instead, a connection replaying
+// its bytes is returned
+func Accept(conn net.Conn, testnet bool) (net.Conn, error) {
+	r := bufio.NewReader(conn)
+	v1Prefix := message.NewMessage(message.CommandVersion, nil, testnet)[:16]
+	prefix := make([]byte, len(v1Prefix))
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if bytes.Equal(prefix, v1Prefix) {
+		return &prefixConn{Conn: conn, r: io.MultiReader(bytes.NewReader(prefix), r)}, nil
+	}
+
+	c := &Conn{Conn: conn, testnet: testnet, r: r}
+	w := newAsyncWriter(conn)
+	if err := c.finish(w, c.handshake(w, false, prefix)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// finish waits for the handshake writes, closing the connection if the handshake failed
+func (c *Conn) finish(w *asyncWriter, err error) error {
+	if err != nil {
+		c.Conn.Close()
+	}
+	if werr := w.close(); err == nil && werr != nil {
+		c.Conn.Close()
+		err = werr
+	}
+	return err
+}
+
+// handshake exchanges keys, garbage and version packets. prefix holds
+// bytes of the peer's public key already read
+func (c *Conn) handshake(w *asyncWriter, initiator bool, prefix []byte) error {
+	priv, ours, err := secp256k1.GenerateEllSwiftKey()
+	if err != nil {
+		return err
+	}
+	garbage, err := randomGarbage()
+	if err != nil {
+		return err
+	}
+	w.write(append(ours[:], garbage...))
+
+	var theirs [secp256k1.EllSwiftSize]byte
+	copy(theirs[:], prefix)
+	if _, err := io.ReadFull(c.r, theirs[len(prefix):]); err != nil {
+		if initiator && len(prefix) == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF || isReset(err)) {
+			return ErrV1Peer
+		}
+		return err
+	}
+
+	sendTerminator, recvTerminator, err := c.deriveKeys(priv, ours, theirs, initiator)
+	if err != nil {
+		return err
+	}
+
+	// Version packet, its contents are reserved for future extensions
+	w.write(append(sendTerminator, c.encrypt(nil, garbage, false)...))
+
+	recvGarbage, err := c.readGarbage(recvTerminator)
+	if err != nil {
+		return err
+	}
+	aad := recvGarbage
+	for {
+		ignore, _, err := c.readPacket(aad)
+		if err != nil {
+			return err
+		}
+		aad = nil
+		if !ignore {
+			return nil
+		}
+	}
+}
+
+// deriveKeys computes the shared secret and initialises the ciphers,
+// returning the garbage terminators to send and expect
+func (c *Conn) deriveKeys(priv [32]byte, ours, theirs [secp256k1.EllSwiftSize]byte, initiator bool) ([]byte, []byte, error) {
+	x, err := secp256k1.EllSwiftECDH(theirs, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	first, second := ours, theirs
+	if !initiator {
+		first, second = theirs, ours
+	}
+	secret := taggedHash("bip324_ellswift_xonly_ecdh", first[:], second[:], x[:])
+
+	salt := append([]byte("bitcoin_v2_shared_secret"), message.MagicBytes(c.testnet)...)
+	prk := hkdfExtract(salt, secret[:])
+	initiatorL := hkdfExpand32(prk, "initiator_L")
+	initiatorP := hkdfExpand32(prk, "initiator_P")
+	responderL := hkdfExpand32(prk, "responder_L")
+	responderP := hkdfExpand32(prk, "responder_P")
+	terminators := hkdfExpand32(prk, "garbage_terminators")
+	c.sessionID = hkdfExpand32(prk, "session_id")
+
+	if initiator {
+		c.sendL, c.sendP = newFSChaCha20(initiatorL), &fsChaCha20Poly1305{key: initiatorP}
+		c.recvL, c.recvP = newFSChaCha20(responderL), &fsChaCha20Poly1305{key: responderP}
+		return terminators[:16], terminators[16:], nil
+	}
+	c.sendL, c.sendP = newFSChaCha20(responderL), &fsChaCha20Poly1305{key: responderP}
+	c.recvL, c.recvP = newFSChaCha20(initiatorL), &fsChaCha20Poly1305{key: initiatorP}
+	return terminators[16:], terminators[:16], nil
+}
+
+// readGarbage reads up to and including the garbage terminator, returning the garbage
+func (c *Conn) readGarbage(terminator []byte) ([]byte, error) {
+	buf := make([]byte, 0, 64)
+	for len(buf) <= MaxGarbageLength+garbageTerminatorLength {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, b)
+		if len(buf) >= garbageTerminatorLength && bytes.Equal(buf[len(buf)-garbageTerminatorLength:], terminator) {
+			return buf[:len(buf)-garbageTerminatorLength], nil
+		}
+	}
+	return nil, ErrNoGarbageTerminator
+}
+
+// encrypt returns the packet for contents
+func (c *Conn) encrypt(contents, aad []byte, ignore bool) []byte {
+	plaintext := make([]byte, packetHeaderLength, packetHeaderLength+len(contents))
+	if ignore {
+		plaintext[0] = ignoreBit
+	}
+	plaintext = append(plaintext, contents...)
+
+	n := len(contents)
+	length := []byte{byte(n), byte(n >> 8), byte(n >> 16)}
+	c.sendL.crypt(length)
+	return append(length, c.sendP.seal(plaintext, aad)...)
+}
+
+// readPacket reads and decrypts the next packet
+func (c *Conn) readPacket(aad []byte) (bool, []byte, error) {
+	length := make([]byte, lengthFieldLength)
+	if _, err := io.ReadFull(c.r, length); err != nil {
+		return false, nil, err
+	}
+	c.recvL.crypt(length)
+	n := int(length[0]) | int(length[1])<<8 | int(length[2])<<16
+	if n > 1+commandLength+message.MaxPayloadLength {
+		return false, nil, ErrPacketTooLarge
+	}
+
+	ct := make([]byte, packetHeaderLength+n+16)
+	if _, err := io.ReadFull(c.r, ct); err != nil {
+		return false, nil, err
+	}
+	pt, err := c.recvP.open(ct, aad)
+	if err != nil {
+		return false, nil, err
+	}
+	return pt[0]&ignoreBit != 0, pt[packetHeaderLength:], nil
+}
+
+// Read returns v1 framed messages decoded from received packets
+func (c *Conn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.rbuf) == 0 {
+		ignore, contents, err := c.readPacket(nil)
+		if err != nil {
+			return 0, err
+		}
+		if ignore || len(contents) == 0 {
+			continue
+		}
+
+		var cmd string
+		if contents[0] == 0 {
+			if len(contents) < 1+commandLength {
+				return 0, errors.New("v2 message type truncated")
+			}
+			cmd = typeconv.CleanStringFromBytes(contents[1 : 1+commandLength])
+			contents = contents[1+commandLength:]
+		} else if int(contents[0]) < len(shortIDs) {
+			cmd = shortIDs[contents[0]]
+			contents = contents[1:]
+		} else {
+			// Unknown message types are ignored as unknown v1 commands are
+			continue
+		}
+		c.rbuf = message.NewMessage(cmd, contents, c.testnet)
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+// Write encrypts each complete v1 framed message written as a v2 packet
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.wbuf = append(c.wbuf, b...)
+
+	out := []byte{}
+	for len(c.wbuf) >= message.HeaderLength() {
+		h, err := message.ParseHeader(c.wbuf[:message.HeaderLength()])
+		if err != nil {
+			return 0, err
+		}
+		end := message.HeaderLength() + int(typeconv.Uint32FromBytes(h.PayloadLen[:]))
+		if len(c.wbuf) < end {
+			break
+		}
+		cmd := typeconv.CleanStringFromBytes(h.Command[:])
+		payload := c.wbuf[message.HeaderLength():end]
+
+		var contents []byte
+		if id, ok := shortIDByCommand[cmd]; ok {
+			contents = append([]byte{id}, payload...)
+		} else {
+			contents = append([]byte{0}, h.Command[:]...)
+			contents = append(contents, payload...)
+		}
+		out = append(out, c.encrypt(contents, nil, false)...)
+		c.wbuf = c.wbuf[end:]
+	}
+
+	if len(out) > 0 {
+		if _, err := c.Conn.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// randomGarbage returns up to MaxGarbageLength random bytes
+func randomGarbage() ([]byte, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(MaxGarbageLength+1))
+	if err != nil {
+		return nil, err
+	}
+	garbage := make([]byte, n.Int64())
+	_, err = rand.Read(garbage)
+	return garbage, err
+}
+
+// isReset reports whether err is the peer resetting the connection
+func isReset(err error) bool {
+	if op, ok := err.(*net.OpError); ok {
+		return !op.Timeout()
+	}
+	return false
+}
+
+// prefixConn replays bytes already read from a connection before reading it further
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// asyncWriter writes to a connection in the background so a handshake can
+// read while its writes are pending, as an unbuffered pipe requires
+type asyncWriter struct {
+	ch   chan []byte
+	done chan error
+}
+
+func newAsyncWriter(conn net.Conn) *asyncWriter {
+	w := &asyncWriter{ch: make(chan []byte, 4), done: make(chan error, 1)}
+	go func() {
+		var err error
+		for b := range w.ch {
+			if err == nil {
+				_, err = conn.Write(b)
+			}
+		}
+		w.done <- err
+	}()
+	return w
+}
+
+func (w *asyncWriter) write(b []byte) {
+	w.ch <- b
+}
+
+// close waits for pending writes and returns the first error
+func (w *asyncWriter) close() error {
+	close(w.ch)
+	return <-w.done
+}
@@ -0,0 +1,107 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package v2transport
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/sanscentral/sansnetwork/message"
+)
+
+// pipePair returns the two ends of an in-memory pipe after the v2 handshake
+func pipePair(t *testing.T) (*Conn, *Conn) {
+	a, b := net.Pipe()
+	accepted := make(chan net.Conn, 1)
+	errc := make(chan error, 1)
+	go func() {
+		c, err := Accept(b, false)
+		accepted <- c
+		errc <- err
+	}()
+	initiator, err := Initiate(a, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	responder, ok := (<-accepted).(*Conn)
+	if !ok {
+		t.Fatal("accepted connection is not v2")
+	}
+	return initiator, responder
+}
+
+// Messages are sent across several rekeys of both the length and packet ciphers
+func TestPipeRoundTrip(t *testing.T) {
+	a, b := pipePair(t)
+	defer a.Close()
+	defer b.Close()
+	if a.SessionID() != b.SessionID() {
+		t.Fatal("session ids differ")
+	}
+
+	const count = 3*rekeyInterval + 5
+	msgs := make([][]byte, count)
+	for i := range msgs {
+		payload := bytes.Repeat([]byte{byte(i)}, i%300)
+		cmd := message.CommandPing
+		if i%2 == 1 {
+			// Not in the short id table
+			cmd = "unknowncmd"
+		}
+		msgs[i] = message.NewMessage(cmd, payload, false)
+	}
+
+	go func() {
+		for _, m := range msgs {
+			if _, err := a.Write(m); err != nil {
+				return
+			}
+		}
+	}()
+	for i, want := range msgs {
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(b, got); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("message %d differs", i)
+		}
+	}
+}
+
+func TestAcceptV1(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	version := message.NewMessage(message.CommandVersion, []byte{1, 2, 3}, false)
+	go a.Write(version)
+	c, err := Accept(b, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, ok := c.(*Conn); ok {
+		t.Fatal("v1 peer accepted as v2")
+	}
+	got := make([]byte, len(version))
+	if _, err := io.ReadFull(c, got); err != nil || !bytes.Equal(got, version) {
+		t.Fatalf("v1 bytes not replayed: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+/*
+	SansNetwork is a  library for direct Bitcoin protocol interaction
+	Copyright (C) 2018 Sans Central
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as
+	published by the Free Software Foundation, either version 3 of the
+	License, or (at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sansnetwork
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sanscentral/sansnetwork/chain"
+	"github.com/sanscentral/sansnetwork/message"
+	"github.com/sanscentral/sansnetwork/node"
+	"github.com/sanscentral/sansnetwork/spv"
+)
+
+// Watcher keeps a watch list's bloom filter loaded on every node in the
+// pool and feeds it relayed transactions and filtered blocks
+type Watcher struct {
+	c         *NetworkConnection
+	w         *spv.WatchList
+	subs      []*node.Subscription
+	wsub      *spv.Subscription
+	chainSub  *chain.Subscription
+	mu        sync.Mutex
+	requested map[[32]byte]time.Time
+}
+
+// Watch loads the filter of w on every node in the pool, including nodes
+// connected later, and fetches a filtered block for every new block announced
+func (c *NetworkConnection) Watch(w *spv.WatchList) *Watcher {
+	wt := &Watcher{
+		c:         c,
+		w:         w,
+		requested: map[[32]byte]time.Time{},
+	}
+	wt.subs = []*node.Subscription{
+		c.Subscribe(node.ByType(node.EventPeerConnected), func(e node.Event) {
+			e.Peer.LoadFilter(w.Filter())
+		}),
+		c.SubscribeNewBlocks(wt.handleNewBlock),
+		c.Subscribe(node.ByCommand(message.CommandTx), func(e node.Event) {
+			if tx, ok := e.Message.(message.Tx); ok {
+				w.ProcessTx(tx)
+			}
+		}),
+		c.Subscribe(node.ByType(node.EventFilteredBlock), func(e node.Event) {
+			if fb, ok := e.Message.(node.FilteredBlock); ok {
+				wt.mu.Lock()
+				delete(wt.requested, fb.Hash)
+				wt.mu.Unlock()
+				w.ProcessFilteredBlock(fb)
+			}
+		}),
+	}
+	wt.wsub = w.Subscribe(func(e spv.Event) {
+		if e.Type == spv.EventFilterChanged {
+			wt.loadFilters()
+		}
+	})
+	wt.loadFilters()
+	return wt
+}
+
+// FollowChain counts payment confirmations in the header chain ch, which
+// should be kept up to date with SyncHeaders and FollowChain on the pool
+func (wt *Watcher) FollowChain(ch *chain.Chain) {
+	wt.mu.Lock()
+	if wt.chainSub != nil {
+		wt.chainSub.Unsubscribe()
+	}
+	wt.chainSub = ch.Subscribe(func(chain.Event) {
+		wt.w.UpdateConfirmations()
+	})
+	wt.mu.Unlock()
+	wt.w.SetHeaderChain(ch)
+}
+
+// Stop stops feeding the watch list and clears the filter from every node
+func (wt *Watcher) Stop() {
+	for _, s := range wt.subs {
+		s.Unsubscribe()
+	}
+	wt.wsub.Unsubscribe()
+	wt.mu.Lock()
+	if wt.chainSub != nil {
+		wt.chainSub.Unsubscribe()
+	}
+	wt.mu.Unlock()
+	for _, n := range wt.c.Nodes() {
+		n.ClearFilter()
+	}
+}
+
+// FetchBlocks requests filtered blocks for the given block hashes, for example
+// to rescan blocks mined before the watch list was created
+func (wt *Watcher) FetchBlocks(hashes [][32]byte) error {
+	for _, n := range wt.c.Nodes() {
+		if n.Filter() != nil {
+			return n.GetFilteredBlocks(hashes)
+		}
+	}
+	return errors.New("no node with a loaded filter")
+}
+
+// loadFilters sends the current filter to every node
+func (wt *Watcher) loadFilters() {
+	f := wt.w.Filter()
+	for _, n := range wt.c.Nodes() {
+		n.LoadFilter(f)
+	}
+}
+
+// handleNewBlock requests a filtered block for each new block announced,
+// whether nodes announce it with inv, headers or compact blocks
+func (wt *Watcher) handleNewBlock(peer *node.Connection, header message.BlockHeader) {
+	if peer.Filter() == nil {
+		return
+	}
+	hash := header.BlockHash()
+	now := time.Now()
+	wt.mu.Lock()
+	for h, t := range wt.requested {
+		if now.Sub(t) >= getDataTimeoutSec*time.Second {
+			delete(wt.requested, h)
+		}
+	}
+	_, requested := wt.requested[hash]
+	if !requested {
+		wt.requested[hash] = now
+	}
+	wt.mu.Unlock()
+
+	if requested {
+		return
+	}
+	if err := peer.GetFilteredBlocks([][32]byte{hash}); err != nil {
+		wt.mu.Lock()
+		delete(wt.requested, hash)
+		wt.mu.Unlock()
+	}
+}